@@ -0,0 +1,124 @@
+// Aho-Corasick multi-pattern matching. Every pattern is compiled into one
+// automaton when the configuration is loaded, so a text is scanned once
+// no matter how many patterns there are.
+package main
+
+// acNode is a state of the automaton. States are stored in one slice and
+// refer to each other by index.
+type acNode struct {
+	next map[byte]int32
+
+	// The longest proper suffix of this state that is also a state
+	fail int32
+
+	// The pattern that ends here (-1 if none), and the nearest state on
+	// the fail chain where a pattern ends (-1 if none)
+	pattern int32
+	output  int32
+}
+
+// ahoCorasick matches a fixed set of byte patterns
+type ahoCorasick struct {
+	nodes []acNode
+}
+
+// newAhoCorasick builds an automaton for patterns. Matches report the
+// index of the pattern in patterns; empty patterns never match.
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	ac := &ahoCorasick{nodes: []acNode{{next: make(map[byte]int32), pattern: -1, output: -1}}}
+
+	for i, p := range patterns {
+		if p == "" {
+			continue
+		}
+
+		state := int32(0)
+		for j := 0; j < len(p); j++ {
+			next, ok := ac.nodes[state].next[p[j]]
+			if !ok {
+				next = int32(len(ac.nodes))
+				ac.nodes = append(ac.nodes, acNode{next: make(map[byte]int32), pattern: -1, output: -1})
+				ac.nodes[state].next[p[j]] = next
+			}
+			state = next
+		}
+
+		// The first of duplicate patterns wins
+		if ac.nodes[state].pattern < 0 {
+			ac.nodes[state].pattern = int32(i)
+		}
+	}
+
+	// Breadth first, so a state's fail target is finished before it
+	queue := make([]int32, 0, len(ac.nodes))
+	for _, child := range ac.nodes[0].next {
+		queue = append(queue, child)
+	}
+
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+
+		for b, child := range ac.nodes[state].next {
+			fail := ac.nodes[state].fail
+			for {
+				if target, ok := ac.nodes[fail].next[b]; ok {
+					ac.nodes[child].fail = target
+					break
+				}
+				if fail == 0 {
+					ac.nodes[child].fail = 0
+					break
+				}
+				fail = ac.nodes[fail].fail
+			}
+
+			target := ac.nodes[child].fail
+			if ac.nodes[target].pattern >= 0 {
+				ac.nodes[child].output = target
+			} else {
+				ac.nodes[child].output = ac.nodes[target].output
+			}
+
+			queue = append(queue, child)
+		}
+	}
+
+	return ac
+}
+
+// step follows b from state, falling back along fail links
+func (ac *ahoCorasick) step(state int32, b byte) int32 {
+	for {
+		if next, ok := ac.nodes[state].next[b]; ok {
+			return next
+		}
+		if state == 0 {
+			return 0
+		}
+		state = ac.nodes[state].fail
+	}
+}
+
+// FindFirst returns the pattern of the match that ends first in text
+// (for matches ending at the same byte, the longest), or -1 if no pattern
+// occurs in text
+func (ac *ahoCorasick) FindFirst(text string) int {
+	if ac == nil || len(ac.nodes) == 1 {
+		return -1
+	}
+
+	state := int32(0)
+	for i := 0; i < len(text); i++ {
+		state = ac.step(state, text[i])
+
+		if p := ac.nodes[state].pattern; p >= 0 {
+			return int(p)
+		}
+		if out := ac.nodes[state].output; out >= 0 {
+			return int(ac.nodes[out].pattern)
+		}
+	}
+
+	return -1
+}
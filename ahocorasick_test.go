@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAhoCorasickFindFirst(t *testing.T) {
+	ac := newAhoCorasick([]string{"he", "she", "his", "hers", "", "she"})
+
+	var tests = []struct {
+		Text   string
+		Output int
+	}{
+		{"ushers", 1},
+		{"ahis", 2},
+		{"her", 0},
+		{"xyz", -1},
+		{"", -1},
+		{"sh", -1},
+		// "hers" is only found through a fail link from "she"
+		{"shers", 1},
+	}
+
+	for _, test := range tests {
+		if got := ac.FindFirst(test.Text); got != test.Output {
+			t.Errorf("FindFirst(%q) = %v, want %v", test.Text, got, test.Output)
+		}
+	}
+}
+
+func TestAhoCorasickOutputLinks(t *testing.T) {
+	// "bcd" ends inside "abcde", which is never completed
+	ac := newAhoCorasick([]string{"abcde", "bcd", "c"})
+
+	if got := ac.FindFirst("xabcx"); got != 2 {
+		t.Errorf("Expected the shorter pattern c reached through an output link, got %v", got)
+	}
+
+	ac = newAhoCorasick([]string{"abcde", "bcd"})
+	if got := ac.FindFirst("abcdx"); got != 1 {
+		t.Errorf("Expected bcd reached through a fail link, got %v", got)
+	}
+}
+
+func TestAhoCorasickEmpty(t *testing.T) {
+	var ac *ahoCorasick
+	if got := ac.FindFirst("text"); got != -1 {
+		t.Errorf("A nil automaton matched %v", got)
+	}
+
+	if got := newAhoCorasick(nil).FindFirst("text"); got != -1 {
+		t.Errorf("An empty automaton matched %v", got)
+	}
+}
+
+func TestAhoCorasickMatchesNaive(t *testing.T) {
+	patterns := []string{"ab", "bab", "abab", "b", "aab", "bba"}
+	ac := newAhoCorasick(patterns)
+
+	// Compare against the earliest ending match found by brute force
+	for _, text := range []string{"aabba", "babab", "aaaa", "bbbb", "abba", "aabab"} {
+		want, wantEnd, wantLen := -1, len(text)+1, 0
+		for i, p := range patterns {
+			if idx := strings.Index(text, p); idx >= 0 {
+				end := idx + len(p)
+				if end < wantEnd || (end == wantEnd && len(p) > wantLen) {
+					want, wantEnd, wantLen = i, end, len(p)
+				}
+			}
+		}
+
+		if got := ac.FindFirst(text); got != want {
+			t.Errorf("FindFirst(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Tweets that make it through processTweet are described as an
+// ApprovedItem and handed to every configured sink (webhooks, etc.)
+package main
+
+import (
+	"fmt"
+	"github.com/davidk/anaconda"
+	"strings"
+	"time"
+)
+
+// ApprovedItem is a portable description of an approved tweet. It is
+// what we send to (and store for) anything downstream of the bot.
+type ApprovedItem struct {
+	TweetID     int64       `json:"tweet_id"`
+	TweetIDStr  string      `json:"tweet_id_str"`
+	URL         string      `json:"url"`
+	Author      ItemAuthor  `json:"author"`
+	Text        string      `json:"text"`
+	ContentType string      `json:"content_type"`
+	Media       []ItemMedia `json:"media"`
+	CreatedAt   time.Time   `json:"created_at"`
+	ApprovedAt  time.Time   `json:"approved_at"`
+	Decision    *Decision   `json:"decision"`
+}
+
+// ItemAuthor is the originating account of an ApprovedItem
+type ItemAuthor struct {
+	ID         int64  `json:"id"`
+	ScreenName string `json:"screen_name"`
+	Name       string `json:"name"`
+}
+
+// ItemMedia holds the URLs for a single media entity. PosterURL is the
+// still image Twitter renders; VideoURL is the highest bitrate MP4 variant
+// (empty for non-video content).
+type ItemMedia struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	PosterURL string `json:"poster_url"`
+	VideoURL  string `json:"video_url,omitempty"`
+}
+
+// tweetMediaEntities gathers the media from all four entity sets that
+// checkTweetContent inspects. The same media is usually repeated across
+// sets, so entries are de-duplicated on their ID (or poster URL).
+func tweetMediaEntities(status anaconda.Tweet) []anaconda.EntityMedia {
+	var media []anaconda.EntityMedia
+	seen := make(map[string]bool)
+
+	for _, set := range [][]anaconda.EntityMedia{
+		status.Entities.Media,
+		status.ExtendedEntities.Media,
+		status.ExtendedTweet.Entities.Media,
+		status.ExtendedTweet.ExtendedEntities.Media,
+	} {
+		for _, m := range set {
+			key := m.Id_str
+			if key == "" {
+				key = m.Media_url_https
+			}
+			if key != "" && seen[key] {
+				continue
+			}
+			seen[key] = true
+			media = append(media, m)
+		}
+	}
+
+	return media
+}
+
+// bestVariant picks the highest bitrate MP4 variant of a video or gif.
+// Returns false if there is nothing usable (HLS playlists are skipped).
+func bestVariant(variants []anaconda.Variant) (anaconda.Variant, bool) {
+	var best anaconda.Variant
+	found := false
+
+	for _, v := range variants {
+		if !strings.EqualFold(v.ContentType, "video/mp4") || v.Url == "" {
+			continue
+		}
+		if !found || v.Bitrate > best.Bitrate {
+			best = v
+			found = true
+		}
+	}
+
+	return best, found
+}
+
+// tweetFullText returns the 280 character text if Twitter sent one,
+// otherwise the (possibly truncated) classic status text
+func tweetFullText(status anaconda.Tweet) string {
+	if status.ExtendedTweet.FullText != "" {
+		return status.ExtendedTweet.FullText
+	}
+	if status.FullText != "" {
+		return status.FullText
+	}
+	return status.Text
+}
+
+// newApprovedItem builds an ApprovedItem from a tweet that passed processTweet
+func newApprovedItem(status anaconda.Tweet, tweetType string, decision *Decision) ApprovedItem {
+	item := ApprovedItem{
+		TweetID:     status.Id,
+		TweetIDStr:  status.IdStr,
+		URL:         fmt.Sprintf("https://twitter.com/%s/status/%d", status.User.ScreenName, status.Id),
+		Author:      ItemAuthor{ID: status.User.Id, ScreenName: status.User.ScreenName, Name: status.User.Name},
+		Text:        tweetFullText(status),
+		ContentType: tweetType,
+		ApprovedAt:  time.Now().UTC(),
+		Decision:    decision,
+	}
+
+	if item.TweetIDStr == "" {
+		item.TweetIDStr = fmt.Sprintf("%d", status.Id)
+	}
+
+	if createdAt, err := time.Parse(time.RubyDate, status.CreatedAt); err == nil {
+		item.CreatedAt = createdAt.UTC()
+	}
+
+	for _, m := range tweetMediaEntities(status) {
+		media := ItemMedia{ID: m.Id_str, Type: m.Type, PosterURL: m.Media_url_https}
+		if v, ok := bestVariant(m.VideoInfo.Variants); ok {
+			media.VideoURL = v.Url
+		}
+		item.Media = append(item.Media, media)
+	}
+
+	return item
+}
+
+// handleApproved fans an approved tweet out to every configured sink
+func handleApproved(item ApprovedItem) {
+	publishWebhooks(config.Webhooks, item)
+	archiveApproved(item)
+	addToFeed(item)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/davidk/anaconda"
+	"path/filepath"
+	"testing"
+)
+
+// TestNewApprovedItem checks that media is collected from every entity set
+// without duplicates, and that the best MP4 variant is chosen
+func TestNewApprovedItem(t *testing.T) {
+	clip := anaconda.EntityMedia{
+		Id_str:          "42",
+		Type:            "video",
+		Media_url_https: "https://pbs.twimg.com/poster.jpg",
+		VideoInfo: anaconda.VideoInfo{
+			Variants: []anaconda.Variant{
+				{ContentType: "application/x-mpegURL", Url: "https://video.twimg.com/pl.m3u8"},
+				{ContentType: "video/mp4", Bitrate: 832000, Url: "https://video.twimg.com/low.mp4"},
+				{ContentType: "video/mp4", Bitrate: 2176000, Url: "https://video.twimg.com/high.mp4"},
+			},
+		},
+	}
+
+	status := anaconda.Tweet{
+		Id:        99,
+		CreatedAt: "Wed Aug 27 13:08:45 +0000 2008",
+		Text:      "truncated…",
+		User:      anaconda.User{Id: 7, ScreenName: "doctor_fluffy"},
+		Entities:  anaconda.Entities{Media: []anaconda.EntityMedia{clip}},
+		ExtendedEntities: anaconda.Entities{
+			Media: []anaconda.EntityMedia{clip},
+		},
+		ExtendedTweet: anaconda.ExtendedTweet{FullText: "the whole text"},
+	}
+
+	item := newApprovedItem(status, "video", &Decision{Verdict: "allow"})
+
+	if len(item.Media) != 1 {
+		t.Fatalf("Expected 1 media entry, got %v", len(item.Media))
+	}
+
+	if item.Media[0].VideoURL != "https://video.twimg.com/high.mp4" {
+		t.Errorf("Wrong variant chosen: %v", item.Media[0].VideoURL)
+	}
+
+	if item.Text != "the whole text" {
+		t.Errorf("Expected full text, got %v", item.Text)
+	}
+
+	if item.URL != "https://twitter.com/doctor_fluffy/status/99" || item.TweetIDStr != "99" {
+		t.Errorf("Unexpected URL/ID: %v %v", item.URL, item.TweetIDStr)
+	}
+
+	if item.CreatedAt.Year() != 2008 {
+		t.Errorf("created_at was not parsed: %v", item.CreatedAt)
+	}
+}
+
+// TestRetweetApprovedTestMode ensures tweets approved in test mode, which
+// are never retweeted, don't reach webhooks, the archive or the feed
+func TestRetweetApprovedTestMode(t *testing.T) {
+	defer func(store *FeedStore, testMode bool) {
+		feedStore, config.TestMode = store, testMode
+	}(feedStore, config.TestMode)
+
+	store, err := NewFeedStore(filepath.Join(t.TempDir(), "feed.json"), 10)
+	if err != nil {
+		t.Fatalf("NewFeedStore: %v", err)
+	}
+	feedStore = store
+
+	status := anaconda.Tweet{Id: 4242, IdStr: "4242", User: anaconda.User{ScreenName: "someone"}}
+
+	config.TestMode = true
+	if !retweetApproved(FakeAPIRetweet{}, status, "video", &Decision{}, nil) {
+		t.Fatal("Expected the tweet to be approved")
+	}
+
+	if items := store.Items(); len(items) != 0 {
+		t.Errorf("Test mode added %d items to the feed", len(items))
+	}
+
+	config.TestMode = false
+	retweetApproved(FakeAPIRetweet{}, status, "video", &Decision{}, nil)
+
+	if items := store.Items(); len(items) != 1 {
+		t.Errorf("Expected a retweet to reach the feed, got %d items", len(items))
+	}
+}
@@ -0,0 +1,383 @@
+// Local archive of approved media. Files are stored under their SHA-256
+// hash (so re-posts of the same clip are only stored once), and each
+// approved tweet gets a JSON sidecar describing where its files are.
+//
+//	<directory>/media/<sha256><ext>
+//	<directory>/items/<tweet id>.json
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultArchiveAttempts       = 3
+	defaultArchiveBackoffSeconds = 5
+
+	// Name prefix of downloads that haven't been moved into place yet
+	archiveTempPrefix = ".download-"
+)
+
+var (
+	// archiver is nil unless an archive directory is configured
+	archiver *Archiver
+
+	// Unit for archive download backoff. Tests shrink this.
+	archiveBackoffUnit = time.Second
+
+	mediaClient = &http.Client{Timeout: 5 * time.Minute}
+
+	// errArchiveQuota is returned when a download would go over quota_mb
+	errArchiveQuota = errors.New("archive quota exceeded")
+
+	archiveOperations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "archive_operations",
+			Help: "Number of media files handled by the archiver, by outcome.",
+		},
+		// result == stored, duplicate, retry, quota, failed
+		[]string{"result"},
+	)
+)
+
+// ArchiveConfig configures the local media archive
+type ArchiveConfig struct {
+	Directory      string `json:"directory"`
+	QuotaMB        int64  `json:"quota_mb"`
+	MaxAttempts    int    `json:"max_attempts"`
+	BackoffSeconds int    `json:"backoff_seconds"`
+}
+
+// ArchivedFile is a downloaded media file belonging to an ArchivedItem
+type ArchivedFile struct {
+	MediaID   string `json:"media_id"`
+	Kind      string `json:"kind"` // video or poster
+	SourceURL string `json:"source_url"`
+	SHA256    string `json:"sha256"`
+	Path      string `json:"path"` // relative to the archive directory
+	Size      int64  `json:"size"`
+}
+
+// ArchivedItem is the JSON sidecar written for every archived tweet
+type ArchivedItem struct {
+	ApprovedItem
+	ArchivedAt time.Time      `json:"archived_at"`
+	Files      []ArchivedFile `json:"files"`
+}
+
+// Archiver downloads media for approved items into a directory
+type Archiver struct {
+	Directory   string
+	Quota       int64 // bytes, 0 == unlimited
+	MaxAttempts int
+	Backoff     time.Duration
+
+	// bytes currently used under media/
+	used int64
+	sync.Mutex
+}
+
+// NewArchiver prepares the archive directory and totals what is already
+// stored in it, so the quota holds across restarts
+func NewArchiver(c ArchiveConfig) (*Archiver, error) {
+	a := &Archiver{
+		Directory:   c.Directory,
+		Quota:       c.QuotaMB * 1024 * 1024,
+		MaxAttempts: c.MaxAttempts,
+		Backoff:     time.Duration(c.BackoffSeconds) * archiveBackoffUnit,
+	}
+
+	if a.MaxAttempts <= 0 {
+		a.MaxAttempts = defaultArchiveAttempts
+	}
+
+	if c.BackoffSeconds <= 0 {
+		a.Backoff = defaultArchiveBackoffSeconds * archiveBackoffUnit
+	}
+
+	for _, dir := range []string{"media", "items"} {
+		if err := os.MkdirAll(filepath.Join(a.Directory, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(a.Directory, "media"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		// Partial downloads left behind by a crash or restart
+		if strings.HasPrefix(f.Name(), archiveTempPrefix) {
+			if err := os.Remove(filepath.Join(a.Directory, "media", f.Name())); err != nil {
+				log.Warnf("NewArchiver: Unable to remove partial download %v: %v", f.Name(), err)
+			}
+			continue
+		}
+
+		a.used += f.Size()
+	}
+
+	log.Infof("NewArchiver: Archiving media to %v (%d bytes in use, quota: %d bytes)", a.Directory, a.used, a.Quota)
+
+	return a, nil
+}
+
+// ArchiveItem downloads the best video variant and poster image of every
+// media entry in item, then writes the item's sidecar. Files that fail
+// to download are left out of the sidecar.
+func (a *Archiver) ArchiveItem(item ApprovedItem) (ArchivedItem, error) {
+	archived := ArchivedItem{ApprovedItem: item}
+
+	for _, media := range item.Media {
+		for _, src := range []struct{ kind, url string }{
+			{"video", media.VideoURL},
+			{"poster", media.PosterURL},
+		} {
+			if src.url == "" {
+				continue
+			}
+
+			file, err := a.fetchWithRetry(src.url)
+			if err != nil {
+				log.Errorf("ArchiveItem: Unable to archive %v for tweet %v: %v", src.url, item.TweetID, err)
+				continue
+			}
+
+			file.MediaID = media.ID
+			file.Kind = src.kind
+			archived.Files = append(archived.Files, file)
+		}
+	}
+
+	archived.ArchivedAt = time.Now().UTC()
+
+	return archived, a.writeSidecar(archived)
+}
+
+// fetchWithRetry retries fetch with exponential backoff. Quota errors are
+// not retried.
+func (a *Archiver) fetchWithRetry(src string) (ArchivedFile, error) {
+	backoff := a.Backoff
+
+	var file ArchivedFile
+	var err error
+
+	for attempt := 1; attempt <= a.MaxAttempts; attempt++ {
+		if file, err = a.fetch(src); err == nil || err == errArchiveQuota {
+			break
+		}
+
+		if attempt < a.MaxAttempts {
+			log.Warnf("fetchWithRetry: Attempt %d/%d for %v failed, retrying in %v: %v", attempt, a.MaxAttempts, src, backoff, err)
+			archiveOperations.WithLabelValues("retry").Add(1)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	switch {
+	case err == errArchiveQuota:
+		archiveOperations.WithLabelValues("quota").Add(1)
+	case err != nil:
+		archiveOperations.WithLabelValues("failed").Add(1)
+	}
+
+	return file, err
+}
+
+// fetch downloads src into a temporary file while hashing it, then moves
+// it to its content address. If that address already exists the
+// download is discarded and does not count against the quota.
+func (a *Archiver) fetch(src string) (ArchivedFile, error) {
+	file := ArchivedFile{SourceURL: src}
+
+	remaining, ok := a.remaining()
+	if !ok {
+		return file, errArchiveQuota
+	}
+
+	resp, err := mediaClient.Get(src)
+	if err != nil {
+		return file, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return file, fmt.Errorf("fetching %v returned HTTP %d", src, resp.StatusCode)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(a.Directory, "media"), archiveTempPrefix)
+	if err != nil {
+		return file, err
+	}
+	defer os.Remove(tmp.Name())
+
+	var body io.Reader = resp.Body
+	if a.Quota > 0 {
+		// Read one byte past the quota so we can tell that it was hit
+		body = io.LimitReader(resp.Body, remaining+1)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return file, err
+	}
+
+	if a.Quota > 0 && size > remaining {
+		return file, errArchiveQuota
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return file, err
+	}
+
+	file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	file.Size = size
+	file.Path = path.Join("media", file.SHA256+mediaExtension(src))
+
+	dest := filepath.Join(a.Directory, filepath.FromSlash(file.Path))
+
+	a.Lock()
+	defer a.Unlock()
+
+	if _, err := os.Stat(dest); err == nil {
+		log.Infof("fetch: %v is already archived as %v", src, file.Path)
+		archiveOperations.WithLabelValues("duplicate").Add(1)
+		return file, nil
+	}
+
+	// Other downloads may have been stored since the quota was checked
+	if a.Quota > 0 && a.used+size > a.Quota {
+		return file, errArchiveQuota
+	}
+
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return file, err
+	}
+
+	a.used += size
+	archiveOperations.WithLabelValues("stored").Add(1)
+	log.Infof("fetch: Archived %v as %v (%d bytes)", src, file.Path, size)
+
+	return file, nil
+}
+
+// remaining returns the bytes left under quota, and false if none are
+func (a *Archiver) remaining() (int64, bool) {
+	if a.Quota <= 0 {
+		return 0, true
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	return a.Quota - a.used, a.used < a.Quota
+}
+
+// writeSidecar atomically writes items/<tweet id>.json
+func (a *Archiver) writeSidecar(item ArchivedItem) error {
+	data, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(a.Directory, "items", item.TweetIDStr+".json"), data, 0644)
+}
+
+// ArchivedSize reads the sidecar of a tweet for the size of the file
+// downloaded from src
+func (a *Archiver) ArchivedSize(tweetIDStr string, src string) (int64, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(a.Directory, "items", tweetIDStr+".json"))
+	if err != nil {
+		return 0, false
+	}
+
+	var item ArchivedItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return 0, false
+	}
+
+	for _, f := range item.Files {
+		if f.SourceURL == src && f.Size > 0 {
+			return f.Size, true
+		}
+	}
+
+	return 0, false
+}
+
+// mediaExtension keeps the extension of a media URL (.mp4, .jpg, ...)
+// so archived files can be served/opened without sniffing them
+func mediaExtension(src string) string {
+	u, err := url.Parse(src)
+	if err != nil {
+		return ""
+	}
+	return path.Ext(u.Path)
+}
+
+// writeFileAtomic writes data to a temporary file next to name, then
+// renames it into place so readers never see a partial file
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+// archiveApproved archives an item in the background if the archiver
+// is enabled
+func archiveApproved(item ApprovedItem) {
+	if archiver == nil {
+		return
+	}
+
+	go func() {
+		if _, err := archiver.ArchiveItem(item); err != nil {
+			log.Errorf("archiveApproved: Unable to write sidecar for tweet %v: %v", item.TweetID, err)
+		}
+	}()
+}
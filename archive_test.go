@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	archiveBackoffUnit = time.Millisecond
+}
+
+// TestArchiveItem downloads a video and poster from a stand-in media host.
+// The video fails once to exercise the retry, and the poster is served
+// twice under different URLs to check that it is only stored once.
+func TestArchiveItem(t *testing.T) {
+	video := []byte("not really an mp4")
+	poster := []byte("not really a jpeg")
+
+	var videoCalls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/clip.mp4":
+			if atomic.AddInt32(&videoCalls, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(video)
+		case "/poster.jpg", "/poster-again.jpg":
+			w.Write(poster)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	a, err := NewArchiver(ArchiveConfig{Directory: dir, BackoffSeconds: 1})
+	if err != nil {
+		t.Fatalf("NewArchiver: %v", err)
+	}
+
+	item := ApprovedItem{
+		TweetID:    99,
+		TweetIDStr: "99",
+		Author:     ItemAuthor{ID: 7, ScreenName: "doctor_fluffy"},
+		Text:       "Its anime day!",
+		Media: []ItemMedia{
+			{ID: "1", Type: "video", PosterURL: server.URL + "/poster.jpg?name=large", VideoURL: server.URL + "/clip.mp4"},
+			{ID: "2", Type: "photo", PosterURL: server.URL + "/poster-again.jpg"},
+		},
+	}
+
+	archived, err := a.ArchiveItem(item)
+	if err != nil {
+		t.Fatalf("ArchiveItem: %v", err)
+	}
+
+	if len(archived.Files) != 3 {
+		t.Fatalf("Expected 3 archived files, got %+v", archived.Files)
+	}
+
+	sum := sha256.Sum256(video)
+	if want := "media/" + hex.EncodeToString(sum[:]) + ".mp4"; archived.Files[0].Path != want {
+		t.Errorf("Video stored at %v, wanted %v", archived.Files[0].Path, want)
+	}
+
+	stored, err := ioutil.ReadFile(filepath.Join(dir, archived.Files[0].Path))
+	if err != nil || string(stored) != string(video) {
+		t.Errorf("Video content mismatch (err: %v)", err)
+	}
+
+	if archived.Files[1].SHA256 != archived.Files[2].SHA256 {
+		t.Error("Identical posters should share a content address")
+	}
+
+	if a.used != int64(len(video)+len(poster)) {
+		t.Errorf("Duplicate poster counted against quota. Used: %v", a.used)
+	}
+
+	var sidecar ArchivedItem
+	data, err := ioutil.ReadFile(filepath.Join(dir, "items", "99.json"))
+	if err != nil {
+		t.Fatalf("Sidecar missing: %v", err)
+	}
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		t.Fatalf("Sidecar is not JSON: %v", err)
+	}
+	if sidecar.Author.ScreenName != "doctor_fluffy" || sidecar.Text != item.Text || len(sidecar.Files) != 3 {
+		t.Errorf("Unexpected sidecar: %+v", sidecar)
+	}
+
+	// A restarted archiver picks up the existing usage
+	reopened, err := NewArchiver(ArchiveConfig{Directory: dir})
+	if err != nil || reopened.used != a.used {
+		t.Errorf("Reopened archive reports %v bytes, wanted %v (err: %v)", reopened.used, a.used, err)
+	}
+}
+
+// TestNewArchiverPartialDownloads ensures downloads a previous run left
+// unfinished are removed rather than counted against the quota
+func TestNewArchiverPartialDownloads(t *testing.T) {
+	dir := t.TempDir()
+	media := filepath.Join(dir, "media")
+
+	if err := os.MkdirAll(media, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{archiveTempPrefix + "123": 4096, "kept.mp4": 100} {
+		if err := ioutil.WriteFile(filepath.Join(media, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, err := NewArchiver(ArchiveConfig{Directory: dir})
+	if err != nil {
+		t.Fatalf("NewArchiver: %v", err)
+	}
+
+	if a.used != 100 {
+		t.Errorf("Expected 100 bytes in use, got %v", a.used)
+	}
+	if _, err := os.Stat(filepath.Join(media, archiveTempPrefix+"123")); !os.IsNotExist(err) {
+		t.Errorf("Partial download was not removed (err: %v)", err)
+	}
+}
+
+// TestArchiveQuota ensures a download that would go over quota is dropped
+func TestArchiveQuota(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 2048))
+	}))
+	defer server.Close()
+
+	a, err := NewArchiver(ArchiveConfig{Directory: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewArchiver: %v", err)
+	}
+	a.Quota = 1024
+
+	if _, err := a.fetchWithRetry(server.URL + "/big.mp4"); err != errArchiveQuota {
+		t.Errorf("Expected quota error, got %v", err)
+	}
+
+	if a.used != 0 {
+		t.Errorf("Rejected download was counted: %v", a.used)
+	}
+}
+
+// TestArchiveQuotaConcurrent ensures downloads running at the same time
+// can't go over quota together, as each of them fits on its own
+func TestArchiveQuotaConcurrent(t *testing.T) {
+	const downloads = 8
+
+	// Hold every response until all downloads have passed the quota check
+	var started sync.WaitGroup
+	started.Add(downloads)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		started.Wait()
+		body := make([]byte, 600)
+		copy(body, r.URL.Path)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	a, err := NewArchiver(ArchiveConfig{Directory: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewArchiver: %v", err)
+	}
+	a.Quota = 1024
+
+	var done sync.WaitGroup
+	var stored int32
+
+	for i := 0; i < downloads; i++ {
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			if _, err := a.fetch(fmt.Sprintf("%v/%d.mp4", server.URL, i)); err == nil {
+				atomic.AddInt32(&stored, 1)
+			} else if err != errArchiveQuota {
+				t.Errorf("Expected quota error, got %v", err)
+			}
+		}(i)
+	}
+	done.Wait()
+
+	if stored != 1 || a.used > a.Quota {
+		t.Errorf("Expected 1 download to fit in quota, got %d using %d bytes", stored, a.used)
+	}
+}
@@ -0,0 +1,429 @@
+// Shared blocklists. Neighboring communities trade lists of spam accounts
+// as CSV or JSON; `chim blocklist import` merges one into a local file and
+// `chim blocklist export` writes out the users chim denies. Local files
+// listed in mutes.blocklists are merged into the deny set, and reloaded
+// when they change.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Blocklist file formats
+const (
+	blocklistCSV  = "csv"
+	blocklistJSON = "json"
+)
+
+// How often local blocklist files are checked for changes
+const blocklistPollInterval = 10 * time.Second
+
+// The columns of a CSV blocklist, in order
+var blocklistColumns = []string{"user_id", "screen_name", "reason", "added_by", "expires_at"}
+
+// BlocklistEntry is a denied user in a local blocklist or the mute file.
+// Only UserID is required.
+type BlocklistEntry struct {
+	UserID     int64
+	ScreenName string
+	Reason     string
+	AddedBy    string
+	ExpiresAt  time.Time
+}
+
+// blocklistEntryJSON is the JSON form of a BlocklistEntry. expires_at is
+// left out when there is no expiry, and can be a date.
+type blocklistEntryJSON struct {
+	UserID     int64  `json:"user_id"`
+	ScreenName string `json:"screen_name,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	AddedBy    string `json:"added_by,omitempty"`
+	ExpiresAt  string `json:"expires_at,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (e BlocklistEntry) MarshalJSON() ([]byte, error) {
+	j := blocklistEntryJSON{UserID: e.UserID, ScreenName: e.ScreenName, Reason: e.Reason, AddedBy: e.AddedBy}
+	if !e.ExpiresAt.IsZero() {
+		j.ExpiresAt = e.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (e *BlocklistEntry) UnmarshalJSON(data []byte) error {
+	var j blocklistEntryJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	expires, err := parseBlocklistTime(j.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("invalid expires_at %q", j.ExpiresAt)
+	}
+
+	*e = BlocklistEntry{
+		UserID:     j.UserID,
+		ScreenName: strings.TrimPrefix(j.ScreenName, "@"),
+		Reason:     j.Reason,
+		AddedBy:    j.AddedBy,
+		ExpiresAt:  expires,
+	}
+
+	return nil
+}
+
+// denyFile is a local file of BlocklistEntries merged into the deny set
+type denyFile struct {
+	Name string
+	Path string
+}
+
+// denyFiles lists the mute file and every blocklist file in c
+func denyFiles(c MuteConfig) []denyFile {
+	var files []denyFile
+
+	if c.File != "" {
+		files = append(files, denyFile{Name: muteFileSource, Path: c.File})
+	}
+
+	for _, path := range c.Blocklists {
+		files = append(files, denyFile{Name: "blocklist " + filepath.Base(path), Path: path})
+	}
+
+	return files
+}
+
+// blocklistFormat picks a format from a file name, defaulting to JSON
+func blocklistFormat(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return blocklistCSV
+	}
+	return blocklistJSON
+}
+
+// parseBlocklistTime parses an expiry, either RFC 3339 or a date
+func parseBlocklistTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse("2006-01-02", value)
+}
+
+// readBlocklist reads entries in the given format. CSV columns follow
+// blocklistColumns; a header row and trailing columns are optional.
+func readBlocklist(r io.Reader, format string) ([]BlocklistEntry, error) {
+	var entries []BlocklistEntry
+
+	switch format {
+	case blocklistJSON:
+		if err := json.NewDecoder(r).Decode(&entries); err != nil && err != io.EOF {
+			return nil, err
+		}
+
+	case blocklistCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		reader.Comment = '#'
+
+		for line := 1; ; line++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+
+			if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), blocklistColumns[0]) {
+				continue
+			}
+
+			for len(record) < len(blocklistColumns) {
+				record = append(record, "")
+			}
+
+			id, err := strconv.ParseInt(strings.TrimSpace(record[0]), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid user_id %q", line, record[0])
+			}
+
+			expires, err := parseBlocklistTime(strings.TrimSpace(record[4]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid expires_at %q", line, record[4])
+			}
+
+			entries = append(entries, BlocklistEntry{
+				UserID:     id,
+				ScreenName: strings.TrimPrefix(strings.TrimSpace(record[1]), "@"),
+				Reason:     record[2],
+				AddedBy:    record[3],
+				ExpiresAt:  expires,
+			})
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown blocklist format %q", format)
+	}
+
+	for i, e := range entries {
+		if e.UserID == 0 {
+			return nil, fmt.Errorf("entry %d has no user_id", i+1)
+		}
+	}
+
+	return entries, nil
+}
+
+// writeBlocklist writes entries in the given format
+func writeBlocklist(w io.Writer, format string, entries []BlocklistEntry) error {
+	switch format {
+	case blocklistJSON:
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+
+	case blocklistCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(blocklistColumns); err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			var expires string
+			if !e.ExpiresAt.IsZero() {
+				expires = e.ExpiresAt.UTC().Format(time.RFC3339)
+			}
+
+			record := []string{strconv.FormatInt(e.UserID, 10), e.ScreenName, e.Reason, e.AddedBy, expires}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+
+		writer.Flush()
+		return writer.Error()
+
+	default:
+		return fmt.Errorf("unknown blocklist format %q", format)
+	}
+}
+
+// loadBlocklistFile reads a local blocklist. A missing file is not an error.
+func loadBlocklistFile(path string) ([]BlocklistEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readBlocklist(f, blocklistFormat(path))
+}
+
+// mergeBlocklist adds entries to existing. An entry for a user that is
+// already listed replaces it. The result is sorted by user ID.
+func mergeBlocklist(existing []BlocklistEntry, entries []BlocklistEntry) []BlocklistEntry {
+	byID := make(map[int64]BlocklistEntry)
+
+	for _, e := range existing {
+		byID[e.UserID] = e
+	}
+
+	for _, e := range entries {
+		byID[e.UserID] = e
+	}
+
+	merged := make([]BlocklistEntry, 0, len(byID))
+	for _, e := range byID {
+		merged = append(merged, e)
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].UserID < merged[j].UserID
+	})
+
+	return merged
+}
+
+// fileStamps returns the modification time and size of each file, so
+// changes can be spotted. Missing files are left out.
+func fileStamps(files []denyFile) map[string]string {
+	stamps := make(map[string]string)
+
+	for _, f := range files {
+		if info, err := os.Stat(f.Path); err == nil {
+			stamps[f.Path] = fmt.Sprintf("%v/%d", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+
+	return stamps
+}
+
+// stampsChanged compares two results of fileStamps
+func stampsChanged(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return true
+	}
+
+	for path, stamp := range a {
+		if b[path] != stamp {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runBlocklist runs `chim blocklist import|export`
+func runBlocklist(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: blocklist import|export [flags]")
+	}
+
+	switch args[0] {
+	case "import":
+		return runBlocklistImport(args[1:])
+	case "export":
+		return runBlocklistExport(args[1:])
+	default:
+		return fmt.Errorf("unknown blocklist command %q", args[0])
+	}
+}
+
+// runBlocklistImport merges a shared blocklist into a local one
+func runBlocklistImport(args []string) error {
+	var target string
+	if len(config.Settings.Mutes.Blocklists) > 0 {
+		target = config.Settings.Mutes.Blocklists[0]
+	}
+
+	fs := flag.NewFlagSet("blocklist import", flag.ContinueOnError)
+	fs.StringVar(&target, "o", target, "Local blocklist to merge into (defaults to the first of mutes.blocklists)")
+	format := fs.String("format", "", "Format of the imported list: csv or json (defaults to the file extension)")
+	addedBy := fs.String("added-by", "", "added_by for entries that don't have one")
+	reason := fs.String("reason", "", "reason for entries that don't have one")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: blocklist import [flags] <file>")
+	}
+
+	if target == "" {
+		return fmt.Errorf("no local blocklist to import into; set mutes.blocklists or -o")
+	}
+
+	source := fs.Arg(0)
+	if *format == "" {
+		*format = blocklistFormat(source)
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	imported, err := readBlocklist(f, *format)
+	if err != nil {
+		return fmt.Errorf("%v: %v", source, err)
+	}
+
+	for i := range imported {
+		if imported[i].AddedBy == "" {
+			imported[i].AddedBy = *addedBy
+		}
+		if imported[i].Reason == "" {
+			imported[i].Reason = *reason
+		}
+	}
+
+	existing, err := loadBlocklistFile(target)
+	if err != nil {
+		return fmt.Errorf("%v: %v", target, err)
+	}
+
+	merged := mergeBlocklist(existing, imported)
+
+	var out strings.Builder
+	if err := writeBlocklist(&out, blocklistFormat(target), merged); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(target, []byte(out.String()), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d entries from %v into %v (%d entries)\n", len(imported), source, target, len(merged))
+
+	return nil
+}
+
+// runBlocklistExport writes out the entries of the local blocklists and
+// the mute file, without the ones that have expired
+func runBlocklistExport(args []string) error {
+	fs := flag.NewFlagSet("blocklist export", flag.ContinueOnError)
+	output := fs.String("o", "", "File to write (defaults to standard output)")
+	format := fs.String("format", "", "csv or json (defaults to the -o extension, or json)")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *format == "" {
+		*format = blocklistFormat(*output)
+	}
+
+	var entries []BlocklistEntry
+	now := time.Now()
+
+	for _, file := range denyFiles(config.Settings.Mutes) {
+		loaded, err := loadBlocklistFile(file.Path)
+		if err != nil {
+			return fmt.Errorf("%v: %v", file.Path, err)
+		}
+
+		var current []BlocklistEntry
+		for _, e := range loaded {
+			if e.ExpiresAt.IsZero() || e.ExpiresAt.After(now) {
+				current = append(current, e)
+			}
+		}
+
+		entries = mergeBlocklist(entries, current)
+	}
+
+	if *output == "" {
+		return writeBlocklist(os.Stdout, *format, entries)
+	}
+
+	var out strings.Builder
+	if err := writeBlocklist(&out, *format, entries); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(*output, []byte(out.String()), 0644)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"github.com/davidk/anaconda"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadBlocklist(t *testing.T) {
+	expires := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		Explain string
+		Format  string
+		Input   string
+		Output  []BlocklistEntry
+		Error   bool
+	}{
+		{
+			"CSV with a header",
+			blocklistCSV,
+			"user_id,screen_name,reason,added_by,expires_at\n1,@spammer,spam,mods,2020-06-01T00:00:00Z\n2,,,,\n",
+			[]BlocklistEntry{
+				{UserID: 1, ScreenName: "spammer", Reason: "spam", AddedBy: "mods", ExpiresAt: expires},
+				{UserID: 2},
+			},
+			false,
+		},
+		{
+			"CSV with only IDs, comments and a date expiry",
+			blocklistCSV,
+			"# shared by neighbors\n3\n4, bot, , , 2020-06-01\n",
+			[]BlocklistEntry{
+				{UserID: 3},
+				{UserID: 4, ScreenName: "bot", ExpiresAt: expires},
+			},
+			false,
+		},
+		{
+			"CSV with a bad ID",
+			blocklistCSV,
+			"user_id\nnot-a-number\n",
+			nil,
+			true,
+		},
+		{
+			"CSV with a bad expiry",
+			blocklistCSV,
+			"5,,,,next tuesday\n",
+			nil,
+			true,
+		},
+		{
+			"JSON",
+			blocklistJSON,
+			`[{"user_id": 1, "screen_name": "spammer", "reason": "spam", "added_by": "mods", "expires_at": "2020-06-01"}, {"user_id": 2}]`,
+			[]BlocklistEntry{
+				{UserID: 1, ScreenName: "spammer", Reason: "spam", AddedBy: "mods", ExpiresAt: expires},
+				{UserID: 2},
+			},
+			false,
+		},
+		{
+			"JSON without a user_id",
+			blocklistJSON,
+			`[{"screen_name": "spammer"}]`,
+			nil,
+			true,
+		},
+		{
+			"Empty JSON file",
+			blocklistJSON,
+			"",
+			nil,
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		entries, err := readBlocklist(strings.NewReader(test.Input), test.Format)
+
+		if (err != nil) != test.Error {
+			t.Errorf("%v: got error %v, want error: %v", test.Explain, err, test.Error)
+			continue
+		}
+
+		if !reflect.DeepEqual(entries, test.Output) {
+			t.Errorf("%v: got %+v, want %+v", test.Explain, entries, test.Output)
+		}
+	}
+}
+
+func TestWriteBlocklistRoundTrip(t *testing.T) {
+	entries := []BlocklistEntry{
+		{UserID: 1, ScreenName: "spammer", Reason: "spam, mostly", AddedBy: "mods", ExpiresAt: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{UserID: 2},
+	}
+
+	for _, format := range []string{blocklistCSV, blocklistJSON} {
+		var buf bytes.Buffer
+		if err := writeBlocklist(&buf, format, entries); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+
+		if format == blocklistJSON && strings.Contains(buf.String(), "0001-01-01") {
+			t.Errorf("JSON output includes an empty expiry: %v", buf.String())
+		}
+
+		read, err := readBlocklist(&buf, format)
+		if err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+
+		if !reflect.DeepEqual(read, entries) {
+			t.Errorf("%v: got %+v back, want %+v", format, read, entries)
+		}
+	}
+}
+
+func TestMergeBlocklist(t *testing.T) {
+	existing := []BlocklistEntry{{UserID: 3, Reason: "old"}, {UserID: 1}}
+	imported := []BlocklistEntry{{UserID: 3, Reason: "new"}, {UserID: 2}}
+
+	want := []BlocklistEntry{{UserID: 1}, {UserID: 2}, {UserID: 3, Reason: "new"}}
+	if got := mergeBlocklist(existing, imported); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func TestBlocklistImportExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chim-blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := filepath.Join(dir, "local.json")
+	shared := filepath.Join(dir, "shared.csv")
+	exported := filepath.Join(dir, "export.csv")
+
+	if err := ioutil.WriteFile(local, []byte(`[{"user_id": 1, "reason": "ours"}, {"user_id": 9, "expires_at": "2000-01-01"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(shared, []byte("user_id,screen_name\n2,spammer\n3,bot\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := config.Settings.Mutes
+	defer func() { config.Settings.Mutes = previous }()
+	config.Settings.Mutes = MuteConfig{Blocklists: []string{local}}
+
+	if err := runCommand([]string{"blocklist", "import", "-added-by", "neighbors", "-reason", "spam", shared}); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	entries, err := loadBlocklistFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 4 || entries[1].UserID != 2 || entries[1].AddedBy != "neighbors" || entries[1].Reason != "spam" {
+		t.Errorf("Unexpected entries after import: %+v", entries)
+	}
+
+	if err := runCommand([]string{"blocklist", "export", "-o", exported}); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	entries, err = loadBlocklistFile(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for _, e := range entries {
+		ids = append(ids, e.UserID)
+	}
+
+	if want := []int64{1, 2, 3}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Exported %v, want %v (without the expired entry)", ids, want)
+	}
+}
+
+func TestReloadDenyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chim-blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "spam.csv")
+	if err := ioutil.WriteFile(file, []byte("100\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := &DenySet{IDs: mutedIds, sources: mutedSources}
+	defer setDenySet(previous)
+
+	c := MuteConfig{Blocklists: []string{file}}
+	calls := 0
+	sources := []denySource{{Name: "mutes", Fetch: func(v url.Values) (anaconda.UserCursor, error) {
+		calls++
+		return anaconda.UserCursor{Next_cursor_str: "0", Users: []anaconda.User{{Id: 7}}}, nil
+	}}}
+
+	if _, err := refreshMutedList(sources, c, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	stamps := fileStamps(denyFiles(c))
+
+	if err := ioutil.WriteFile(file, []byte("100\n200\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if !stampsChanged(stamps, fileStamps(denyFiles(c))) {
+		t.Error("A changed blocklist was not noticed")
+	}
+
+	if _, err := reloadDenyFiles(sources, c, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 1 {
+		t.Errorf("Reloading local files called the API %d times", calls-1)
+	}
+
+	for _, id := range []int64{7, 100, 200} {
+		if !userIsMuted(id, currentMutedIds()) {
+			t.Errorf("Expected %v to be denied after a reload", id)
+		}
+	}
+
+	if got := denySourcesOf(200); !reflect.DeepEqual(got, []string{"blocklist spam.csv"}) {
+		t.Errorf("Got sources %v for 200", got)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/davidk/memberset"
 	log "github.com/sirupsen/logrus"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -30,11 +31,12 @@ func checkAccountAge(status anaconda.Tweet, minAgeHours int) bool {
 	// "created_at":"Wed Aug 27 13:08:45 +0000 2008"
 	// Twitter's created_at format is defined as RubyDate in Go
 
-	if minAgeHours < 0 {
-		minAgeHours = 0
+	if minAgeHours <= 0 {
+		log.Debug("checkAccountAge: No minimum account age. OK.")
+		return true
 	}
 
-	minAgeDuration := time.Duration(minAgeHours*24) * time.Hour
+	minAgeDuration := time.Duration(minAgeHours) * time.Hour
 
 	log.WithFields(log.Fields{
 		"screenName":          status.User.ScreenName,
@@ -43,18 +45,19 @@ func checkAccountAge(status anaconda.Tweet, minAgeHours int) bool {
 	}).Debug("checkAccountAge: Checking account age")
 
 	userCreatedAt, err := time.Parse(time.RubyDate, status.User.CreatedAt)
-	check(ErrorsAreFatal{}, "checkAccountAge: Unable to parse time.", err)
+	if err != nil {
+		log.Warnf("checkAccountAge: Unable to parse account creation time %q, FAIL: %v", status.User.CreatedAt, err)
+		return false
+	}
 
-	// Round everything to the nearest hour
-	userCreatedAt = userCreatedAt.Truncate(time.Nanosecond)
-	timeSinceUserCreated := time.Now().Truncate(time.Hour).Sub(userCreatedAt)
+	timeSinceUserCreated := time.Since(userCreatedAt)
 
 	log.WithFields(log.Fields{
-		"accountAge": time.Duration(timeSinceUserCreated) / 24,
-		"minAge":     time.Duration(minAgeDuration) / 24,
+		"accountAge": timeSinceUserCreated.Round(time.Minute),
+		"minAge":     minAgeDuration,
 	}).Info("checkAccountAge")
 
-	if timeSinceUserCreated > minAgeDuration {
+	if timeSinceUserCreated >= minAgeDuration {
 		log.Info("checkAccountAge: Account is older than required hours. OK.")
 		return true
 	}
@@ -63,18 +66,82 @@ func checkAccountAge(status anaconda.Tweet, minAgeHours int) bool {
 	return false
 }
 
-// checkDuplicateContent checks a LRU to see if the URL given has already
-// been posted in recent memory. If it is, we return false.
-func checkDuplicateContent(url string) bool {
+// canonicalMediaURL strips the query string and fragment from a media URL
+// (Twitter varies these, i.e. ?tag=10 on video variants) and lowercases
+// the scheme and host
+func canonicalMediaURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
 
-	if _, present := urlLRU.Get(url); !present {
-		log.Infof("checkDuplicateContent: CACHE MISS - ACCEPT - Content does not exist in LRU: %v\n", url)
-		urlLRU.Add(url, 1)
-		return true
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	return u.String()
+}
+
+// mediaKeys builds stable identities for the media in a tweet, taken from
+// all four entity sets. A re-post of the same clip (by someone else, or
+// with different text) shares at least one of these keys:
+// media:<media id>, variant:<video url without query>, and for media that
+// was shared from another tweet, source:<expanded url of that tweet>
+func mediaKeys(status anaconda.Tweet) []string {
+	var keys []string
+	seen := make(map[string]bool)
+
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
 	}
 
-	log.Infof("checkDuplicateContent: CACHE HIT - REJECT - Content exists in LRU: %v\n", url)
-	return false
+	for _, media := range tweetMediaEntities(status) {
+		if media.Id_str != "" {
+			add("media:" + media.Id_str)
+		} else if media.Id != 0 {
+			add("media:" + strconv.FormatInt(media.Id, 10))
+		}
+
+		for _, v := range media.VideoInfo.Variants {
+			if strings.HasPrefix(strings.ToLower(v.ContentType), "video/") && v.Url != "" {
+				add("variant:" + canonicalMediaURL(v.Url))
+			}
+		}
+
+		if media.Source_status_id != 0 && media.Expanded_url != "" {
+			add("source:" + canonicalMediaURL(media.Expanded_url))
+		}
+	}
+
+	return keys
+}
+
+// checkDuplicateMedia rejects a tweet if any of its media keys belong to
+// a recently retweeted clip. Keys are only remembered once a tweet is
+// retweeted (see rememberMedia), so a tweet rejected by a later check
+// doesn't block the clip.
+func checkDuplicateMedia(keys []string) bool {
+
+	for _, key := range keys {
+		if _, present := urlLRU.Get(key); present {
+			log.Infof("checkDuplicateMedia: CACHE HIT - REJECT - Media exists in LRU: %v\n", key)
+			return false
+		}
+	}
+
+	log.Infof("checkDuplicateMedia: CACHE MISS - ACCEPT - Media does not exist in LRU: %v\n", keys)
+	return true
+}
+
+// rememberMedia adds the media keys of a retweeted tweet to urlLRU
+func rememberMedia(keys []string) {
+	for _, key := range keys {
+		urlLRU.Add(key, 1)
+	}
 }
 
 // checkTweetContent sees if the data is re-tweetable or not
@@ -103,27 +170,88 @@ func checkTweetContent(status anaconda.Tweet) (approved bool, tweetType string,
 		return false, "sensitive", ""
 	}
 
-	if approved, tweetType, contentURL = checkEntityMedia(status, status.Entities.Media); approved {
-		return
+	// Photo sets are only listed in full in the extended entities, so the
+	// media is classified across all four entity sets at once
+	media := tweetMediaEntities(status)
+
+	approved, tweetType, contentURL = checkEntityMedia(status, media)
+	if !approved {
+		log.Debug("checkTweetContent REJECT: No media content found")
+		return false, "no_match", ""
+	}
+
+	if !mediaTypeAccepted(tweetType, config.Settings.AcceptedMediaTypes) {
+		log.Debugf("checkTweetContent REJECT: Media type %v is not in accepted_media_types", tweetType)
+		return false, tweetType, contentURL
+	}
+
+	if tweetType == contentPhoto || tweetType == contentPhotoSet {
+		photos := countPhotos(media)
+		if photos < config.Settings.MinPhotos || (config.Settings.MaxPhotos > 0 && photos > config.Settings.MaxPhotos) {
+			log.Debugf("checkTweetContent REJECT: %d photo(s) is outside of min_photos %d / max_photos %d",
+				photos, config.Settings.MinPhotos, config.Settings.MaxPhotos)
+			return false, tweetType, contentURL
+		}
 	}
 
-	if approved, tweetType, contentURL = checkEntityMedia(status, status.ExtendedEntities.Media); approved {
-		return
+	return true, tweetType, contentURL
+}
+
+// Content types that checkEntityMedia can detect. These are the values
+// used in accepted_media_types, delta_gated_content and metrics.
+const (
+	contentGif      = "gif"
+	contentVideo    = "video"
+	contentPhoto    = "photo"
+	contentPhotoSet = "photo_set"
+)
+
+// Used when accepted_media_types isn't set
+var defaultAcceptedMediaTypes = []string{contentGif, contentVideo}
+
+// isContentType reports whether tweetType is one of the content types
+// above (as opposed to a rejection reason such as "no_match")
+func isContentType(tweetType string) bool {
+	switch tweetType {
+	case contentGif, contentVideo, contentPhoto, contentPhotoSet:
+		return true
 	}
+	return false
+}
 
-	if approved, tweetType, contentURL = checkEntityMedia(status, status.ExtendedTweet.Entities.Media); approved {
-		return
+// mediaTypeAccepted checks a content type against accepted_media_types
+func mediaTypeAccepted(tweetType string, accepted []string) bool {
+	if len(accepted) == 0 {
+		accepted = defaultAcceptedMediaTypes
 	}
 
-	if approved, tweetType, contentURL = checkEntityMedia(status, status.ExtendedTweet.ExtendedEntities.Media); approved {
-		return
+	for _, t := range accepted {
+		if strings.EqualFold(t, tweetType) {
+			return true
+		}
 	}
 
-	log.Debug("checkTweetContent REJECT: No media content found")
-	return false, "no_match", ""
+	return false
 }
 
+// countPhotos counts the still images in a set of media entities
+func countPhotos(mediaEntries []anaconda.EntityMedia) int {
+	photos := 0
+	for _, media := range mediaEntries {
+		if strings.EqualFold(media.Type, "photo") {
+			photos++
+		}
+	}
+	return photos
+}
+
+// checkEntityMedia classifies the media in a tweet. A gif or video takes
+// precedence over any photos posted alongside it; otherwise one photo is
+// a "photo" and several are a "photo_set".
 func checkEntityMedia(status anaconda.Tweet, mediaEntries []anaconda.EntityMedia) (bool, string, string) {
+	var firstPhoto string
+	photos := 0
+
 	for _, media := range mediaEntries {
 		switch {
 		case strings.EqualFold(media.Type, "animated_gif"):
@@ -134,7 +262,7 @@ func checkEntityMedia(status anaconda.Tweet, mediaEntries []anaconda.EntityMedia
 			}
 
 			log.Debugf("checkEntityMedia found %v: %v\n", media.Type, media.Media_url_https)
-			return true, "gif", media.Media_url_https
+			return true, contentGif, media.Media_url_https
 		case strings.EqualFold(media.Type, "video"):
 			log.Debugf("checkEntityMedia found %v: %v\n", status.User.ScreenName, status.Text)
 
@@ -143,9 +271,23 @@ func checkEntityMedia(status anaconda.Tweet, mediaEntries []anaconda.EntityMedia
 			}
 
 			log.Debugf("checkEntityMedia found %v: %v\n", media.Type, media.Media_url_https)
-			return true, "video", media.Media_url_https
+			return true, contentVideo, media.Media_url_https
+		case strings.EqualFold(media.Type, "photo"):
+			log.Debugf("checkEntityMedia found %v: %v\n", media.Type, media.Media_url_https)
+			if photos == 0 {
+				firstPhoto = media.Media_url_https
+			}
+			photos++
 		}
 	}
+
+	switch {
+	case photos == 1:
+		return true, contentPhoto, firstPhoto
+	case photos > 1:
+		return true, contentPhotoSet, firstPhoto
+	}
+
 	return false, "", ""
 }
 
@@ -170,31 +312,64 @@ func (fs FriendshipInfo) GetFriendshipStatus(v url.Values) (anaconda.Relationshi
 // this is rate-limited to a 15-minute window (app) / 180 user auth
 func checkUserFollowing(fs FriendshipStatus, status anaconda.Tweet, targetUser string) bool {
 
-	if strings.EqualFold(status.User.ScreenName, targetUser) {
-		log.Infof("userIsFollowing: Tweet originated from our target. Bypassing check.")
-		return true
-	}
-
 	if targetUser == "" {
 		log.Infof("userIsFollowing: Setting must_follow is not set. Bypassing check for user: %v\n",
 			status.User.ScreenName)
 		return true
 	}
 
+	return checkFollowTarget(fs, status, FollowTarget{ScreenName: targetUser}) == followYes
+}
+
+// checkFollowTarget checks whether the user that originated the tweet
+// follows a single must_follow target (see checkUserFollowing). If the
+// API can't be asked or fails, the result is followUnknown, which is
+// never cached.
+func checkFollowTarget(fs FriendshipStatus, status anaconda.Tweet, target FollowTarget) followResult {
+
+	targetUser, mutual := target.ScreenName, target.mutual()
+
+	if strings.EqualFold(status.User.ScreenName, targetUser) {
+		log.Infof("userIsFollowing: Tweet originated from our target. Bypassing check.")
+		return followYes
+	}
+
 	log.Infof("userIsFollowing: Checking origin twitter handle: %v. User must follow %v. [mutual mode: %t]\n",
-		status.User.ScreenName, targetUser, config.Settings.MutualFollow)
+		status.User.ScreenName, targetUser, mutual)
+
+	// Answer from the synced follow graph if we keep one (see followgraph.go).
+	// It is refreshed in the background, so its answers aren't cached. Only
+	// a yes is trusted: the user may have followed since the last sync.
+	if g := followGraphFor(targetUser); g != nil {
+		if sourceFollows, targetFollows, ok := g.Relationship(status.User.Id); !ok {
+			log.Info("userIsFollowing: Follow graph has not synced yet. Falling back to the API.")
+		} else if followAccepted(sourceFollows, targetFollows, mutual) {
+			log.Infof("userIsFollowing: Follow graph says [ %v follows %v ? %v ] [ does %v follow? %v ]\n", status.User.ScreenName,
+				targetUser, sourceFollows, targetUser, targetFollows)
+			return followYes
+		} else {
+			log.Info("userIsFollowing: Follow graph says no, but it may be out of date. Falling back to the API.")
+		}
+	}
+
+	cacheKey := FollowCacheKey{Source: status.User.ScreenName, Target: strings.ToLower(targetUser), Mutual: mutual}
 
-	val, _ := tweetOriginatorLRU.Get(status.User.ScreenName)
+	val, _ := tweetOriginatorLRU.Get(cacheKey)
 
 	if val == 1 {
 		log.Info("userIsFollowing: LRU cache hit.")
-		return true
+		return followYes
 	} else if val == nil {
 		log.Info("userIsFollowing: LRU cache miss.")
 		// cache missed/no entry
 	} else if val == 0 {
 		log.Info("userIsFollowing: LRU cache hit.")
-		return false
+		return followNo
+	}
+
+	if until, paused := followLookupsPaused(); paused {
+		log.Infof("userIsFollowing: Friendship lookups are rate-limited until %v. Result unknown.", until)
+		return followUnknown
 	}
 
 	log.Println("userIsFollowing: Performing live check.")
@@ -203,45 +378,36 @@ func checkUserFollowing(fs FriendshipStatus, status anaconda.Tweet, targetUser s
 	values.Set("source_screen_name", status.User.ScreenName)
 	values.Set("target_screen_name", targetUser)
 
-	// caches missed, do live query
-	r, _ := fs.GetFriendshipStatus(values)
+	// caches missed, do live query. An error (usually rate-limiting) says
+	// nothing about the relationship, so it must not be cached.
+	r, err := fs.GetFriendshipStatus(values)
+	if err != nil {
+		noteFollowLookupError(err)
+		log.Errorf("userIsFollowing: Unable to check whether %v follows %v, result unknown: %v", status.User.ScreenName, targetUser, err)
+		return followUnknown
+	}
 
 	log.Infof("userIsFollowing: Does [ %v follow %v ] ? %v [ does %v follow? %v ]\n", status.User.ScreenName,
 		targetUser, r.Relationship.Source.Following, targetUser, r.Relationship.Target.Following)
 
-	if r.Relationship.Source.Following && config.Settings.MutualFollow == false {
-
-		log.Infof("userIsFollowing [tweet source follows, mutual %t]: %v is following target.\n",
-			config.Settings.MutualFollow,
-			status.User.ScreenName)
-
-		tweetOriginatorLRU.Add(status.User.ScreenName, 1)
-
-		log.Info("userIsFollowing [tweet source follows, mutual off]: added user to LRU cache (1). User is following.")
-
-		return true
-
-	} else if config.Settings.MutualFollow == true {
-
-		if r.Relationship.Source.Following && r.Relationship.Target.Following {
-
-			tweetOriginatorLRU.Add(status.User.ScreenName, 1)
-			log.Info("userIsFollowing [mutual mode]: added user to LRU cache (1). User and target are following each other.")
-			return true
-
-		}
-
-		tweetOriginatorLRU.Add(status.User.ScreenName, 0)
-		log.Info("userIsFollowing [mutual mode]: Target/Source are not mutually following each other. Rejected.")
-		return false
-
-	} else {
+	if followAccepted(r.Relationship.Source.Following, r.Relationship.Target.Following, mutual) {
+		tweetOriginatorLRU.Add(cacheKey, 1)
+		log.Infof("userIsFollowing [mutual %t]: added user to LRU cache (1). User is following.", mutual)
+		return followYes
+	}
 
-		tweetOriginatorLRU.Add(status.User.ScreenName, 0)
-		log.Info("userIsFollowing: LRU cache add (0). User not following.")
-		return false
+	tweetOriginatorLRU.Add(cacheKey, 0)
+	log.Infof("userIsFollowing [mutual %t]: LRU cache add (0). User not following.", mutual)
+	return followNo
+}
 
+// followAccepted decides a follow check: the source of the tweet must
+// follow the target, and in mutual mode the target must follow back
+func followAccepted(sourceFollows bool, targetFollows bool, mutual bool) bool {
+	if mutual {
+		return sourceFollows && targetFollows
 	}
+	return sourceFollows
 }
 
 // calculateTweetTime converts string based times and seconds to values
@@ -294,6 +460,26 @@ func checkContentDelta(user int64, username string, contentType string,
 
 }
 
+// forgetOwnDeltas removes the content and post delta entries a tweet left
+// when it passed those checks, so that it can be checked again (see
+// RetryPending) without colliding with itself. Entries left by the user's
+// later tweets are kept.
+func forgetOwnDeltas(status anaconda.Tweet, contentType string) {
+	createdTime, _ := calculateTweetTime(&status, 0)
+
+	for _, entry := range []struct {
+		cache *StateCache
+		key   interface{}
+	}{
+		{userContentDeltaLRU, ContentDelta{status.User.Id, contentType}},
+		{userPostDeltaLRU, status.User.Id},
+	} {
+		if val, present := entry.cache.Get(entry.key); present && val.(time.Time).Equal(createdTime) {
+			entry.cache.Remove(entry.key)
+		}
+	}
+}
+
 // checkUserPostDelta sees if a user is posting at a very small delta.
 // If we approve a post, we store a timestamp, and on subsequent approvals
 // compare it against the stored timestamp.
@@ -324,19 +510,26 @@ func checkUserPostDelta(user int64, username string, timeDeltaSeconds int, statu
 }
 
 // checkPostRecentLRU stores a recent set of tweet statuses
-// if one matches, we can stop processing where this matches
+// and rejects text that is the same as, or nearly the same as, a status
+// seen within the configured window (see neardup.go)
 func checkPostRecentLRU(statusText string) bool {
 
-	_, present := postTextLRU.Get(statusText)
+	c := config.Settings.NearDuplicateText.withDefaults()
+	key := textKey(statusText, c.MinTokens)
 
-	if !present {
-		log.Info("checkPostRecentLRU: CACHE MISS - ACCEPT - LRU has not seen this tweet yet.")
-		postTextLRU.Add(statusText, 1)
+	if key == nil {
+		log.Info("checkPostRecentLRU: ACCEPT - No text to compare.")
 		return true
 	}
 
-	log.Info("checkPostRecentLRU: CACHE HIT - REJECT - LRU has seen this post already.")
-	return false
+	if distance, present := findNearDuplicate(postTextLRU, key, c.MaxDistance, time.Duration(c.WindowSeconds)*time.Second); present {
+		log.Infof("checkPostRecentLRU: CACHE HIT - REJECT - LRU has seen this post (or one %d bits from it) already.", distance)
+		return false
+	}
+
+	log.Info("checkPostRecentLRU: CACHE MISS - ACCEPT - LRU has not seen this tweet yet.")
+	postTextLRU.Add(key, 1)
+	return true
 
 }
 
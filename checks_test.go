@@ -4,6 +4,7 @@ import (
 	"github.com/davidk/anaconda"
 	"github.com/davidk/memberset"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -168,12 +169,36 @@ func TestCheckAccountAge(t *testing.T) {
 				},
 			}, 2871, true,
 		},
-		{"Allow 1 day old accounts. Normally un-checkable due to sub-second precision, but hours are rounded out",
+		{"Allow 1 day old accounts when 1 hour is required. min_account_age_hours is in hours, not days",
 			anaconda.Tweet{
 				User: anaconda.User{
 					ScreenName: "porter",
 					CreatedAt:  time.Now().Add(-time.Duration(24) * time.Hour).Format(time.RubyDate),
 				},
+			}, 1, true,
+		},
+		{"Deny 23 hour old accounts when 24 hours are required",
+			anaconda.Tweet{
+				User: anaconda.User{
+					ScreenName: "wheatley",
+					CreatedAt:  time.Now().Add(-time.Duration(23) * time.Hour).Format(time.RubyDate),
+				},
+			}, 24, false,
+		},
+		{"Allow 25 hour old accounts when 24 hours are required",
+			anaconda.Tweet{
+				User: anaconda.User{
+					ScreenName: "glados",
+					CreatedAt:  time.Now().Add(-time.Duration(25) * time.Hour).Format(time.RubyDate),
+				},
+			}, 24, true,
+		},
+		{"Deny accounts with an unreadable creation time",
+			anaconda.Tweet{
+				User: anaconda.User{
+					ScreenName: "cave",
+					CreatedAt:  "yesterday-ish",
+				},
 			}, 1, false,
 		},
 		{"Deny 1 day in the future returned from twitter API. Fails.",
@@ -283,7 +308,7 @@ func TestCheckTweetContent(t *testing.T) {
 	config = AppConfiguration{
 		Settings: InternalTuning{
 			IgnoreFrom:           "chim",
-			MustFollow:           "jack",
+			MustFollow:           FollowTargets{{ScreenName: "jack"}},
 			DenySensitiveContent: true,
 			MinAccountAgeHours:   5,
 		},
@@ -455,10 +480,10 @@ func TestCheckUserFollowing(t *testing.T) {
 		{
 			"Allow tweets that originate from the target (user doesn't really follow itself)",
 			anaconda.Tweet{
-				User: anaconda.User{ScreenName: config.Settings.MustFollow},
+				User: anaconda.User{ScreenName: config.Settings.MustFollow[0].ScreenName},
 				Text: "See how our GM ate the entire group!",
 			},
-			config.Settings.MustFollow,
+			config.Settings.MustFollow[0].ScreenName,
 			true,
 		},
 		{
@@ -560,30 +585,6 @@ func TestCheckUserFollowing(t *testing.T) {
 
 }
 
-// TestCheckDuplicateContent tests the checkDuplicateContent
-// LRU to ensure that it functions with a size of 5 for
-// media content URLs that we retrieve
-func TestCheckDuplicateContent(t *testing.T) {
-	var testDuplicateContent = []struct {
-		Input  string
-		Output bool
-	}{
-		{Input: "https://google.com", Output: true},
-		{Input: "https://google.com", Output: false},
-		{Input: "https://altavista.com", Output: true},
-		{Input: "https://periscope.tv/w/", Output: true},
-		{Input: "https://google.com", Output: false},
-	}
-
-	for _, testInput := range testDuplicateContent {
-		result := checkDuplicateContent(testInput.Input)
-		if result != testInput.Output {
-			t.Errorf("Tried %v, but got %v.", testInput.Input, testInput.Output)
-		}
-	}
-
-}
-
 // TestUserIsMuted exercises memberset's setters and getters, with varying types.
 // We rely on memberset's behavior being consistent, so it needs to be tested.
 // Note: The failing case is also tested: a key that does not exist and is
@@ -719,3 +720,162 @@ func (f FakeFriendshipInfo) GetFriendshipStatus(v url.Values) (anaconda.Relation
 		}, nil
 	}
 }
+
+// TestCheckDuplicateMedia checks that re-posts of the same clip are caught
+// through any of the media keys, regardless of which entity set they
+// turn up in or how the variant URL's query string changes
+func TestCheckDuplicateMedia(t *testing.T) {
+	urlLRU = newStateCache("url", 128)
+
+	original := anaconda.Tweet{
+		ExtendedEntities: anaconda.Entities{
+			Media: []anaconda.EntityMedia{
+				{Id_str: "1001", Type: "video",
+					VideoInfo: anaconda.VideoInfo{
+						Variants: []anaconda.Variant{
+							{ContentType: "video/mp4", Url: "https://video.twimg.com/ext_tw_video/1001/vid/720x720/clip.mp4?tag=10"},
+							{ContentType: "application/x-mpegURL", Url: "https://video.twimg.com/ext_tw_video/1001/pl/clip.m3u8?tag=10"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	keys := mediaKeys(original)
+	wantKeys := []string{"media:1001", "variant:https://video.twimg.com/ext_tw_video/1001/vid/720x720/clip.mp4"}
+	if strings.Join(keys, ",") != strings.Join(wantKeys, ",") {
+		t.Errorf("mediaKeys: wanted %v, got %v", wantKeys, keys)
+	}
+
+	var testDuplicateMedia = []struct {
+		TestInfo string
+		Input    anaconda.Tweet
+		Output   bool
+	}{
+		{"First sighting of a clip", original, true},
+		{"Same media ID, re-posted in the extended tweet's entities",
+			anaconda.Tweet{
+				ExtendedTweet: anaconda.ExtendedTweet{
+					Entities: anaconda.Entities{
+						Media: []anaconda.EntityMedia{{Id_str: "1001", Type: "video"}},
+					},
+				},
+			}, false,
+		},
+		{"New media ID, but the same video with a different query string",
+			anaconda.Tweet{
+				Entities: anaconda.Entities{
+					Media: []anaconda.EntityMedia{
+						{Id_str: "2002", Type: "video",
+							VideoInfo: anaconda.VideoInfo{
+								Variants: []anaconda.Variant{
+									{ContentType: "video/mp4", Url: "https://VIDEO.twimg.com/ext_tw_video/1001/vid/720x720/clip.mp4?tag=12"},
+								},
+							},
+						},
+					},
+				},
+			}, false,
+		},
+		{"Shared from a source status",
+			anaconda.Tweet{
+				Entities: anaconda.Entities{
+					Media: []anaconda.EntityMedia{
+						{Id_str: "3003", Type: "video", Source_status_id: 77,
+							Expanded_url: "https://twitter.com/creator/status/77/video/1"},
+					},
+				},
+			}, true,
+		},
+		{"Another share of the same source status",
+			anaconda.Tweet{
+				ExtendedTweet: anaconda.ExtendedTweet{
+					ExtendedEntities: anaconda.Entities{
+						Media: []anaconda.EntityMedia{
+							{Id_str: "4004", Type: "video", Source_status_id: 77,
+								Expanded_url: "https://twitter.com/creator/status/77/video/1?s=20"},
+						},
+					},
+				},
+			}, false,
+		},
+		{"Unrelated clip",
+			anaconda.Tweet{
+				Entities: anaconda.Entities{
+					Media: []anaconda.EntityMedia{{Id_str: "5005", Type: "animated_gif"}},
+				},
+			}, true,
+		},
+	}
+
+	for _, testInput := range testDuplicateMedia {
+		result := checkDuplicateMedia(mediaKeys(testInput.Input))
+		if result {
+			// As if it had been retweeted
+			rememberMedia(mediaKeys(testInput.Input))
+		}
+		if result != testInput.Output {
+			t.Error(
+				"Tried: ", testInput.TestInfo,
+				"wanted: ", testInput.Output,
+				"Got: ", result,
+			)
+		}
+	}
+}
+
+// TestCheckTweetContentMediaTypes tests accepted_media_types and the
+// photo count rules
+func TestCheckTweetContentMediaTypes(t *testing.T) {
+
+	saved := config.Settings
+	defer func() { config.Settings = saved }()
+
+	photos := func(n int) anaconda.Tweet {
+		status := anaconda.Tweet{User: anaconda.User{ScreenName: "painter"}, Text: "New piece!"}
+		for i := 0; i < n; i++ {
+			id := strconv.Itoa(i + 1)
+			status.ExtendedEntities.Media = append(status.ExtendedEntities.Media,
+				anaconda.EntityMedia{Id_str: id, Type: "photo", Media_url_https: "https://pbs.example.com/" + id + ".jpg"})
+		}
+		// Entities only ever carries the first photo
+		status.Entities.Media = status.ExtendedEntities.Media[:1]
+		return status
+	}
+
+	videoWithPhoto := photos(1)
+	videoWithPhoto.ExtendedEntities.Media = append(videoWithPhoto.ExtendedEntities.Media,
+		anaconda.EntityMedia{Id_str: "9", Type: "video"})
+
+	var tests = []struct {
+		TestInfo  string
+		Accepted  []string
+		MinPhotos int
+		MaxPhotos int
+		Input     anaconda.Tweet
+		Approved  bool
+		TweetType string
+	}{
+		{"Photos are not accepted by default", nil, 0, 0, photos(1), false, "photo"},
+		{"Single photo", []string{"photo"}, 0, 0, photos(1), true, "photo"},
+		{"Photo set counted from extended entities", []string{"photo_set"}, 0, 0, photos(3), true, "photo_set"},
+		{"Photo set is not a photo", []string{"photo"}, 0, 0, photos(3), false, "photo_set"},
+		{"Too few photos", []string{"photo", "photo_set"}, 2, 4, photos(1), false, "photo"},
+		{"Too many photos", []string{"photo", "photo_set"}, 2, 3, photos(4), false, "photo_set"},
+		{"Within photo limits", []string{"photo", "photo_set"}, 2, 4, photos(4), true, "photo_set"},
+		{"Video takes precedence over photos", []string{"video"}, 2, 0, videoWithPhoto, true, "video"},
+		{"Video not accepted", []string{"photo", "gif"}, 0, 0, videoWithPhoto, false, "video"},
+	}
+
+	for _, test := range tests {
+		config.Settings.AcceptedMediaTypes = test.Accepted
+		config.Settings.MinPhotos = test.MinPhotos
+		config.Settings.MaxPhotos = test.MaxPhotos
+
+		approved, tweetType, _ := checkTweetContent(test.Input)
+		if approved != test.Approved || tweetType != test.TweetType {
+			t.Errorf("%v: wanted (%v, %v), got (%v, %v)", test.TestInfo, test.Approved, test.TweetType, approved, tweetType)
+		}
+	}
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/davidk/anaconda"
-	"github.com/davidk/lru"
 	"github.com/davidk/memberset"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -29,23 +29,23 @@ var (
 
 	// LRU to avoid hitting rate limited Twitter API calls when we check
 	// if a user is following a configured target
-	tweetOriginatorLRU *lru.Cache
+	tweetOriginatorLRU *StateCache
 
 	// LRU to rate limit content
-	userContentDeltaLRU *lru.Cache = lru.New(27)
+	userContentDeltaLRU *StateCache = newStateCache("userContentDelta", 27)
 
 	// LRU to allow time deltas between approved posts
 	// we may refuse a post if results are within a certain delta rate
-	userPostDeltaLRU *lru.Cache
+	userPostDeltaLRU *StateCache
 
 	// Store the post text in a LRU cache to avoid spamming
 	// the same message in a repeat fashion
-	postTextLRU *lru.Cache
+	postTextLRU *StateCache
 
-	// Track URL assets that we retweet, so duplicate tweets
-	// that change the message slightly with the same content are not
-	// retweeted
-	urlLRU *lru.Cache
+	// Track media keys (IDs, video URLs, source tweets) that we retweet,
+	// so duplicate tweets that change the message slightly with the same
+	// content are not retweeted
+	urlLRU *StateCache
 
 	// IDs that are muted. We check against this list and deny anyone on it.
 	mutedIds *memberset.MemberSet = memberset.New()
@@ -56,7 +56,12 @@ var (
 
 	// Single words and/or mentions that are blocked from being retweeted
 	prohibitedMentions *memberset.MemberSet = memberset.New()
-	prohibitedWords    *memberset.MemberSet = memberset.New()
+
+	// Screen names in prohibited_mentions, resolved to IDs in main
+	prohibitedMentionNames []string
+
+	// Words, phrases and patterns that are blocked from being retweeted
+	prohibitedWords *ProhibitedTerms
 
 	// Prometheus variables (metrics)
 	tweetsProcessed = prometheus.NewCounterVec(
@@ -68,6 +73,17 @@ var (
 		// result == result of hitting type
 		[]string{"type", "result"},
 	)
+
+	contentTypesProcessed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tweets_by_content_type",
+			Help: "Number of tweets processed, by the type of media they carry.",
+		},
+		// content_type == gif, video, photo, photo_set
+		// result == accepted, rejected (by accepted_media_types or the photo
+		// count rules) or retweeted
+		[]string{"content_type", "result"},
+	)
 )
 
 // AppConfiguration holds private credential data from config.json
@@ -82,26 +98,98 @@ type AppConfiguration struct {
 	LogrusLevel       string         `json:"logrus_level"`
 	Settings          InternalTuning `json:"settings"`
 	TestMode          bool           `json:"test_mode"`
+
+	// Webhooks receive a JSON copy of every approved tweet
+	Webhooks []WebhookConfig `json:"webhooks"`
+
+	// Archive stores the media of approved tweets locally
+	Archive ArchiveConfig `json:"archive"`
+
+	// Feed serves recently approved tweets as Atom/RSS/JSON Feed
+	Feed FeedConfig `json:"feed"`
+
+	// State snapshots the anti-abuse LRUs so they survive restarts
+	State StateConfig `json:"state"`
 }
 
 // InternalTuning consists of behaviour tunables for very basic spam/anti-abuse
 type InternalTuning struct {
-	MustFollow           string   `json:"must_follow"`
-	IgnoreFrom           string   `json:"ignore_from"`
-	PostTimeDelta        int      `json:"post_time_delta_seconds"`
-	ContentTimeDelta     int      `json:"delta_gated_content_time_seconds"`
-	DeltaGatedContent    []string `json:"delta_gated_content"`
-	DenySensitiveContent bool     `json:"deny_sensitive_content"`
-	MinAccountAgeHours   int      `json:"min_account_age_hours"`
-	MutualFollow         bool     `json:"mutual_follow"`
-	ProhibitedMentions   []string `json:"prohibited_mentions"`
-	ProhibitedWords      []string `json:"prohibited_words"`
+	MustFollow           FollowTargets `json:"must_follow"`
+	IgnoreFrom           string        `json:"ignore_from"`
+	PostTimeDelta        int           `json:"post_time_delta_seconds"`
+	ContentTimeDelta     int           `json:"delta_gated_content_time_seconds"`
+	DeltaGatedContent    []string      `json:"delta_gated_content"`
+	DenySensitiveContent bool          `json:"deny_sensitive_content"`
+	MinAccountAgeHours   int           `json:"min_account_age_hours"`
+	MutualFollow         bool          `json:"mutual_follow"`
+	ProhibitedMentions   []string      `json:"prohibited_mentions"`
+	ProhibitedWords      []string      `json:"prohibited_words"`
+	ProhibitedPatterns   []string      `json:"prohibited_patterns"`
+
+	// Languages (Twitter's lang tag, or detected) and place countries
+	// that tweets may or may not have
+	Languages      LanguageConfig `json:"languages"`
+	PlaceCountries CountryConfig  `json:"place_countries"`
+
+	// Reject tweets that don't really contain a search term (as a hashtag,
+	// mention or word of the text) and aren't from a watched user
+	RequireRelevance bool `json:"require_relevance"`
+
+	// Domains that links in tweets may or may not point to
+	LinkDomains LinkDomainsConfig `json:"link_domains"`
+
+	// Prohibited terms in the author's display name, bio, location and URL
+	ProfileFilters ProfileFiltersConfig `json:"profile_filters"`
+
+	// Follower, ratio, tweet count, avatar and name change thresholds
+	Reputation ReputationConfig `json:"reputation"`
 
 	// TwitterFilterLevel is a twitter internal bit used by their ML
 	// to make content displayable in public. Currently most tweets
 	// we see are at the very least 'low'
 	// filter_level: none, low, medium, high (high not implemented)
 	TwitterFilterLevel string `json:"twitter_filter_level"`
+
+	// Number of media keys (see mediaKeys) remembered for duplicate
+	// detection. A tweet usually has 2-4 keys.
+	DuplicateMediaLRUSize int `json:"duplicate_media_lru_size"`
+
+	// Reject clips whose poster image looks like a recently approved one
+	PerceptualDedup PerceptualDedupConfig `json:"perceptual_dedup"`
+
+	// Reject text that is nearly the same as recently seen text
+	NearDuplicateText NearDuplicateTextConfig `json:"near_duplicate_text"`
+
+	// What to do with tweets that re-post someone else's media:
+	// allow-reposts (default), prefer-original or deny-reposts
+	RepostPolicy string `json:"repost_policy"`
+
+	// Content types to retweet: gif, video, photo and/or photo_set.
+	// Defaults to gif and video.
+	AcceptedMediaTypes []string `json:"accepted_media_types"`
+
+	// Number of images a photo/photo_set post must have (0 for no limit)
+	MinPhotos int `json:"min_photos"`
+	MaxPhotos int `json:"max_photos"`
+
+	// Duration, bitrate, aspect ratio and resolution limits for videos
+	VideoQuality VideoQualityConfig `json:"video_quality"`
+
+	// Sync the followers/friends of must_follow in the background instead
+	// of looking up each user
+	FollowGraph FollowGraphConfig `json:"follow_graph"`
+
+	// How many must_follow accounts a user has to follow: any (default),
+	// all, or at_least MustFollowAtLeast of them
+	MustFollowMode    string `json:"must_follow_mode"`
+	MustFollowAtLeast int    `json:"must_follow_at_least"`
+
+	// What to do when must_follow can't be checked (rate limits, errors)
+	FollowUnknown FollowUnknownConfig `json:"follow_unknown"`
+
+	// Periodic/SIGUSR1 refresh of muted users, a local mute file, and
+	// other deny lists (blocks, moderator accounts, Twitter lists)
+	Mutes MuteConfig `json:"mutes"`
 }
 
 // ErrorInterface is used to switch between production and testing environments
@@ -186,7 +274,8 @@ func ConfigureApp(errorType ErrorInterface) {
 	err = json.Unmarshal(jsonData, &config)
 	check(errorType, "Couldn't unmarshal JSON from configuration file. Invalid syntax?", err)
 
-	if config.ConsumerKey == "" || config.ConsumerSecret == "" || config.AccessToken == "" || config.AccessTokenSecret == "" {
+	// Sub-commands (see commands.go) work offline and don't need credentials
+	if flag.NArg() == 0 && (config.ConsumerKey == "" || config.ConsumerSecret == "" || config.AccessToken == "" || config.AccessTokenSecret == "") {
 		log.Fatal("At least one API credential is empty? Check JSON configuration file.")
 	}
 
@@ -216,6 +305,12 @@ func ConfigureApp(errorType ErrorInterface) {
 
 	// Configure Prometheus metrics
 	prometheus.MustRegister(tweetsProcessed)
+	prometheus.MustRegister(contentTypesProcessed)
+	prometheus.MustRegister(webhookDeliveries)
+	prometheus.MustRegister(archiveOperations)
+	prometheus.MustRegister(deniedBySource)
+	prometheus.MustRegister(reputationFailures)
+	prometheus.MustRegister(tweetsByTerm)
 
 	// Initialize twitter API
 	anaconda.SetConsumerKey(config.ConsumerKey)
@@ -229,16 +324,111 @@ func ConfigureApp(errorType ErrorInterface) {
 	// Initialize LRUs -- for longer description, see initial declarations
 
 	// LRU: Check to see if a user is following a target
-	tweetOriginatorLRU = lru.New(128)
+	tweetOriginatorLRU = newStateCache("tweetOriginator", 128)
 
 	// LRU: Keep deltas for posts
-	userPostDeltaLRU = lru.New(128)
+	userPostDeltaLRU = newStateCache("userPostDelta", 128)
+
+	// LRU: Fingerprints of the posts we've seen recently (see neardup.go)
+	postTextLRU = newStateCache("postText", config.Settings.NearDuplicateText.withDefaults().IndexSize)
+
+	// LRU: Media keys we've posted recently
+	if config.Settings.DuplicateMediaLRUSize <= 0 {
+		config.Settings.DuplicateMediaLRUSize = 128
+	}
+	urlLRU = newStateCache("url", config.Settings.DuplicateMediaLRUSize)
+
+	// LRU: Names of tweet authors, to spot name changes (see reputation.go)
+	if config.Settings.Reputation.NameHistorySize <= 0 {
+		config.Settings.Reputation.NameHistorySize = defaultNameHistorySize
+	}
+	nameHistoryLRU = newStateCache("nameHistory", config.Settings.Reputation.NameHistorySize)
+
+	// Restore the LRUs from the last snapshot, if we keep one
+	stateCaches = []*StateCache{tweetOriginatorLRU, userContentDeltaLRU, userPostDeltaLRU, postTextLRU, urlLRU, nameHistoryLRU}
+	if config.State.File != "" {
+		err = loadStateSnapshot(config.State.File, stateCaches, stateMaxAge)
+		check(errorType, "Unable to restore state snapshot", err)
+	}
+
+	// Media archive, if configured
+	if config.Archive.Directory != "" {
+		archiver, err = NewArchiver(config.Archive)
+		check(errorType, "Unable to set up the media archive directory", err)
+	}
+
+	// Feed store, if configured
+	if config.Feed.File != "" {
+		feedStore, err = NewFeedStore(config.Feed.File, config.Feed.MaxItems)
+		check(errorType, "Unable to load the feed store", err)
+	}
+
+	// How many must_follow targets have to be followed (see mustfollow.go)
+	switch config.Settings.MustFollowMode {
+	case "", mustFollowAny, mustFollowAll:
+	case mustFollowAtLeast:
+		if config.Settings.MustFollowAtLeast < 1 || config.Settings.MustFollowAtLeast > len(config.Settings.MustFollow) {
+			log.Fatalf("must_follow_at_least must be between 1 and the number of must_follow accounts (%d). Check JSON configuration file.", len(config.Settings.MustFollow))
+		}
+	default:
+		log.Fatalf("Unknown must_follow_mode %q. Check JSON configuration file.", config.Settings.MustFollowMode)
+	}
+
+	// What to do when follow checks can't be answered (see verifyqueue.go)
+	switch config.Settings.FollowUnknown.Policy {
+	case "", followUnknownFailClosed, followUnknownFailOpen:
+	case followUnknownWait:
+		followQueue = NewFollowVerifyQueue(config.Settings.FollowUnknown)
+		prometheus.MustRegister(followQueueLength)
+	default:
+		log.Fatalf("Unknown follow_unknown policy %q. Check JSON configuration file.", config.Settings.FollowUnknown.Policy)
+	}
+
+	// Follower graphs of the must_follow targets, synced in the background by main()
+	if config.Settings.FollowGraph.Enabled && len(config.Settings.MustFollow) > 0 {
+		followGraphs = make(map[string]*FollowGraph)
+		for _, target := range config.Settings.MustFollow {
+			followGraphs[strings.ToLower(target.ScreenName)] = NewFollowGraph(target.ScreenName)
+		}
+
+		if config.Settings.FollowGraph.File != "" {
+			err = loadFollowGraphs(config.Settings.FollowGraph.File, followGraphs)
+			check(errorType, "Unable to load the follow graph file", err)
+		}
+
+		prometheus.MustRegister(followGraphCollector{})
+	}
+
+	profileFilters, err = compileProfileFilters(config.Settings.ProfileFilters)
+	if err != nil {
+		log.Fatalf("Invalid profile_filters: %v. Check JSON configuration file.", err)
+	}
+
+	// Deny lists besides the bot's own mutes (see denylist.go)
+	for _, m := range config.Settings.Mutes.Moderators {
+		if m.ScreenName == "" || m.AccessToken == "" || m.AccessTokenSecret == "" {
+			log.Fatalf("Moderator accounts in mutes.moderators need a screen_name, access_token and access_token_secret. Check JSON configuration file.")
+		}
+	}
 
-	// LRU: Small LRU for keeping the last few posts we've seen so far
-	postTextLRU = lru.New(25)
+	for _, l := range config.Settings.Mutes.Lists {
+		if l.ID == 0 && (l.Owner == "" || l.Slug == "") {
+			log.Fatalf("Lists in mutes.lists need a list_id, or an owner_screen_name and slug. Check JSON configuration file.")
+		}
+	}
+
+	// What to do with re-posts (see repost.go)
+	switch config.Settings.RepostPolicy {
+	case "", repostAllow, repostPreferOriginal, repostDeny:
+	default:
+		log.Fatalf("Unknown repost_policy %q. Check JSON configuration file.", config.Settings.RepostPolicy)
+	}
 
-	// LRU: Very small LRU for keeping recent URLs we've posted
-	urlLRU = lru.New(10)
+	// Poster hash index for perceptual duplicate detection
+	if config.Settings.PerceptualDedup.Enabled {
+		phashIndex, err = NewPerceptualIndex(config.Settings.PerceptualDedup)
+		check(errorType, "Unable to load the perceptual hash index", err)
+	}
 
 	// Load gated content types into a memberset
 	for _, types := range config.Settings.DeltaGatedContent {
@@ -246,20 +436,37 @@ func ConfigureApp(errorType ErrorInterface) {
 	}
 
 	// Add prohibited* to membersets
-	for _, entries := range config.Settings.ProhibitedMentions {
-		prohibitedMentions.Add(entries)
+	prohibitedMentionNames = loadProhibitedMentions(config.Settings.ProhibitedMentions, prohibitedMentions)
+
+	prohibitedWords, err = compileProhibitedTerms(config.Settings.ProhibitedWords, config.Settings.ProhibitedPatterns)
+	if err != nil {
+		log.Fatalf("Invalid prohibited_patterns: %v. Check JSON configuration file.", err)
+	}
+
+	switch config.Settings.Languages.Undetermined {
+	case "", undeterminedAllow, undeterminedDeny:
+	default:
+		log.Fatalf("Unknown languages.undetermined %q. Check JSON configuration file.", config.Settings.Languages.Undetermined)
+	}
+
+	trackTerms = parseTrackTerms(config.SearchTerms)
+
+	linkDomains, err = compileLinkDomains(config.Settings.LinkDomains)
+	if err != nil {
+		log.Fatalf("Invalid link_domains: %v. Check JSON configuration file.", err)
 	}
 
-	for _, entries := range config.Settings.ProhibitedWords {
-		prohibitedWords.Add(entries)
+	if err := config.Settings.VideoQuality.compile(); err != nil {
+		log.Fatalf("Invalid video_quality: %v. Check JSON configuration file.", err)
 	}
 
 }
 
-// APIInterface -- .Retweet and .GetUsersLookup interfaces for production
+// APIInterface -- .Retweet, .GetUsersLookup and .GetTweet interfaces for production
 type APIInterface interface {
 	Retweet(id int64, trimUser bool) (rt anaconda.Tweet, err error)
 	GetUsersLookup(usernames string, v url.Values) (u []anaconda.User, err error)
+	GetTweet(id int64, v url.Values) (t anaconda.Tweet, err error)
 }
 
 // APIAccess passes control to Anaconda in production
@@ -275,72 +482,276 @@ func (fs APIAccess) GetUsersLookup(usernames string, v url.Values) (u []anaconda
 	return api.GetUsersLookup(usernames, v)
 }
 
+// GetTweet passes to Anaconda's GetTweet()
+func (fs APIAccess) GetTweet(id int64, v url.Values) (t anaconda.Tweet, err error) {
+	return api.GetTweet(id, v)
+}
+
+// Decision is the trace of checks a tweet went through in processTweet.
+// It travels with approved tweets so consumers can see why they passed.
+type Decision struct {
+	Verdict string   `json:"verdict"`
+	Checks  []string `json:"checks"`
+
+	// The check that turned the tweet away, and why
+	RejectedBy string `json:"rejected_by,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+
+	// Search terms and watched users the tweet really matched (see
+	// relevance.go)
+	MatchedTerms []string `json:"matched_terms,omitempty"`
+
+	// ID of the re-post that led us to this tweet (see repost.go)
+	ResolvedFrom int64 `json:"resolved_from,omitempty"`
+}
+
+// passed records a check that the tweet has cleared
+func (d *Decision) passed(check string) {
+	d.Checks = append(d.Checks, check)
+}
+
+// rejected records the check that turned the tweet away, and counts it
+// under that label in tweets_processed
+func (d *Decision) rejected(check string, reason string) {
+	d.Verdict = "reject"
+	d.RejectedBy = check
+	d.Reason = reason
+	tweetsProcessed.WithLabelValues(check, "reject").Add(1)
+}
+
+// log writes the decision on a tweet as a single entry
+func (d *Decision) log(status anaconda.Tweet) {
+	fields := log.Fields{"statusId": status.Id, "user": status.User.ScreenName, "verdict": d.Verdict}
+
+	if d.RejectedBy != "" {
+		fields["check"] = d.RejectedBy
+		fields["reason"] = d.Reason
+	}
+
+	if len(d.MatchedTerms) > 0 {
+		fields["terms"] = strings.Join(d.MatchedTerms, ", ")
+	}
+
+	if d.ResolvedFrom != 0 {
+		fields["resolvedFrom"] = d.ResolvedFrom
+	}
+
+	log.WithFields(fields).Info("Decision")
+}
+
 // processTweet runs through validation and
 // other steps before actually retweeting. Intended to be
 // called via goroutine so we can do many re-tweets under
 // processing load
 func processTweet(a APIInterface, fs FriendshipStatus, status anaconda.Tweet) bool {
-	tweetLog := log.WithFields(log.Fields{"statusId": status.Id, "statusText": status.Text})
-
 	tweetsProcessed.WithLabelValues("tweetsSeen", "count").Add(1)
 
+	decision := &Decision{}
+
+	// Tag the tweet with the search terms or watched user that brought it
+	// in. Once it is decided, log the decision and count its verdict by
+	// term (tweets deferred by the follow verification queue are counted
+	// once the queue decides them).
+	decision.MatchedTerms = matchedTerms(status, trackTerms, watchedUsers)
+	defer func() {
+		decision.log(status)
+
+		switch decision.Verdict {
+		case "allow":
+			countTermVerdict(decision, "allow")
+		case "defer":
+		default:
+			countTermVerdict(decision, "reject")
+		}
+	}()
+
+	// Make sure the stream didn't match on a URL or display name
+	if config.Settings.RequireRelevance {
+		if len(decision.MatchedTerms) == 0 {
+			decision.rejected("relevance", "no search term in the hashtags, mentions or text, and not from a watched user")
+			return false
+		}
+		log.Printf("processTweet: Matched %v", strings.Join(decision.MatchedTerms, ", "))
+		decision.passed("relevance")
+	}
+
+	// Re-posts of someone else's media: depending on the repost policy,
+	// reject them or check (and retweet) the original instead
+	status, resolvedFrom, rejectLabel := resolveCanonicalSource(a, status, config.Settings.RepostPolicy)
+	if rejectLabel != "" {
+		decision.rejected(rejectLabel, repostRejectReasons[rejectLabel])
+		return false
+	}
+	decision.ResolvedFrom = resolvedFrom
+	decision.passed("canonicalSource")
+
 	approved, tweetType, tweetContent := checkTweetContent(status)
 
 	if !approved {
-		tweetsProcessed.WithLabelValues("checkTweetContentReject", "reject").Add(1)
+		if isContentType(tweetType) {
+			contentTypesProcessed.WithLabelValues(tweetType, "rejected").Add(1)
+		}
+		decision.rejected("checkTweetContentReject", fmt.Sprintf("tweet has no content we retweet (type: %q)", tweetType))
 		return false
 	}
+	contentTypesProcessed.WithLabelValues(tweetType, "accepted").Add(1)
+	decision.passed("checkTweetContent")
 
 	log.Printf("type: %v | content: %v | filter_level: %v", tweetType, tweetContent, status.FilterLevel)
 
+	// Turn away tiny, low bitrate or overly long videos
+	if ok, rejectLabel := checkVideoQuality(status, config.Settings.VideoQuality); !ok {
+		decision.rejected(rejectLabel, fmt.Sprintf("video failed the %v quality gate", rejectLabel))
+		return false
+	}
+	decision.passed("videoQuality")
+
+	// Languages and regions the community doesn't read
+	if config.Settings.Languages.enabled() {
+		if ok, rejectLabel, reason := checkLanguage(status, config.Settings.Languages); !ok {
+			decision.rejected(rejectLabel, reason)
+			return false
+		}
+		decision.passed("language")
+	}
+
+	if config.Settings.PlaceCountries.enabled() {
+		if ok, reason := checkPlaceCountry(status, config.Settings.PlaceCountries); !ok {
+			decision.rejected("placeCountry", reason)
+			return false
+		}
+		decision.passed("placeCountry")
+	}
+
 	// Check prohibited mention(s) for this tweet
 	if checkForProhibitedMentions(status, prohibitedMentions) == false {
-		tweetsProcessed.WithLabelValues("prohibitedMentions", "reject").Add(1)
+		decision.rejected("prohibitedMentions", "tweet mentions a prohibited user")
 		return false
 	}
+	decision.passed("prohibitedMentions")
 
 	if checkForProhibitedWords(status, prohibitedWords) == false {
-		tweetsProcessed.WithLabelValues("prohibitedWords", "reject").Add(1)
+		decision.rejected("prohibitedWords", "tweet contains a prohibited term")
+		return false
+	}
+	decision.passed("prohibitedWords")
+
+	// Links to denied (or not allowed) domains
+	if ok, reason := checkLinkDomains(status, linkDomains); !ok {
+		decision.rejected("linkDomain", reason)
 		return false
 	}
+	decision.passed("linkDomains")
+
+	// Prohibited terms in the author's name, bio, location or website
+	if ok, rejectLabel, reason := checkProfile(status, profileFilters); !ok {
+		decision.rejected(rejectLabel, reason)
+		return false
+	}
+	decision.passed("profileFilters")
 
 	// Check account age
 	if checkAccountAge(status, config.Settings.MinAccountAgeHours) == false {
-		tweetsProcessed.WithLabelValues("accountAgeHours", "reject").Add(1)
+		decision.rejected("accountAgeHours", fmt.Sprintf("account is younger than %v hours", config.Settings.MinAccountAgeHours))
 		return false
 	}
+	decision.passed("accountAgeHours")
+
+	// Followers, following ratio, tweet count, avatar, name changes
+	if config.Settings.Reputation.enabled() {
+		if failures := checkReputation(status, config.Settings.Reputation, nameHistoryLRU, time.Now()); len(failures) > 0 {
+			decision.rejected("reputation", reputationReason(failures))
+			return false
+		}
+		decision.passed("reputation")
+	}
 
 	// Sleepy developer: Note the reversal of passing here.
-	if userIsMuted(status.User.Id, mutedIds) == true {
-		tweetsProcessed.WithLabelValues("mutedUserId", "reject").Add(1)
+	if userIsMuted(status.User.Id, currentMutedIds()) == true {
+		countDenied(status)
+		decision.rejected("mutedUserId", "user is muted or on a deny list")
+		return false
+	}
+	decision.passed("mutedUserId")
+
+	// Have we seen the same (or nearly the same) post text recently? Happens with
+	// eventual-consistency sometimes, and with spammers changing an emoji or URL.
+	if checkPostRecentLRU(tweetFullText(status)) == false {
+		decision.rejected("postDuplicateInLRU", "the same (or nearly the same) text was posted recently")
+		return false
+	}
+	decision.passed("postDuplicateInLRU")
+
+	// Posting too quickly, or re-posting a clip we've approved recently
+	ok, posterHashes := checkRecentActivity(status, tweetType, decision)
+	if !ok {
+		return false
+	}
+
+	// Ensure user is following enough of the MustFollow targets. If the
+	// API can't tell us right now, follow_unknown decides (see verifyqueue.go)
+	switch checkMustFollow(fs, status, config.Settings.MustFollow, config.Settings.MustFollowMode, config.Settings.MustFollowAtLeast) {
+	case followNo:
+		decision.rejected("mustFollow", "user doesn't follow enough of the must_follow accounts")
 		return false
+	case followUnknown:
+		pending := PendingTweet{API: a, Friendships: fs, Status: status, TweetType: tweetType, Decision: decision}
+		if handleFollowUnknown(pending, config.Settings.FollowUnknown) == false {
+			return false
+		}
+	default:
+		decision.passed("mustFollow")
 	}
 
+	return retweetApproved(a, status, tweetType, decision, posterHashes)
+
+}
+
+// checkRecentActivity runs the checks that depend on what has been seen
+// or approved recently: the user's content and post deltas, and duplicate
+// media. processTweet runs it, and the follow verification queue runs it
+// again before retweeting a deferred tweet, as the same clip may have been
+// approved while it waited. Returns the poster hashes of the tweet.
+func checkRecentActivity(status anaconda.Tweet, tweetType string, decision *Decision) (bool, []uint64) {
 	// Reject if the user posts certain kinds of content too quickly
 	if checkContentDelta(status.User.Id, status.User.ScreenName, tweetType, deltaGatedContent, config.Settings.ContentTimeDelta, &status) == false {
-		tweetsProcessed.WithLabelValues("contentTimeDelta", "reject").Add(1)
-		return false
+		decision.rejected("contentTimeDelta", fmt.Sprintf("user posted %v too soon after their last one", tweetType))
+		return false, nil
 	}
+	decision.passed("contentTimeDelta")
 
 	// Timing control for all posts we see from a user
 	// Only status.User.Id is used for validation (its presumably static).
 	// The ScreenName is used for debugging/display purposes (can vary).
 	if checkUserPostDelta(status.User.Id, status.User.ScreenName, config.Settings.PostTimeDelta, &status) == false {
-		tweetsProcessed.WithLabelValues("userPostDelta", "reject").Add(1)
-		return false
+		decision.rejected("userPostDelta", "user posted too soon after their last post")
+		return false, nil
 	}
+	decision.passed("userPostDelta")
 
-	// Have we seen the same post text recently? Happens with eventual-consistency sometimes.
-	if checkPostRecentLRU(status.Text) == false {
-		tweetsProcessed.WithLabelValues("postDuplicateInLRU", "reject").Add(1)
-		return false
+	// Has the same clip been posted recently, by anyone?
+	if checkDuplicateMedia(mediaKeys(status)) == false {
+		decision.rejected("duplicateMedia", "media was approved recently")
+		return false, nil
 	}
-
-	// Ensure user is following a target if we set MustFollow
-	if checkUserFollowing(fs, status, config.Settings.MustFollow) == false {
-		tweetsProcessed.WithLabelValues("mustFollow", "reject").Add(1)
-		return false
+	decision.passed("duplicateMedia")
+
+	// Does the poster look like a clip we've approved recently? Catches
+	// re-uploads that got new media IDs.
+	posterUnique, posterHashes := checkPerceptualDuplicate(status, phashIndex)
+	if posterUnique == false {
+		decision.rejected("perceptualDuplicate", "poster looks like a clip approved recently")
+		return false, nil
 	}
+	decision.passed("perceptualDuplicate")
+
+	return true, posterHashes
+}
+
+// retweetApproved retweets a tweet that passed processTweet, and hands
+// it to the approved tweet sinks
+func retweetApproved(a APIInterface, status anaconda.Tweet, tweetType string, decision *Decision, posterHashes []uint64) bool {
+	tweetLog := log.WithFields(log.Fields{"statusId": status.Id, "statusText": status.Text})
 
 	// Decide what kind of action to take based on detected content
 	// if any pre-filtering is required (such as content conversion)
@@ -367,11 +778,29 @@ func processTweet(a APIInterface, fs FriendshipStatus, status anaconda.Tweet) bo
 			// likely to repeat/not good. Try to crash out.
 			checkRetweetErrors(ErrorsAreFatal{}, "Could not retweet", err)
 			tweetsProcessed.WithLabelValues("retweeted", "allow").Add(1)
+			contentTypesProcessed.WithLabelValues(tweetType, "retweeted").Add(1)
 		} else {
 			tweetLog.Warn("Test mode; this tweet has not been retweeted because test_mode is true in the configuration")
 		}
 	}
 
+	decision.Verdict = "allow"
+
+	rememberMedia(mediaKeys(status))
+
+	if phashIndex != nil {
+		if err := phashIndex.Add(status.Id, posterHashes); err != nil {
+			tweetLog.Errorf("Unable to save perceptual hash index: %v", err)
+		}
+	}
+
+	// Webhooks, the archive and the feed only hear about real retweets
+	if config.TestMode {
+		tweetLog.Warn("Test mode; webhooks, the archive and the feed have not been given this tweet")
+	} else {
+		handleApproved(newApprovedItem(status, tweetType, decision))
+	}
+
 	return true
 
 }
@@ -400,6 +829,7 @@ func buildSearchTerms(a APIInterface, searchTerms string, watchUsers string) url
 
 		for _, u := range users {
 			userIDs = append(userIDs, strconv.FormatInt(u.Id, 10))
+			watchedUsers[u.Id] = u.ScreenName
 		}
 		userIDsToWatch := strings.Join(userIDs, ",")
 		log.Printf(" ---> Watching for tweets from: [ users: %v ][ ids: %v ] \n", watchUsers, userIDsToWatch)
@@ -437,10 +867,43 @@ func runPublicStreamFilter() {
 func main() {
 
 	ConfigureApp(ErrorsAreFatal{})
-	populateMutedList(MutedInfo{}, url.Values{}, mutedIds)
+
+	if flag.NArg() > 0 {
+		check(ErrorsAreFatal{}, "Command failed", runCommand(flag.Args()))
+		return
+	}
+
+	// Match prohibited mentions by user ID, so renames don't get around them
+	resolveProhibitedMentions(APIAccess{}, prohibitedMentionNames, prohibitedMentions)
+
+	sources := denySources(DenyListInfo{API: api}, config.Settings.Mutes, moderatorAPI)
+	nextMuteExpiry, err := refreshMutedList(sources, config.Settings.Mutes, time.Now())
+	if err != nil {
+		log.Errorf("Unable to read every deny list, retrying shortly: %v", err)
+		if retry := time.Now().Add(muteRetryDelay); nextMuteExpiry.IsZero() || nextMuteExpiry.After(retry) {
+			nextMuteExpiry = retry
+		}
+	}
+	go runMuteRefresh(sources, config.Settings.Mutes, nextMuteExpiry)
+
+	if config.State.File != "" {
+		go runStateSnapshots(config.State, stateCaches)
+	}
+
+	if followGraphs != nil {
+		go runFollowGraphSync(FollowIDsInfo{}, config.Settings.FollowGraph, followGraphs)
+	}
+
+	if followQueue != nil {
+		go followQueue.Run()
+	}
 
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
+		if feedStore != nil {
+			feedStore.registerHandlers(http.DefaultServeMux, config.Feed)
+			log.Info("Feeds of approved tweets are available at /feed.atom, /feed.rss and /feed.json")
+		}
 		log.Info("This bot provides prometheus metrics. Available at http://127.0.0.1:8080/metrics")
 		log.Fatal(http.ListenAndServe("127.0.0.1:8080", nil))
 	}()
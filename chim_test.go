@@ -3,8 +3,9 @@ package main
 import (
 	"errors"
 	"github.com/davidk/anaconda"
-	"github.com/davidk/lru"
 	"github.com/davidk/memberset"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"net/url"
 	"strings"
 	"testing"
@@ -12,11 +13,11 @@ import (
 
 func init() {
 	// Testing LRUs
-	tweetOriginatorLRU = lru.New(128)
-	userPostDeltaLRU = lru.New(128)
+	tweetOriginatorLRU = newStateCache("tweetOriginator", 128)
+	userPostDeltaLRU = newStateCache("userPostDelta", 128)
 	// Small LRU for keeping the last few posts we've seen so far
-	postTextLRU = lru.New(25)
-	urlLRU = lru.New(5)
+	postTextLRU = newStateCache("postText", 25)
+	urlLRU = newStateCache("url", 5)
 }
 
 func printDebug(t *testing.T) {
@@ -93,6 +94,10 @@ func (fs FakeAPIRetweet) GetUsersLookup(usernames string, v url.Values) (u []ana
 	return []anaconda.User{{Id: 12345}, {Id: 6789}, {Id: 101112131415}}, nil
 }
 
+func (fs FakeAPIRetweet) GetTweet(id int64, v url.Values) (t anaconda.Tweet, err error) {
+	return fs.Response, fs.Error
+}
+
 // FakeMuteInfo is passed to GetMutedUsersList to stub/mock
 // the call to twitter
 type FakeMuteInfo struct {
@@ -240,6 +245,32 @@ func TestProcessTweet(t *testing.T) {
 	}
 }
 
+// TestProcessTweetLogsDecision checks that a decision is logged once, with
+// the check that rejected the tweet and why
+func TestProcessTweetLogsDecision(t *testing.T) {
+	hooks := log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	defer log.StandardLogger().ReplaceHooks(hooks)
+	hook := logtest.NewGlobal()
+
+	processTweet(FakeAPIRetweet{}, FakeFriendshipInfo{}, anaconda.Tweet{Id: 4040, User: anaconda.User{ScreenName: "textOnly"}})
+
+	var decisions []*log.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Decision" {
+			decisions = append(decisions, entry)
+		}
+	}
+
+	if len(decisions) != 1 {
+		t.Fatalf("Wanted one decision entry, got %d", len(decisions))
+	}
+
+	fields := decisions[0].Data
+	if fields["statusId"] != int64(4040) || fields["verdict"] != "reject" || fields["check"] != "checkTweetContentReject" || fields["reason"] == "" {
+		t.Errorf("Unexpected decision entry: %v", fields)
+	}
+}
+
 func TestPopulateMuteList(t *testing.T) {
 	mutedIds = memberset.New()
 	populateMutedList(FakeMuteInfo{}, url.Values{}, mutedIds)
@@ -269,3 +300,48 @@ func TestPopulateMuteList(t *testing.T) {
 	}
 
 }
+
+// TestRejectedTweetDoesNotBlockMedia ensures a clip posted first by someone
+// a later check rejects can still be retweeted from someone else
+func TestRejectedTweetDoesNotBlockMedia(t *testing.T) {
+	mutedIds = memberset.New()
+	defer func(targets FollowTargets) { config.Settings.MustFollow = targets }(config.Settings.MustFollow)
+
+	clip := func(id int64, screenName string, text string) anaconda.Tweet {
+		return anaconda.Tweet{
+			Id:        id,
+			CreatedAt: "Wed Aug 27 13:08:45 +0000 2008",
+			Text:      text,
+			User: anaconda.User{
+				Id:         id,
+				ScreenName: screenName,
+				CreatedAt:  "Wed Aug 27 13:08:45 +0000 2008"},
+			ExtendedEntities: anaconda.Entities{
+				Media: []anaconda.EntityMedia{
+					{Id_str: "900900", Type: "video",
+						VideoInfo: anaconda.VideoInfo{
+							Variants: []anaconda.Variant{
+								{ContentType: "video/mp4", Url: "https://video.twimg.com/ext_tw_video/900900/vid/clip.mp4"},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	// Rejected by must_follow, after the duplicate media check
+	config.Settings.MustFollow = FollowTargets{{ScreenName: "studio"}}
+	if processTweet(FakeAPIRetweet{}, FakeFriendshipInfo{}, clip(880001, "noFollow", "first upload of the clip")) {
+		t.Fatal("Expected the tweet from a non-follower to be rejected")
+	}
+
+	config.Settings.MustFollow = nil
+	if !processTweet(FakeAPIRetweet{}, FakeFriendshipInfo{}, clip(880002, "bothFollow", "the same clip, from a follower")) {
+		t.Error("The clip was blocked by a tweet that was rejected")
+	}
+
+	if processTweet(FakeAPIRetweet{}, FakeFriendshipInfo{}, clip(880003, "bothFollow2", "and again, from someone else")) {
+		t.Error("The retweeted clip was not remembered")
+	}
+}
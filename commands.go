@@ -0,0 +1,21 @@
+// Sub-commands that run instead of the bot. These are given after the
+// flags, i.e.: chim -c config.json gallery -o ./site
+package main
+
+import (
+	"fmt"
+)
+
+// runCommand dispatches a sub-command. args[0] is the command name.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "gallery":
+		return runGallery(args[1:])
+	case "blocklist":
+		return runBlocklist(args[1:])
+	case "report":
+		return runReport(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
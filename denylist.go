@@ -0,0 +1,238 @@
+// Deny lists. Besides the bot's own mutes, users can be denied because the
+// bot blocked them, because a moderator account blocked or muted them, or
+// because they are on a Twitter list kept as a shared blocklist. Every
+// source is merged into one set, which remembers where each user came
+// from so rejections can name the list.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/davidk/anaconda"
+	"github.com/davidk/memberset"
+	"github.com/garyburd/go-oauth/oauth"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ModeratorAccount is an account whose blocks and/or mutes are denied.
+// Twitter only lists blocks and mutes to the account itself, so each
+// moderator needs its own access token (for the bot's consumer key).
+// If neither Blocks nor Mutes is set, both are used.
+type ModeratorAccount struct {
+	ScreenName        string `json:"screen_name"`
+	AccessToken       string `json:"access_token"`
+	AccessTokenSecret string `json:"access_token_secret"`
+	Blocks            bool   `json:"blocks"`
+	Mutes             bool   `json:"mutes"`
+}
+
+// DenyList is a Twitter list used as a shared blocklist, given either by
+// ID or by owner and slug
+type DenyList struct {
+	ID    int64  `json:"list_id"`
+	Owner string `json:"owner_screen_name"`
+	Slug  string `json:"slug"`
+}
+
+// GetDenyLists wraps the Anaconda calls that list denied users, for testing
+type GetDenyLists interface {
+	GetMutedList
+	GetBlocksList(v url.Values) (c anaconda.UserCursor, err error)
+	GetListMembers(v url.Values) (c anaconda.UserCursor, err error)
+}
+
+// DenyListInfo passes control to Anaconda in production, as the account
+// API is authenticated as
+type DenyListInfo struct {
+	API *anaconda.TwitterApi
+}
+
+// GetMutedUsersList passes to Anaconda's GetMutedUsersList()
+func (d DenyListInfo) GetMutedUsersList(v url.Values) (c anaconda.UserCursor, err error) {
+	return d.API.GetMutedUsersList(v)
+}
+
+// GetBlocksList passes to Anaconda's GetBlocksList()
+func (d DenyListInfo) GetBlocksList(v url.Values) (c anaconda.UserCursor, err error) {
+	return d.API.GetBlocksList(v)
+}
+
+// GetListMembers calls lists/members, which Anaconda doesn't wrap. The
+// request is signed the same way Anaconda signs its own.
+func (d DenyListInfo) GetListMembers(v url.Values) (c anaconda.UserCursor, err error) {
+	client := oauth.Client{Credentials: oauth.Credentials{Token: config.ConsumerKey, Secret: config.ConsumerSecret}}
+
+	resp, err := client.Get(d.API.HttpClient, d.API.Credentials, anaconda.BaseUrl+"/lists/members.json", v)
+	if err != nil {
+		return c, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return c, anaconda.NewApiError(resp)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&c)
+	return c, err
+}
+
+// denySource is one paged listing of users to deny
+type denySource struct {
+	Name   string
+	Values url.Values
+	Fetch  func(v url.Values) (anaconda.UserCursor, error)
+}
+
+// DenySet is the merged set of denied user IDs. IDs is what userIsMuted
+// checks; sources records which lists each ID is on.
+type DenySet struct {
+	IDs     *memberset.MemberSet
+	sources map[int64][]string
+}
+
+var (
+	// Where each ID in mutedIds came from. Swapped with mutedIds.
+	mutedSources map[int64][]string
+
+	deniedBySource = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tweets_denied_by_source",
+			Help: "Tweets rejected because their author is on a deny list, by list.",
+		},
+		[]string{"source"},
+	)
+)
+
+// NewDenySet creates an empty DenySet
+func NewDenySet() *DenySet {
+	return &DenySet{IDs: memberset.New(), sources: make(map[int64][]string)}
+}
+
+// Deny adds id to the set, as coming from source
+func (d *DenySet) Deny(id int64, source string) {
+	d.IDs.Add(id)
+
+	for _, s := range d.sources[id] {
+		if s == source {
+			return
+		}
+	}
+
+	d.sources[id] = append(d.sources[id], source)
+}
+
+// Sources returns the lists id is on
+func (d *DenySet) Sources(id int64) []string {
+	return d.sources[id]
+}
+
+// Len returns the number of denied IDs
+func (d *DenySet) Len() int {
+	return len(d.sources)
+}
+
+// denySources lists every API source configured in c. own is the bot's
+// account; moderator returns the API for a moderator account.
+func denySources(own GetDenyLists, c MuteConfig, moderator func(ModeratorAccount) GetDenyLists) []denySource {
+	sources := []denySource{{Name: "mutes", Fetch: own.GetMutedUsersList}}
+
+	if c.Blocks {
+		sources = append(sources, denySource{Name: "blocks", Fetch: own.GetBlocksList})
+	}
+
+	for _, m := range c.Moderators {
+		a := moderator(m)
+		name := "@" + strings.TrimPrefix(m.ScreenName, "@")
+
+		if m.Blocks || !m.Mutes {
+			sources = append(sources, denySource{Name: name + " blocks", Fetch: a.GetBlocksList})
+		}
+
+		if m.Mutes || !m.Blocks {
+			sources = append(sources, denySource{Name: name + " mutes", Fetch: a.GetMutedUsersList})
+		}
+	}
+
+	for _, l := range c.Lists {
+		v := url.Values{}
+		v.Set("count", "5000")
+		v.Set("skip_status", "true")
+		v.Set("include_entities", "false")
+
+		var name string
+		if l.ID != 0 {
+			v.Set("list_id", strconv.FormatInt(l.ID, 10))
+			name = fmt.Sprintf("list %d", l.ID)
+		} else {
+			v.Set("owner_screen_name", l.Owner)
+			v.Set("slug", l.Slug)
+			name = fmt.Sprintf("list @%v/%v", strings.TrimPrefix(l.Owner, "@"), l.Slug)
+		}
+
+		sources = append(sources, denySource{Name: name, Values: v, Fetch: own.GetListMembers})
+	}
+
+	return sources
+}
+
+// moderatorAPI creates an API client for a moderator account
+func moderatorAPI(m ModeratorAccount) GetDenyLists {
+	return DenyListInfo{API: anaconda.NewTwitterApi(m.AccessToken, m.AccessTokenSecret)}
+}
+
+// fetchUsers pages through a listing of users, passing each to add
+func fetchUsers(fetch func(url.Values) (anaconda.UserCursor, error), v url.Values, add func(anaconda.User)) error {
+	values := url.Values{}
+	for k, vs := range v {
+		values[k] = vs
+	}
+
+	for {
+		cursor, err := fetch(values)
+		if err != nil {
+			return err
+		}
+
+		for _, user := range cursor.Users {
+			add(user)
+		}
+
+		if cursor.Next_cursor_str == "0" || cursor.Next_cursor_str == "" {
+			return nil
+		}
+
+		values.Set("cursor", cursor.Next_cursor_str)
+	}
+}
+
+// setDenySet swaps in d as the muted user set
+func setDenySet(d *DenySet) {
+	mutedIdsLock.Lock()
+	mutedIds, mutedSources = d.IDs, d.sources
+	mutedIdsLock.Unlock()
+}
+
+// denySourcesOf returns the lists a muted user is on
+func denySourcesOf(id int64) []string {
+	mutedIdsLock.RLock()
+	defer mutedIdsLock.RUnlock()
+	return mutedSources[id]
+}
+
+// countDenied logs and counts a rejection by the lists the user is on
+func countDenied(status anaconda.Tweet) {
+	sources := denySourcesOf(status.User.Id)
+	if len(sources) == 0 {
+		sources = []string{"unknown"}
+	}
+
+	log.Infof("processTweet: REJECT - %v [id: %v] is on deny lists: %v", status.User.ScreenName, status.User.Id, strings.Join(sources, ", "))
+
+	for _, s := range sources {
+		deniedBySource.WithLabelValues(s).Add(1)
+	}
+}
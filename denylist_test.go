@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"github.com/davidk/anaconda"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// FakeDenyLists returns one page of users per listing
+type FakeDenyLists struct {
+	Muted   []anaconda.User
+	Blocked []anaconda.User
+	Members map[string][]anaconda.User
+	Err     error
+}
+
+func (f FakeDenyLists) GetMutedUsersList(v url.Values) (anaconda.UserCursor, error) {
+	return anaconda.UserCursor{Next_cursor_str: "0", Users: f.Muted}, f.Err
+}
+
+func (f FakeDenyLists) GetBlocksList(v url.Values) (anaconda.UserCursor, error) {
+	return anaconda.UserCursor{Next_cursor_str: "0", Users: f.Blocked}, f.Err
+}
+
+func (f FakeDenyLists) GetListMembers(v url.Values) (anaconda.UserCursor, error) {
+	key := v.Get("list_id")
+	if key == "" {
+		key = v.Get("owner_screen_name") + "/" + v.Get("slug")
+	}
+	return anaconda.UserCursor{Next_cursor_str: "0", Users: f.Members[key]}, f.Err
+}
+
+func TestDenySources(t *testing.T) {
+	own := FakeDenyLists{
+		Muted:   []anaconda.User{{Id: 1}},
+		Blocked: []anaconda.User{{Id: 2}, {Id: 5}},
+		Members: map[string][]anaconda.User{
+			"99":        {{Id: 3}},
+			"mods/spam": {{Id: 5}},
+		},
+	}
+
+	moderators := map[string]GetDenyLists{
+		"alice": FakeDenyLists{Muted: []anaconda.User{{Id: 4}}, Blocked: []anaconda.User{{Id: 6}}},
+		"bob":   FakeDenyLists{Err: errors.New("revoked token")},
+	}
+
+	c := MuteConfig{
+		Blocks: true,
+		Moderators: []ModeratorAccount{
+			{ScreenName: "alice", Mutes: true},
+			{ScreenName: "@bob"},
+		},
+		Lists: []DenyList{{ID: 99}, {Owner: "mods", Slug: "spam"}},
+	}
+
+	sources := denySources(own, c, func(m ModeratorAccount) GetDenyLists {
+		return moderators[strings.TrimPrefix(m.ScreenName, "@")]
+	})
+
+	var names []string
+	for _, s := range sources {
+		names = append(names, s.Name)
+	}
+
+	want := []string{"mutes", "blocks", "@alice mutes", "@bob blocks", "@bob mutes", "list 99", "list @mods/spam"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("Got sources %v, want %v", names, want)
+	}
+
+	previous := &DenySet{IDs: mutedIds, sources: mutedSources}
+	defer setDenySet(previous)
+
+	if _, err := refreshMutedList(sources, c, time.Now()); err == nil {
+		t.Error("Expected an error for the moderator with a revoked token")
+	}
+
+	var tests = []struct {
+		id      int64
+		sources []string
+	}{
+		{1, []string{"mutes"}},
+		{2, []string{"blocks"}},
+		{3, []string{"list 99"}},
+		{4, []string{"@alice mutes"}},
+		{5, []string{"blocks", "list @mods/spam"}},
+		{6, nil},
+	}
+
+	for _, test := range tests {
+		if got := denySourcesOf(test.id); !reflect.DeepEqual(got, test.sources) {
+			t.Errorf("Sources of %v are %v, want %v", test.id, got, test.sources)
+		}
+
+		if muted := userIsMuted(test.id, currentMutedIds()); muted != (test.sources != nil) {
+			t.Errorf("userIsMuted(%v) = %v", test.id, muted)
+		}
+	}
+}
+
+func TestDenySetDeny(t *testing.T) {
+	d := NewDenySet()
+	d.Deny(1, "mutes")
+	d.Deny(1, "mutes")
+	d.Deny(1, "blocks")
+
+	if got := d.Sources(1); !reflect.DeepEqual(got, []string{"mutes", "blocks"}) {
+		t.Errorf("Got sources %v", got)
+	}
+
+	if d.Len() != 1 {
+		t.Errorf("Got %d entries, want 1", d.Len())
+	}
+}
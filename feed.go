@@ -0,0 +1,440 @@
+// Atom, RSS and JSON Feed output of the most recently approved items,
+// for people who follow along without a Twitter account. Items are kept
+// in a small JSON file so the feed survives restarts.
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultFeedItems = 50
+
+// feedStore is nil unless a feed file is configured
+var feedStore *FeedStore
+
+// FeedConfig configures the feed endpoints
+type FeedConfig struct {
+	File        string `json:"file"`
+	MaxItems    int    `json:"max_items"`
+	Title       string `json:"title"`
+	Link        string `json:"link"`
+	Description string `json:"description"`
+}
+
+// FeedStore keeps the newest approved items, newest first
+type FeedStore struct {
+	Path     string
+	MaxItems int
+
+	items []ApprovedItem
+	sync.RWMutex
+}
+
+// NewFeedStore loads any items previously saved to path
+func NewFeedStore(path string, maxItems int) (*FeedStore, error) {
+	if maxItems <= 0 {
+		maxItems = defaultFeedItems
+	}
+
+	f := &FeedStore{Path: path, MaxItems: maxItems}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &f.items); err != nil {
+		return nil, err
+	}
+
+	if len(f.items) > f.MaxItems {
+		f.items = f.items[:f.MaxItems]
+	}
+
+	log.Infof("NewFeedStore: Loaded %d feed items from %v", len(f.items), path)
+
+	return f, nil
+}
+
+// Add puts an item at the top of the feed and saves the store
+func (f *FeedStore) Add(item ApprovedItem) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.items = append([]ApprovedItem{item}, f.items...)
+	if len(f.items) > f.MaxItems {
+		f.items = f.items[:f.MaxItems]
+	}
+
+	data, err := json.Marshal(f.items)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(f.Path, data, 0644)
+}
+
+// Items returns a copy of the current items, newest first
+func (f *FeedStore) Items() []ApprovedItem {
+	f.RLock()
+	defer f.RUnlock()
+
+	return append([]ApprovedItem(nil), f.items...)
+}
+
+// registerHandlers adds the feed endpoints to mux
+func (f *FeedStore) registerHandlers(mux *http.ServeMux, c FeedConfig) {
+	mux.HandleFunc("/feed.atom", func(w http.ResponseWriter, r *http.Request) {
+		writeFeed(w, "application/atom+xml; charset=utf-8", xml.Header, buildAtomFeed(c, feedSelfURL(r), f.Items()))
+	})
+	mux.HandleFunc("/feed.rss", func(w http.ResponseWriter, r *http.Request) {
+		writeFeed(w, "application/rss+xml; charset=utf-8", xml.Header, buildRSSFeed(c, f.Items()))
+	})
+	mux.HandleFunc("/feed.json", func(w http.ResponseWriter, r *http.Request) {
+		writeFeed(w, "application/feed+json; charset=utf-8", "", buildJSONFeed(c, feedSelfURL(r), f.Items()))
+	})
+}
+
+// writeFeed marshals a feed document as XML, or JSON if header is empty
+func writeFeed(w http.ResponseWriter, contentType string, header string, doc interface{}) {
+	var data []byte
+	var err error
+
+	if header != "" {
+		data, err = xml.MarshalIndent(doc, "", "  ")
+	} else {
+		data, err = json.MarshalIndent(doc, "", "  ")
+	}
+
+	if err != nil {
+		log.Errorf("writeFeed: Unable to marshal feed: %v", err)
+		http.Error(w, "unable to build feed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(header))
+	w.Write(data)
+}
+
+// feedSelfURL reconstructs the URL a feed was requested from
+func feedSelfURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.Path
+}
+
+// feedTitle is the channel title, defaulting to the bot's name
+func feedTitle(c FeedConfig) string {
+	if c.Title != "" {
+		return c.Title
+	}
+	return "chim"
+}
+
+// feedItemTitle is a one-line title for an item
+func feedItemTitle(item ApprovedItem) string {
+	text := []rune(strings.Join(strings.Fields(item.Text), " "))
+	if len(text) > 80 {
+		text = append([]rune(strings.TrimSpace(string(text[:80]))), '…')
+	}
+	return fmt.Sprintf("@%s: %s", item.Author.ScreenName, string(text))
+}
+
+// feedItemHTML renders an item's text with an embedded player for videos
+// and gifs, or the poster image for anything else
+func feedItemHTML(item ApprovedItem) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "<p>%s</p>", html.EscapeString(item.Text))
+
+	for _, m := range item.Media {
+		switch {
+		case m.VideoURL != "" && m.Type == "animated_gif":
+			fmt.Fprintf(&b, `<video autoplay loop muted playsinline poster="%s"><source src="%s" type="video/mp4"></video>`,
+				html.EscapeString(m.PosterURL), html.EscapeString(m.VideoURL))
+		case m.VideoURL != "":
+			fmt.Fprintf(&b, `<video controls preload="none" poster="%s"><source src="%s" type="video/mp4"></video>`,
+				html.EscapeString(m.PosterURL), html.EscapeString(m.VideoURL))
+		case m.PosterURL != "":
+			fmt.Fprintf(&b, `<img src="%s" alt="">`, html.EscapeString(m.PosterURL))
+		}
+	}
+
+	fmt.Fprintf(&b, `<p>— <a href="https://twitter.com/%s">@%s</a> (<a href="%s">original tweet</a>)</p>`,
+		html.EscapeString(item.Author.ScreenName), html.EscapeString(item.Author.ScreenName), html.EscapeString(item.URL))
+
+	return b.String()
+}
+
+// feedItemDate prefers the tweet's creation time over the approval time
+func feedItemDate(item ApprovedItem) time.Time {
+	if !item.CreatedAt.IsZero() {
+		return item.CreatedAt
+	}
+	return item.ApprovedAt
+}
+
+// feedUpdated is the date of the newest item (or now, for an empty feed)
+func feedUpdated(items []ApprovedItem) time.Time {
+	if len(items) > 0 {
+		return feedItemDate(items[0])
+	}
+	return time.Now().UTC()
+}
+
+// === Atom (RFC 4287) ===
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Links     []atomLink  `xml:"link"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    atomAuthor  `xml:"author"`
+	Content   atomContent `xml:"content"`
+}
+
+func buildAtomFeed(c FeedConfig, selfURL string, items []ApprovedItem) atomFeed {
+	feed := atomFeed{
+		Title:   feedTitle(c),
+		ID:      selfURL,
+		Links:   []atomLink{{Href: selfURL, Rel: "self", Type: "application/atom+xml"}},
+		Updated: feedUpdated(items).Format(time.RFC3339),
+	}
+
+	if c.Link != "" {
+		feed.Links = append(feed.Links, atomLink{Href: c.Link, Rel: "alternate"})
+	}
+
+	for _, item := range items {
+		date := feedItemDate(item).Format(time.RFC3339)
+		entry := atomEntry{
+			Title:     feedItemTitle(item),
+			ID:        item.URL,
+			Links:     []atomLink{{Href: item.URL, Rel: "alternate"}},
+			Published: date,
+			Updated:   date,
+			Author:    atomAuthor{Name: item.Author.ScreenName, URI: "https://twitter.com/" + item.Author.ScreenName},
+			Content:   atomContent{Type: "html", Body: feedItemHTML(item)},
+		}
+
+		for _, m := range item.Media {
+			if m.VideoURL != "" {
+				entry.Links = append(entry.Links, atomLink{Href: m.VideoURL, Rel: "enclosure", Type: "video/mp4"})
+			}
+		}
+
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	return feed
+}
+
+// === RSS 2.0 ===
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Description string        `xml:"description"`
+	Enclosure   *rssEnclosure `xml:"enclosure,omitempty"`
+}
+
+func buildRSSFeed(c FeedConfig, items []ApprovedItem) rssFeed {
+	description := c.Description
+	if description == "" {
+		description = "Recently retweeted clips"
+	}
+
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         feedTitle(c),
+			Link:          c.Link,
+			Description:   description,
+			LastBuildDate: feedUpdated(items).Format(time.RFC1123Z),
+		},
+	}
+
+	for _, item := range items {
+		rss := rssItem{
+			Title:       feedItemTitle(item),
+			Link:        item.URL,
+			GUID:        rssGUID{IsPermaLink: true, Value: item.URL},
+			PubDate:     feedItemDate(item).Format(time.RFC1123Z),
+			Description: feedItemHTML(item),
+		}
+
+		// RSS only allows a single enclosure per item, and it needs the
+		// length, which is only known once the video has been archived
+		for _, m := range item.Media {
+			if m.VideoURL != "" {
+				if size, ok := archivedSize(item, m.VideoURL); ok {
+					rss.Enclosure = &rssEnclosure{URL: m.VideoURL, Length: size, Type: "video/mp4"}
+				}
+				break
+			}
+		}
+
+		feed.Channel.Items = append(feed.Channel.Items, rss)
+	}
+
+	return feed
+}
+
+// === JSON Feed 1.1 ===
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url,omitempty"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type jsonFeedAttachment struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+}
+
+type jsonFeedItem struct {
+	ID            string               `json:"id"`
+	URL           string               `json:"url"`
+	Title         string               `json:"title"`
+	ContentHTML   string               `json:"content_html"`
+	ContentText   string               `json:"content_text"`
+	Image         string               `json:"image,omitempty"`
+	DatePublished string               `json:"date_published"`
+	Authors       []jsonFeedAuthor     `json:"authors"`
+	Attachments   []jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+func buildJSONFeed(c FeedConfig, selfURL string, items []ApprovedItem) jsonFeed {
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       feedTitle(c),
+		HomePageURL: c.Link,
+		FeedURL:     selfURL,
+		Description: c.Description,
+		Items:       []jsonFeedItem{},
+	}
+
+	for _, item := range items {
+		entry := jsonFeedItem{
+			ID:            item.TweetIDStr,
+			URL:           item.URL,
+			Title:         feedItemTitle(item),
+			ContentHTML:   feedItemHTML(item),
+			ContentText:   item.Text,
+			DatePublished: feedItemDate(item).Format(time.RFC3339),
+			Authors: []jsonFeedAuthor{
+				{Name: item.Author.ScreenName, URL: "https://twitter.com/" + item.Author.ScreenName},
+			},
+		}
+
+		for _, m := range item.Media {
+			if entry.Image == "" {
+				entry.Image = m.PosterURL
+			}
+			if m.VideoURL != "" {
+				entry.Attachments = append(entry.Attachments, jsonFeedAttachment{URL: m.VideoURL, MimeType: "video/mp4"})
+			}
+		}
+
+		feed.Items = append(feed.Items, entry)
+	}
+
+	return feed
+}
+
+// archivedSize returns the size of the archived copy of src, if archiving
+// is enabled and it has been archived
+func archivedSize(item ApprovedItem, src string) (int64, bool) {
+	if archiver == nil {
+		return 0, false
+	}
+	return archiver.ArchivedSize(item.TweetIDStr, src)
+}
+
+// addToFeed records an approved item in the feed, if it is enabled
+func addToFeed(item ApprovedItem) {
+	if feedStore == nil {
+		return
+	}
+
+	if err := feedStore.Add(item); err != nil {
+		log.Errorf("addToFeed: Unable to save feed store: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFeedStore checks that the store keeps the newest items and that
+// they survive a reload
+func TestFeedStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feed.json")
+
+	store, err := NewFeedStore(path, 2)
+	if err != nil {
+		t.Fatalf("NewFeedStore: %v", err)
+	}
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := store.Add(ApprovedItem{TweetIDStr: id}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	reloaded, err := NewFeedStore(path, 2)
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	items := reloaded.Items()
+	if len(items) != 2 || items[0].TweetIDStr != "3" || items[1].TweetIDStr != "2" {
+		t.Errorf("Unexpected items after reload: %+v", items)
+	}
+}
+
+// TestFeedHandlers requests each feed format and checks that it parses
+// and carries the item's media
+func TestFeedHandlers(t *testing.T) {
+	store, err := NewFeedStore(filepath.Join(t.TempDir(), "feed.json"), 10)
+	if err != nil {
+		t.Fatalf("NewFeedStore: %v", err)
+	}
+
+	store.Add(ApprovedItem{
+		TweetIDStr: "99",
+		URL:        "https://twitter.com/doctor_fluffy/status/99",
+		Author:     ItemAuthor{ScreenName: "doctor_fluffy"},
+		Text:       "Its anime day! <3",
+		Media: []ItemMedia{
+			{Type: "video", PosterURL: "https://pbs.twimg.com/poster.jpg", VideoURL: "https://video.twimg.com/clip.mp4"},
+		},
+	})
+
+	// The RSS enclosure needs the size of the archived video
+	defer func(a *Archiver) { archiver = a }(archiver)
+	if archiver, err = NewArchiver(ArchiveConfig{Directory: t.TempDir()}); err != nil {
+		t.Fatalf("NewArchiver: %v", err)
+	}
+	archiver.writeSidecar(ArchivedItem{
+		ApprovedItem: ApprovedItem{TweetIDStr: "99"},
+		Files:        []ArchivedFile{{Kind: "video", SourceURL: "https://video.twimg.com/clip.mp4", Size: 1234}},
+	})
+
+	mux := http.NewServeMux()
+	store.registerHandlers(mux, FeedConfig{Title: "Fluffy clips"})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %v: %v", path, err)
+		}
+		return resp
+	}
+
+	resp := get("/feed.atom")
+	var atom atomFeed
+	if err := xml.NewDecoder(resp.Body).Decode(&atom); err != nil {
+		t.Fatalf("Atom did not parse: %v", err)
+	}
+	resp.Body.Close()
+
+	if len(atom.Entries) != 1 || atom.Title != "Fluffy clips" || atom.ID != server.URL+"/feed.atom" {
+		t.Errorf("Unexpected atom feed: %+v", atom)
+	}
+	if !strings.Contains(atom.Entries[0].Content.Body, `<source src="https://video.twimg.com/clip.mp4"`) ||
+		!strings.Contains(atom.Entries[0].Content.Body, "&lt;3") {
+		t.Errorf("Atom content missing player or not escaped: %v", atom.Entries[0].Content.Body)
+	}
+
+	resp = get("/feed.rss")
+	var rss rssFeed
+	if err := xml.NewDecoder(resp.Body).Decode(&rss); err != nil {
+		t.Fatalf("RSS did not parse: %v", err)
+	}
+	resp.Body.Close()
+
+	if len(rss.Channel.Items) != 1 || rss.Channel.Items[0].Enclosure == nil ||
+		rss.Channel.Items[0].Enclosure.URL != "https://video.twimg.com/clip.mp4" || rss.Channel.Items[0].Enclosure.Length != 1234 {
+		t.Errorf("Unexpected RSS feed: %+v", rss)
+	}
+
+	resp = get("/feed.json")
+	var feed jsonFeed
+	if err := json.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		t.Fatalf("JSON feed did not parse: %v", err)
+	}
+	resp.Body.Close()
+
+	if len(feed.Items) != 1 || feed.Items[0].Image != "https://pbs.twimg.com/poster.jpg" || len(feed.Items[0].Attachments) != 1 {
+		t.Errorf("Unexpected JSON feed: %+v", feed)
+	}
+}
+
+// TestRSSEnclosureUnknownSize ensures videos that haven't been archived
+// are left out of RSS rather than sent with a length of 0
+func TestRSSEnclosureUnknownSize(t *testing.T) {
+	defer func(a *Archiver) { archiver = a }(archiver)
+
+	item := ApprovedItem{
+		TweetIDStr: "99",
+		Media:      []ItemMedia{{Type: "video", VideoURL: "https://video.twimg.com/clip.mp4"}},
+	}
+
+	archiver = nil
+	if feed := buildRSSFeed(FeedConfig{}, []ApprovedItem{item}); feed.Channel.Items[0].Enclosure != nil {
+		t.Errorf("Enclosure without archiving: %+v", feed.Channel.Items[0].Enclosure)
+	}
+
+	var err error
+	if archiver, err = NewArchiver(ArchiveConfig{Directory: t.TempDir()}); err != nil {
+		t.Fatalf("NewArchiver: %v", err)
+	}
+	if feed := buildRSSFeed(FeedConfig{}, []ApprovedItem{item}); feed.Channel.Items[0].Enclosure != nil {
+		t.Errorf("Enclosure before the video was archived: %+v", feed.Channel.Items[0].Enclosure)
+	}
+}
@@ -0,0 +1,335 @@
+// Follower graph sync. friendships/show is limited to 180 calls per 15
+// minutes, which a busy event burns through quickly. Instead, the
+// followers and friends ID lists of must_follow are paged into local sets
+// in the background (5000 IDs per call), and follow checks are answered
+// from those sets.
+package main
+
+import (
+	"encoding/json"
+	"github.com/davidk/anaconda"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFollowGraphRefreshSeconds = 3600
+
+	// The most IDs followers/ids and friends/ids return per page
+	followIDsPageSize = "5000"
+)
+
+// FollowGraphConfig configures the background follower graph sync
+type FollowGraphConfig struct {
+	Enabled        bool   `json:"enabled"`
+	RefreshSeconds int    `json:"refresh_seconds"`
+	File           string `json:"file"`
+}
+
+// GetFollowIDs wraps Anaconda's followers/friends ID listings for testing
+type GetFollowIDs interface {
+	GetFollowersIds(v url.Values) (c anaconda.Cursor, err error)
+	GetFriendsIds(v url.Values) (c anaconda.Cursor, err error)
+}
+
+// FollowIDsInfo passes control to Anaconda in production
+type FollowIDsInfo struct{}
+
+// GetFollowersIds passes to Anaconda's GetFollowersIds()
+func (fs FollowIDsInfo) GetFollowersIds(v url.Values) (c anaconda.Cursor, err error) {
+	return api.GetFollowersIds(v)
+}
+
+// GetFriendsIds passes to Anaconda's GetFriendsIds()
+func (fs FollowIDsInfo) GetFriendsIds(v url.Values) (c anaconda.Cursor, err error) {
+	return api.GetFriendsIds(v)
+}
+
+// FollowGraph holds who follows a target account (Followers) and who the
+// target follows (Friends), as of SyncedAt
+type FollowGraph struct {
+	Target string
+
+	followers map[int64]bool
+	friends   map[int64]bool
+	syncedAt  time.Time
+	sync.RWMutex
+
+	// Where an interrupted sync left off, and when the rate limit that
+	// interrupted it resets. Only used by Sync, which runs on one goroutine.
+	progress *followSyncProgress
+	resumeAt time.Time
+}
+
+// followSyncProgress is a sync in progress: the IDs fetched so far, and
+// the cursor of the next page
+type followSyncProgress struct {
+	followers     []int64
+	friends       []int64
+	followersDone bool
+	cursor        string
+}
+
+// followGraphFile is the on-disk format of a FollowGraph
+type followGraphFile struct {
+	Target    string    `json:"target"`
+	SyncedAt  time.Time `json:"synced_at"`
+	Followers []int64   `json:"followers"`
+	Friends   []int64   `json:"friends"`
+}
+
+// followGraphs is keyed on the lowercased target screen name. It is nil
+// unless follow_graph is enabled.
+var followGraphs map[string]*FollowGraph
+
+// NewFollowGraph creates an empty (never synced) graph for target
+func NewFollowGraph(target string) *FollowGraph {
+	return &FollowGraph{Target: target}
+}
+
+// followGraphFor returns the graph for target, if one is kept
+func followGraphFor(target string) *FollowGraph {
+	return followGraphs[strings.ToLower(target)]
+}
+
+// Relationship answers whether userID follows the target, and whether the
+// target follows userID. ok is false if the graph hasn't been synced yet.
+func (g *FollowGraph) Relationship(userID int64) (sourceFollows bool, targetFollows bool, ok bool) {
+	g.RLock()
+	defer g.RUnlock()
+
+	if g.syncedAt.IsZero() {
+		return false, false, false
+	}
+
+	return g.followers[userID], g.friends[userID], true
+}
+
+// SyncedAt returns the time of the last successful sync
+func (g *FollowGraph) SyncedAt() time.Time {
+	g.RLock()
+	defer g.RUnlock()
+	return g.syncedAt
+}
+
+// Sync pages through the target's followers and friends. The graph is
+// only replaced once both lists have been fetched completely. If a page
+// fails, the IDs fetched so far are kept and the next Sync resumes from
+// that page; a rate limit also holds off the next Sync until it resets.
+func (g *FollowGraph) Sync(a GetFollowIDs) error {
+	if g.progress == nil {
+		g.progress = &followSyncProgress{cursor: "-1"}
+	}
+	p := g.progress
+
+	if !p.followersDone {
+		ids, cursor, err := fetchFollowIDs(a.GetFollowersIds, g.Target, p.cursor)
+		p.followers, p.cursor = append(p.followers, ids...), cursor
+		if err != nil {
+			return g.interrupted(err)
+		}
+		p.followersDone, p.cursor = true, "-1"
+	}
+
+	ids, cursor, err := fetchFollowIDs(a.GetFriendsIds, g.Target, p.cursor)
+	p.friends, p.cursor = append(p.friends, ids...), cursor
+	if err != nil {
+		return g.interrupted(err)
+	}
+
+	g.progress = nil
+	g.set(p.followers, p.friends, time.Now().UTC())
+
+	log.Infof("FollowGraph.Sync: %v has %d followers and follows %d accounts", g.Target, len(p.followers), len(p.friends))
+
+	return nil
+}
+
+// interrupted notes a rate limit that stopped a sync, so it isn't retried
+// before the limit resets
+func (g *FollowGraph) interrupted(err error) error {
+	if nextWindow, limited := rateLimitReset(err); limited {
+		g.resumeAt = nextWindow
+		log.Warnf("FollowGraph.Sync: Syncing %v is rate-limited until %v", g.Target, nextWindow)
+	}
+	return err
+}
+
+// syncDue reports whether the graph should be synced now: it is older than
+// refresh or a sync was interrupted, and no rate limit is being waited out
+func (g *FollowGraph) syncDue(refresh time.Duration) bool {
+	if time.Now().Before(g.resumeAt) {
+		return false
+	}
+	return g.progress != nil || time.Since(g.SyncedAt()) >= refresh
+}
+
+func (g *FollowGraph) set(followers []int64, friends []int64, syncedAt time.Time) {
+	followerSet := make(map[int64]bool, len(followers))
+	for _, id := range followers {
+		followerSet[id] = true
+	}
+
+	friendSet := make(map[int64]bool, len(friends))
+	for _, id := range friends {
+		friendSet[id] = true
+	}
+
+	g.Lock()
+	g.followers, g.friends, g.syncedAt = followerSet, friendSet, syncedAt
+	g.Unlock()
+}
+
+// fetchFollowIDs pages through a followers/ids or friends/ids listing,
+// starting at cursor. On error, it returns the IDs fetched so far and the
+// cursor of the page that failed.
+func fetchFollowIDs(fetch func(url.Values) (anaconda.Cursor, error), target string, cursor string) ([]int64, string, error) {
+	var ids []int64
+
+	for cursor != "0" && cursor != "" {
+		v := url.Values{}
+		v.Set("screen_name", target)
+		v.Set("count", followIDsPageSize)
+		v.Set("cursor", cursor)
+
+		page, err := fetch(v)
+		if err != nil {
+			return ids, cursor, err
+		}
+
+		ids = append(ids, page.Ids...)
+		cursor = page.Next_cursor_str
+	}
+
+	return ids, cursor, nil
+}
+
+// loadFollowGraphs restores previously synced graphs from path into
+// graphs. Targets that are no longer configured are ignored, and a missing
+// file is not an error.
+func loadFollowGraphs(path string, graphs map[string]*FollowGraph) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var files []followGraphFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if g, ok := graphs[strings.ToLower(f.Target)]; ok {
+			g.set(f.Followers, f.Friends, f.SyncedAt)
+			log.Infof("loadFollowGraphs: Restored the follow graph of %v from %v", f.Target, f.SyncedAt)
+		}
+	}
+
+	return nil
+}
+
+// saveFollowGraphs writes every synced graph to path
+func saveFollowGraphs(path string, graphs map[string]*FollowGraph) error {
+	var files []followGraphFile
+
+	for _, g := range graphs {
+		g.RLock()
+		f := followGraphFile{Target: g.Target, SyncedAt: g.syncedAt}
+		for id := range g.followers {
+			f.Followers = append(f.Followers, id)
+		}
+		for id := range g.friends {
+			f.Friends = append(f.Friends, id)
+		}
+		g.RUnlock()
+
+		if !f.SyncedAt.IsZero() {
+			files = append(files, f)
+		}
+	}
+
+	data, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data, 0600)
+}
+
+// syncFollowGraphs syncs (or resumes syncing) every graph that is older
+// than refresh, and saves them if any changed
+func syncFollowGraphs(a GetFollowIDs, c FollowGraphConfig, graphs map[string]*FollowGraph, refresh time.Duration) {
+	synced := false
+
+	for _, g := range graphs {
+		if !g.syncDue(refresh) {
+			continue
+		}
+
+		if err := g.Sync(a); err != nil {
+			log.Errorf("syncFollowGraphs: Unable to sync the follow graph of %v, keeping the previous one until the sync resumes: %v", g.Target, err)
+			continue
+		}
+		synced = true
+	}
+
+	if synced && c.File != "" {
+		if err := saveFollowGraphs(c.File, graphs); err != nil {
+			log.Errorf("syncFollowGraphs: Unable to save follow graphs to %v: %v", c.File, err)
+		}
+	}
+}
+
+// runFollowGraphSync keeps the graphs fresh. Graphs restored from disk are
+// only re-synced once they are older than refresh_seconds.
+func runFollowGraphSync(a GetFollowIDs, c FollowGraphConfig, graphs map[string]*FollowGraph) {
+	refresh := time.Duration(c.RefreshSeconds) * time.Second
+	if refresh <= 0 {
+		refresh = defaultFollowGraphRefreshSeconds * time.Second
+	}
+
+	// Check more often than the refresh, so a failed sync is retried
+	// without waiting for a whole refresh period
+	tick := refresh / 4
+	if tick < time.Minute {
+		tick = time.Minute
+	}
+
+	syncFollowGraphs(a, c, graphs, refresh)
+
+	for range time.Tick(tick) {
+		syncFollowGraphs(a, c, graphs, refresh)
+	}
+}
+
+// followGraphCollector exports the age of each follow graph
+type followGraphCollector struct{}
+
+var followGraphAgeDesc = prometheus.NewDesc(
+	"follow_graph_age_seconds",
+	"Seconds since the follow graph of a must_follow target was last synced.",
+	[]string{"target"}, nil,
+)
+
+// Describe implements prometheus.Collector
+func (followGraphCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- followGraphAgeDesc
+}
+
+// Collect implements prometheus.Collector. Graphs that have never synced
+// are left out.
+func (followGraphCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, g := range followGraphs {
+		if syncedAt := g.SyncedAt(); !syncedAt.IsZero() {
+			ch <- prometheus.MustNewConstMetric(followGraphAgeDesc, prometheus.GaugeValue, time.Since(syncedAt).Seconds(), g.Target)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"github.com/davidk/anaconda"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// FakeFollowIDs serves follower/friend IDs two to a page
+type FakeFollowIDs struct {
+	Followers []int64
+	Friends   []int64
+	Err       error
+}
+
+func fakeIDPage(ids []int64, v url.Values) anaconda.Cursor {
+	start := 0
+	if v.Get("cursor") != "-1" {
+		start = len(ids) / 2
+	}
+
+	end := start + 2
+	if end >= len(ids) {
+		return anaconda.Cursor{Ids: ids[start:], Next_cursor_str: "0"}
+	}
+
+	return anaconda.Cursor{Ids: ids[start:end], Next_cursor_str: "2"}
+}
+
+func (f FakeFollowIDs) GetFollowersIds(v url.Values) (anaconda.Cursor, error) {
+	return fakeIDPage(f.Followers, v), nil
+}
+
+func (f FakeFollowIDs) GetFriendsIds(v url.Values) (anaconda.Cursor, error) {
+	if f.Err != nil {
+		return anaconda.Cursor{}, f.Err
+	}
+	return fakeIDPage(f.Friends, v), nil
+}
+
+func TestFollowGraphSync(t *testing.T) {
+
+	g := NewFollowGraph("target")
+
+	if _, _, ok := g.Relationship(1); ok {
+		t.Error("An unsynced graph claimed to know a relationship")
+	}
+
+	if err := g.Sync(FakeFollowIDs{Followers: []int64{1, 2, 3, 4}, Friends: []int64{2, 5}}); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	var tests = []struct {
+		User          int64
+		SourceFollows bool
+		TargetFollows bool
+	}{
+		{1, true, false},
+		{2, true, true},
+		{4, true, false}, // second page
+		{5, false, true},
+		{6, false, false},
+	}
+
+	for _, test := range tests {
+		source, target, ok := g.Relationship(test.User)
+		if !ok || source != test.SourceFollows || target != test.TargetFollows {
+			t.Errorf("Relationship(%v): wanted (%v, %v), got (%v, %v, ok: %v)", test.User, test.SourceFollows, test.TargetFollows, source, target, ok)
+		}
+	}
+
+	// A failed sync keeps the previous graph
+	if err := g.Sync(FakeFollowIDs{Followers: []int64{9}, Err: errors.New("Rate limit exceeded")}); err == nil {
+		t.Error("Sync should have failed")
+	}
+
+	if source, _, _ := g.Relationship(1); !source {
+		t.Error("A failed sync replaced the graph")
+	}
+}
+
+// FakeLimitedFollowIDs serves follower IDs one to a page, failing once at
+// the page FailAt with Err
+type FakeLimitedFollowIDs struct {
+	Followers []int64
+	FailAt    string
+	Err       error
+	Requested []string
+}
+
+func (f *FakeLimitedFollowIDs) GetFollowersIds(v url.Values) (anaconda.Cursor, error) {
+	cursor := v.Get("cursor")
+	f.Requested = append(f.Requested, cursor)
+
+	if cursor == f.FailAt && f.Err != nil {
+		err := f.Err
+		f.Err = nil
+		return anaconda.Cursor{}, err
+	}
+
+	i := 0
+	if cursor != "-1" {
+		i, _ = strconv.Atoi(cursor)
+	}
+
+	next := strconv.Itoa(i + 1)
+	if i+1 >= len(f.Followers) {
+		next = "0"
+	}
+
+	return anaconda.Cursor{Ids: f.Followers[i : i+1], Next_cursor_str: next}, nil
+}
+
+func (f *FakeLimitedFollowIDs) GetFriendsIds(v url.Values) (anaconda.Cursor, error) {
+	return anaconda.Cursor{Next_cursor_str: "0"}, nil
+}
+
+// TestFollowGraphSyncResumes checks that a rate-limited sync waits for the
+// limit to reset, then carries on from the page it stopped at
+func TestFollowGraphSyncResumes(t *testing.T) {
+
+	reset := time.Now().Add(10 * time.Minute)
+	limited := &anaconda.ApiError{
+		StatusCode: 429,
+		Header:     http.Header{"X-Rate-Limit-Reset": []string{strconv.FormatInt(reset.Unix(), 10)}},
+	}
+
+	a := &FakeLimitedFollowIDs{Followers: []int64{1, 2, 3, 4}, FailAt: "2", Err: limited}
+	g := NewFollowGraph("target")
+	graphs := map[string]*FollowGraph{"target": g}
+
+	syncFollowGraphs(a, FollowGraphConfig{}, graphs, time.Hour)
+
+	if _, _, ok := g.Relationship(1); ok {
+		t.Error("A partial sync was used")
+	}
+	if !g.resumeAt.Equal(time.Unix(reset.Unix(), 0)) {
+		t.Errorf("Expected the sync to wait until %v, got %v", reset, g.resumeAt)
+	}
+
+	// Nothing is requested while the limit is in force
+	syncFollowGraphs(a, FollowGraphConfig{}, graphs, time.Hour)
+	if len(a.Requested) != 3 {
+		t.Errorf("Synced during the rate limit: %v", a.Requested)
+	}
+
+	g.resumeAt = time.Now().Add(-time.Second)
+	syncFollowGraphs(a, FollowGraphConfig{}, graphs, time.Hour)
+
+	if want := []string{"-1", "1", "2", "2", "3"}; strings.Join(a.Requested, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected pages %v, got %v", want, a.Requested)
+	}
+
+	for _, id := range []int64{1, 2, 3, 4} {
+		if source, _, ok := g.Relationship(id); !ok || !source {
+			t.Errorf("Follower %v is missing after the resumed sync", id)
+		}
+	}
+
+	if g.syncDue(time.Hour) {
+		t.Error("A finished sync is still due")
+	}
+}
+
+func TestFollowGraphPersistence(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "follow_graph.json")
+
+	g := NewFollowGraph("Target")
+	g.set([]int64{1, 2}, []int64{2}, time.Now().Add(-time.Minute))
+
+	if err := saveFollowGraphs(path, map[string]*FollowGraph{"target": g, "never": NewFollowGraph("never")}); err != nil {
+		t.Fatalf("saveFollowGraphs: %v", err)
+	}
+
+	restored := map[string]*FollowGraph{"target": NewFollowGraph("Target")}
+	if err := loadFollowGraphs(path, restored); err != nil {
+		t.Fatalf("loadFollowGraphs: %v", err)
+	}
+
+	if source, target, ok := restored["target"].Relationship(2); !ok || !source || !target {
+		t.Errorf("Restored graph lost user 2 (%v, %v, ok: %v)", source, target, ok)
+	}
+
+	if age := time.Since(restored["target"].SyncedAt()); age < time.Minute || age > time.Hour {
+		t.Errorf("Restored graph has the wrong age: %v", age)
+	}
+
+	if err := loadFollowGraphs(path+".missing", restored); err != nil {
+		t.Errorf("Missing follow graph file returned an error: %v", err)
+	}
+}
+
+func TestCheckUserFollowingGraph(t *testing.T) {
+
+	saved, savedMutual := followGraphs, config.Settings.MutualFollow
+	defer func() { followGraphs, config.Settings.MutualFollow = saved, savedMutual }()
+
+	g := NewFollowGraph("graphTarget")
+	g.set([]int64{100, 200}, []int64{200}, time.Now())
+	followGraphs = map[string]*FollowGraph{"graphtarget": g}
+
+	// The graph's yes is final. Its no is checked with the (fake) API, since
+	// the user may have followed since the last sync.
+	tweet := func(id int64, screenName string) anaconda.Tweet {
+		return anaconda.Tweet{User: anaconda.User{Id: id, ScreenName: screenName}}
+	}
+
+	var tests = []struct {
+		User       int64
+		ScreenName string
+		Mutual     bool
+		Output     bool
+	}{
+		{100, "noSourceTargetFollow", false, true},
+		{100, "noSourceTargetFollow", true, false},
+		{200, "noSourceTargetFollow", true, true},
+		{300, "noSourceTargetFollow", false, false},
+		{400, "bothFollow", true, true},
+	}
+
+	for _, test := range tests {
+		config.Settings.MutualFollow = test.Mutual
+		if result := checkUserFollowing(FakeFriendshipInfo{}, tweet(test.User, test.ScreenName), "graphTarget"); result != test.Output {
+			t.Errorf("User %v (mutual: %v): wanted %v, got %v", test.User, test.Mutual, test.Output, result)
+		}
+	}
+
+	// Without the API, the graph's no is unknown rather than final
+	status := tweet(500, "followedSinceTheSync")
+	if result := checkFollowTarget(FakeFriendshipInfo{Err: errors.New("Over capacity")}, status, FollowTarget{ScreenName: "graphTarget"}); result != followUnknown {
+		t.Errorf("Expected followUnknown for a user the graph doesn't know, got %v", result)
+	}
+
+	if n := testutil.CollectAndCount(followGraphCollector{}); n != 1 {
+		t.Errorf("Expected one follow graph age metric, got %d", n)
+	}
+}
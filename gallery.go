@@ -0,0 +1,361 @@
+// Static HTML gallery of the media archive. `chim gallery` renders the
+// archived items into a self-contained site (pages by date, a page per
+// contributor and an index with counts) that can be published anywhere.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultGalleryPerPage = 24
+
+// GalleryOptions controls how the gallery is rendered
+type GalleryOptions struct {
+	ArchiveDir string
+	OutputDir  string
+	PerPage    int
+	Title      string
+}
+
+// galleryClip is a single playable/viewable piece of media
+type galleryClip struct {
+	Video  string
+	Poster string
+	Loop   bool // gifs autoplay and loop without controls
+}
+
+// galleryItem is an archived item prepared for the templates
+type galleryItem struct {
+	ArchivedItem
+	Date  time.Time
+	Clips []galleryClip
+}
+
+// galleryContributor is a row on the index page
+type galleryContributor struct {
+	ScreenName string
+	Page       string
+	Count      int
+}
+
+// galleryPage is what every template is rendered with
+type galleryPage struct {
+	Title        string
+	Heading      string
+	Items        []galleryItem
+	Page         int
+	Pages        int
+	PrevPage     string
+	NextPage     string
+	Total        int
+	Counts       map[string]int
+	Contributors []galleryContributor
+	Generated    time.Time
+}
+
+var galleryTemplates = template.Must(template.New("gallery").Funcs(template.FuncMap{
+	"day":             func(t time.Time) string { return t.Format("2006-01-02") },
+	"contributorPage": contributorPage,
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Heading}} — {{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 0 auto; padding: 1em; background: #fafafa; color: #222; }
+nav a { margin-right: 1em; }
+.day { border-bottom: 1px solid #ccc; margin-top: 2em; }
+.item { background: #fff; border: 1px solid #ddd; border-radius: 4px; padding: 1em; margin: 1em 0; }
+.item video, .item img { max-width: 100%; display: block; margin: 0.5em 0; }
+.meta { color: #666; font-size: 0.9em; }
+table td { padding: 0.2em 1em 0.2em 0; }
+</style>
+</head>
+<body>
+<nav><a href="index.html">{{.Title}}</a><a href="page-1.html">Latest</a></nav>
+<h1>{{.Heading}}</h1>
+{{end}}
+
+{{define "footer"}}<p class="meta">Generated {{.Generated.Format "2006-01-02 15:04 MST"}}</p>
+</body>
+</html>
+{{end}}
+
+{{define "items"}}{{$day := ""}}{{range .Items}}{{if ne (day .Date) $day}}{{$day = day .Date}}<h2 class="day">{{$day}}</h2>{{end}}
+<div class="item">
+{{range .Clips}}{{if .Video}}{{if .Loop}}<video autoplay loop muted playsinline{{if .Poster}} poster="{{.Poster}}"{{end}}><source src="{{.Video}}" type="video/mp4"></video>
+{{else}}<video controls preload="none"{{if .Poster}} poster="{{.Poster}}"{{end}}><source src="{{.Video}}" type="video/mp4"></video>
+{{end}}{{else if .Poster}}<img src="{{.Poster}}" alt="" loading="lazy">
+{{end}}{{end}}<p>{{.Text}}</p>
+<p class="meta"><a href="{{contributorPage .Author.ID}}">@{{.Author.ScreenName}}</a> · {{.Date.Format "15:04 MST"}} · <a href="{{.URL}}">original tweet</a></p>
+</div>
+{{end}}{{end}}
+
+{{define "pager"}}<p>{{if .PrevPage}}<a href="{{.PrevPage}}">← newer</a> {{end}}page {{.Page}} of {{.Pages}}{{if .NextPage}} <a href="{{.NextPage}}">older →</a>{{end}}</p>{{end}}
+
+{{define "page"}}{{template "header" .}}{{template "pager" .}}{{template "items" .}}{{template "pager" .}}{{template "footer" .}}{{end}}
+
+{{define "contributor"}}{{template "header" .}}<p>{{len .Items}} items</p>{{template "items" .}}{{template "footer" .}}{{end}}
+
+{{define "index"}}{{template "header" .}}
+<p>{{.Total}} items from {{len .Contributors}} contributors, across {{.Pages}} pages.</p>
+<table>
+{{range $type, $count := .Counts}}<tr><td>{{$type}}</td><td>{{$count}}</td></tr>
+{{end}}</table>
+<h2>Contributors</h2>
+<table>
+{{range .Contributors}}<tr><td><a href="{{.Page}}">@{{.ScreenName}}</a></td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{template "footer" .}}{{end}}
+`))
+
+// runGallery is the `gallery` sub-command
+func runGallery(args []string) error {
+	opts := GalleryOptions{}
+
+	fs := flag.NewFlagSet("gallery", flag.ContinueOnError)
+	fs.StringVar(&opts.ArchiveDir, "archive", config.Archive.Directory, "Archive directory to render (defaults to archive.directory)")
+	fs.StringVar(&opts.OutputDir, "o", "./gallery", "Directory to write the site to")
+	fs.IntVar(&opts.PerPage, "per-page", defaultGalleryPerPage, "Items per page")
+	fs.StringVar(&opts.Title, "title", "chim archive", "Site title")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return buildGallery(opts)
+}
+
+// contributorPage is the file name of a contributor's page. Pages are
+// named by user ID, which (unlike the screen name) never changes.
+func contributorPage(id int64) string {
+	return "contributor-" + strconv.FormatInt(id, 10) + ".html"
+}
+
+// loadArchivedItems reads every sidecar in the archive, newest first
+func loadArchivedItems(archiveDir string) ([]ArchivedItem, error) {
+	paths, err := filepath.Glob(filepath.Join(archiveDir, "items", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var items []ArchivedItem
+
+	for _, p := range paths {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+
+		var item ArchivedItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			log.Warnf("loadArchivedItems: Skipping unreadable sidecar %v: %v", p, err)
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return feedItemDate(items[i].ApprovedItem).After(feedItemDate(items[j].ApprovedItem))
+	})
+
+	return items, nil
+}
+
+// newGalleryItem pairs up each media entry's archived video and poster.
+// Media that never made it into the archive falls back to Twitter's URLs.
+func newGalleryItem(item ArchivedItem) galleryItem {
+	g := galleryItem{ArchivedItem: item, Date: feedItemDate(item.ApprovedItem)}
+
+	for _, m := range item.Media {
+		clip := galleryClip{Video: m.VideoURL, Poster: m.PosterURL, Loop: m.Type == "animated_gif"}
+
+		for _, f := range item.Files {
+			if f.MediaID != m.ID {
+				continue
+			}
+			switch f.Kind {
+			case "video":
+				clip.Video = f.Path
+			case "poster":
+				clip.Poster = f.Path
+			}
+		}
+
+		g.Clips = append(g.Clips, clip)
+	}
+
+	return g
+}
+
+// buildGallery renders the site into opts.OutputDir
+func buildGallery(opts GalleryOptions) error {
+	if opts.ArchiveDir == "" {
+		return errors.New("no archive directory given (set archive.directory or -archive)")
+	}
+
+	if opts.PerPage <= 0 {
+		opts.PerPage = defaultGalleryPerPage
+	}
+
+	archived, err := loadArchivedItems(opts.ArchiveDir)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(opts.OutputDir, "media"), 0755); err != nil {
+		return err
+	}
+
+	base := galleryPage{
+		Title:     opts.Title,
+		Total:     len(archived),
+		Counts:    make(map[string]int),
+		Generated: time.Now().UTC(),
+	}
+
+	var items []galleryItem
+	byContributor := make(map[int64][]galleryItem)
+
+	// Contributors are listed under their newest screen name
+	screenNames := make(map[int64]string)
+
+	for _, a := range archived {
+		for _, f := range a.Files {
+			if err := copyArchivedFile(opts.ArchiveDir, opts.OutputDir, f.Path); err != nil {
+				return err
+			}
+		}
+
+		item := newGalleryItem(a)
+		items = append(items, item)
+		base.Counts[a.ContentType]++
+
+		id := a.Author.ID
+		byContributor[id] = append(byContributor[id], item)
+		if _, ok := screenNames[id]; !ok {
+			screenNames[id] = a.Author.ScreenName
+		}
+	}
+
+	base.Pages = (len(items) + opts.PerPage - 1) / opts.PerPage
+	if base.Pages == 0 {
+		base.Pages = 1
+	}
+
+	for page := 1; page <= base.Pages; page++ {
+		p := base
+		p.Heading = fmt.Sprintf("Page %d", page)
+		p.Page = page
+
+		start := (page - 1) * opts.PerPage
+		end := start + opts.PerPage
+		if end > len(items) {
+			end = len(items)
+		}
+		p.Items = items[start:end]
+
+		if page > 1 {
+			p.PrevPage = fmt.Sprintf("page-%d.html", page-1)
+		}
+		if page < base.Pages {
+			p.NextPage = fmt.Sprintf("page-%d.html", page+1)
+		}
+
+		if err := renderGalleryPage(opts.OutputDir, fmt.Sprintf("page-%d.html", page), "page", p); err != nil {
+			return err
+		}
+	}
+
+	for id, contributed := range byContributor {
+		p := base
+		p.Heading = "@" + screenNames[id]
+		p.Items = contributed
+
+		if err := renderGalleryPage(opts.OutputDir, contributorPage(id), "contributor", p); err != nil {
+			return err
+		}
+
+		base.Contributors = append(base.Contributors, galleryContributor{ScreenName: screenNames[id], Page: contributorPage(id), Count: len(contributed)})
+	}
+
+	sort.Slice(base.Contributors, func(i, j int) bool {
+		if base.Contributors[i].Count != base.Contributors[j].Count {
+			return base.Contributors[i].Count > base.Contributors[j].Count
+		}
+		return base.Contributors[i].ScreenName < base.Contributors[j].ScreenName
+	})
+
+	index := base
+	index.Heading = "Archive"
+
+	if err := renderGalleryPage(opts.OutputDir, "index.html", "index", index); err != nil {
+		return err
+	}
+
+	log.Infof("buildGallery: Rendered %d items from %d contributors into %v", len(items), len(byContributor), opts.OutputDir)
+
+	return nil
+}
+
+// renderGalleryPage executes a named template into outputDir/name
+func renderGalleryPage(outputDir string, name string, tmpl string, page galleryPage) error {
+	var b strings.Builder
+
+	if err := galleryTemplates.ExecuteTemplate(&b, tmpl, page); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(outputDir, name), []byte(b.String()), 0644)
+}
+
+// copyArchivedFile brings a media file into the site. Files are content
+// addressed, so one that already exists is left alone. A hard link is
+// tried first to avoid doubling the disk usage.
+func copyArchivedFile(archiveDir string, outputDir string, rel string) error {
+	src := filepath.Join(archiveDir, filepath.FromSlash(rel))
+	dest := filepath.Join(outputDir, filepath.FromSlash(rel))
+
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestSidecar drops an archived item (and its media) into dir
+func writeTestSidecar(t *testing.T, dir string, item ArchivedItem) {
+	for _, sub := range []string{"items", "media"} {
+		os.MkdirAll(filepath.Join(dir, sub), 0755)
+	}
+
+	for _, f := range item.Files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.Path), []byte(f.SHA256), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, _ := json.Marshal(item)
+	if err := ioutil.WriteFile(filepath.Join(dir, "items", item.TweetIDStr+".json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBuildGallery renders a small archive and checks the pages, players
+// and copied media
+func TestBuildGallery(t *testing.T) {
+	archiveDir := t.TempDir()
+	outputDir := t.TempDir()
+
+	day := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+
+	writeTestSidecar(t, archiveDir, ArchivedItem{
+		ApprovedItem: ApprovedItem{
+			TweetIDStr:  "1",
+			URL:         "https://twitter.com/doctor_fluffy/status/1",
+			Author:      ItemAuthor{ID: 7, ScreenName: "old_fluffy"},
+			Text:        "Its anime day! <b>",
+			ContentType: "video",
+			CreatedAt:   day,
+			Media:       []ItemMedia{{ID: "10", Type: "video", VideoURL: "https://video.twimg.com/1.mp4"}},
+		},
+		Files: []ArchivedFile{
+			{MediaID: "10", Kind: "video", SHA256: "aaaa", Path: "media/aaaa.mp4"},
+			{MediaID: "10", Kind: "poster", SHA256: "bbbb", Path: "media/bbbb.jpg"},
+		},
+	})
+
+	writeTestSidecar(t, archiveDir, ArchivedItem{
+		ApprovedItem: ApprovedItem{
+			TweetIDStr:  "2",
+			Author:      ItemAuthor{ID: 8, ScreenName: "Fluffy"},
+			Text:        "gif time",
+			ContentType: "gif",
+			CreatedAt:   day.Add(24 * time.Hour),
+			Media:       []ItemMedia{{ID: "20", Type: "animated_gif", PosterURL: "https://pbs.twimg.com/2.jpg", VideoURL: "https://video.twimg.com/2.mp4"}},
+		},
+	})
+
+	writeTestSidecar(t, archiveDir, ArchivedItem{
+		ApprovedItem: ApprovedItem{
+			TweetIDStr:  "3",
+			Author:      ItemAuthor{ID: 7, ScreenName: "doctor_fluffy"},
+			Text:        "more",
+			ContentType: "video",
+			CreatedAt:   day.Add(48 * time.Hour),
+		},
+	})
+
+	if err := buildGallery(GalleryOptions{ArchiveDir: archiveDir, OutputDir: outputDir, PerPage: 2, Title: "Test"}); err != nil {
+		t.Fatalf("buildGallery: %v", err)
+	}
+
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(outputDir, name))
+		if err != nil {
+			t.Fatalf("Missing %v: %v", name, err)
+		}
+		return string(data)
+	}
+
+	index := read("index.html")
+	if !strings.Contains(index, "3 items from 2 contributors, across 2 pages") {
+		t.Errorf("Index is missing counts:\n%v", index)
+	}
+	if !strings.Contains(index, `href="contributor-7.html">@doctor_fluffy</a>`) {
+		t.Error("Index does not link contributor pages")
+	}
+
+	// Newest first: page 1 has items 3 and 2, page 2 has item 1
+	page1 := read("page-1.html")
+	if !strings.Contains(page1, "2018-07-06") || !strings.Contains(page1, "autoplay loop") || !strings.Contains(page1, `href="page-2.html"`) {
+		t.Errorf("Unexpected first page:\n%v", page1)
+	}
+
+	page2 := read("page-2.html")
+	if !strings.Contains(page2, `<video controls preload="none" poster="media/bbbb.jpg"><source src="media/aaaa.mp4"`) {
+		t.Errorf("Second page does not use the archived media:\n%v", page2)
+	}
+	if strings.Contains(page2, "<b>") {
+		t.Error("Tweet text was not escaped")
+	}
+
+	// doctor_fluffy was renamed from old_fluffy; both tweets are on one page
+	if !strings.Contains(read("contributor-7.html"), "2 items") {
+		t.Error("Contributor page has the wrong count")
+	}
+
+	if read("media/aaaa.mp4") != "aaaa" {
+		t.Error("Archived media was not copied into the site")
+	}
+}
@@ -0,0 +1,143 @@
+// Local language detection, for tweets Twitter didn't tag with a language.
+// Scripts used by a single language give it away; Latin and Cyrillic text
+// is told apart by common short words. Text that is too short or too mixed
+// is left undetermined.
+package main
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Number of common words a Latin or Cyrillic text needs before its
+// language is trusted
+const minLangWordHits = 2
+
+// URLs, mentions and hashtags say little about the language of a tweet
+var langNoise = regexp.MustCompile(`https?://\S+|[@#]\w+`)
+
+// Scripts that (nearly) identify a language on their own
+var scriptLangs = []struct {
+	table *unicode.RangeTable
+	lang  string
+}{
+	{unicode.Hangul, "ko"},
+	{unicode.Thai, "th"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Greek, "el"},
+	{unicode.Devanagari, "hi"},
+	{unicode.Georgian, "ka"},
+	{unicode.Armenian, "hy"},
+}
+
+// Common short words of languages written in Latin or Cyrillic script
+var commonWords = map[string][]string{
+	"en": {"the", "and", "is", "are", "this", "that", "with", "for", "you", "of", "to", "it", "was", "have", "what", "my", "not", "just"},
+	"es": {"el", "los", "las", "que", "y", "es", "por", "con", "para", "una", "está", "pero", "muy", "del", "lo", "como"},
+	"pt": {"os", "não", "é", "com", "para", "uma", "você", "mas", "muito", "isso", "está", "do", "da", "em", "que"},
+	"fr": {"le", "la", "les", "et", "est", "une", "des", "pour", "pas", "je", "avec", "dans", "qui", "du", "ce"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ich", "mit", "ein", "eine", "auf", "zu", "sie", "auch"},
+	"it": {"il", "che", "è", "di", "non", "per", "sono", "questo", "della", "con", "ma", "gli", "anche"},
+	"nl": {"het", "een", "en", "is", "niet", "van", "ik", "dat", "op", "met", "zijn", "ook", "je"},
+	"id": {"yang", "dan", "ini", "itu", "tidak", "aku", "saya", "ada", "dengan", "untuk", "juga", "sudah"},
+	"tr": {"bir", "ve", "bu", "çok", "için", "ne", "ile", "gibi", "değil", "ben", "sen"},
+	"ru": {"и", "в", "не", "на", "что", "это", "я", "с", "как", "но", "он", "по", "так"},
+	"uk": {"і", "та", "не", "на", "що", "це", "я", "з", "як", "але", "він", "по", "дуже"},
+}
+
+// Words to the languages they are common in, built from commonWords
+var commonWordLangs = func() map[string][]string {
+	langs := make(map[string][]string)
+	for lang, words := range commonWords {
+		for _, w := range words {
+			langs[w] = append(langs[w], lang)
+		}
+	}
+	return langs
+}()
+
+// detectLanguage guesses the language of text, returning a Twitter style
+// tag, or "und" if it can't tell
+func detectLanguage(text string) string {
+	text = langNoise.ReplaceAllString(text, " ")
+
+	var letters, kana, han int
+	scripts := make(map[string]int)
+
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Han, r):
+			han++
+		default:
+			for _, s := range scriptLangs {
+				if unicode.Is(s.table, r) {
+					scripts[s.lang]++
+					break
+				}
+			}
+		}
+	}
+
+	if letters == 0 {
+		return "und"
+	}
+
+	// Japanese mixes kana with kanji; Chinese has no kana
+	if kana+han > letters/2 {
+		if kana > 0 {
+			return "ja"
+		}
+		return "zh"
+	}
+
+	for lang, n := range scripts {
+		if n > letters/2 {
+			return lang
+		}
+	}
+
+	return detectByWords(text)
+}
+
+// detectByWords picks the language with the most common words in text.
+// Ties and texts with too few common words are undetermined.
+func detectByWords(text string) string {
+	hits := make(map[string]int)
+
+	for _, token := range textTokens(norm.NFC.String(strings.ToLower(text))) {
+		for _, lang := range commonWordLangs[token] {
+			hits[lang]++
+		}
+	}
+
+	best, bestHits, tied := "und", 0, false
+	for lang, n := range hits {
+		switch {
+		case n > bestHits:
+			best, bestHits, tied = lang, n, false
+		case n == bestHits:
+			tied = true
+		}
+	}
+
+	if bestHits < minLangWordHits || tied {
+		return "und"
+	}
+
+	// Ukrainian has letters Russian lacks
+	if best == "ru" && strings.ContainsAny(text, "іїєґІЇЄҐ") {
+		return "uk"
+	}
+
+	return best
+}
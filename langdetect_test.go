@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestDetectLanguage(t *testing.T) {
+	var tests = []struct {
+		Text   string
+		Output string
+	}{
+		{"This is the best clip of the match, you have to see it", "en"},
+		{"今日のハイライトを見てください", "ja"},
+		{"今天的比赛非常精彩", "zh"},
+		{"오늘 경기 하이라이트", "ko"},
+		{"Este es el mejor gol de la temporada, pero no es para todos", "es"},
+		{"Isso não é para você, mas é muito bom", "pt"},
+		{"Das ist nicht mein Tor, aber ich mag es und die Fans auch", "de"},
+		{"C'est le meilleur but de la saison et je suis pour", "fr"},
+		{"Это не то, что я думал, но так и есть", "ru"},
+		{"Це дуже гарний гол, і я радий що він є", "uk"},
+		{"Καλημέρα σε όλους", "el"},
+		{"@someone https://t.co/abc #goal", "und"},
+		{"GOAL!!! 🔥🔥", "und"},
+		{"", "und"},
+	}
+
+	for _, test := range tests {
+		if result := detectLanguage(test.Text); result != test.Output {
+			t.Errorf("detectLanguage(%q): got %q, want %q", test.Text, result, test.Output)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Language and region filters. The streaming API matches track terms in
+// any language, so tweets can be limited to the languages a community
+// reads (by Twitter's lang tag, or by detecting it from the text when the
+// tag is missing) and to the countries of their place.
+package main
+
+import (
+	"fmt"
+	"github.com/davidk/anaconda"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// What to do with tweets whose language can't be told
+const (
+	undeterminedAllow = "allow"
+	undeterminedDeny  = "deny"
+)
+
+// LanguageConfig limits the languages of tweets. Languages are Twitter's
+// tags (BCP 47, e.g. "en", "ja"); "zh" also covers "zh-tw".
+type LanguageConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	// Detect the language from the text when Twitter's tag is missing or
+	// undetermined
+	Detect bool `json:"detect"`
+
+	// What to do when the language is still undetermined: allow (default)
+	// or deny
+	Undetermined string `json:"undetermined"`
+}
+
+// CountryConfig limits the countries of a tweet's place, by ISO 3166
+// country code. Tweets without a place pass unless DenyUnknown is set.
+type CountryConfig struct {
+	Allow       []string `json:"allow"`
+	Deny        []string `json:"deny"`
+	DenyUnknown bool     `json:"deny_unknown"`
+}
+
+// Twitter's tags for tweets without a language it can tell: undetermined,
+// no linguistic content, and media links, hashtags, mentions, cashtags or
+// short text only
+var undeterminedLangs = map[string]bool{
+	"": true, "und": true, "zxx": true, "qme": true, "qht": true, "qam": true, "qct": true, "qst": true,
+}
+
+// Legacy codes Twitter still sends, and the codes they stand for
+var legacyLangs = map[string]string{
+	"in": "id",
+	"iw": "he",
+}
+
+// enabled reports whether any language filtering is configured
+func (c LanguageConfig) enabled() bool {
+	return len(c.Allow) > 0 || len(c.Deny) > 0 || c.Undetermined == undeterminedDeny
+}
+
+// enabled reports whether any country filtering is configured
+func (c CountryConfig) enabled() bool {
+	return len(c.Allow) > 0 || len(c.Deny) > 0 || c.DenyUnknown
+}
+
+// normalizeLang lowercases a language tag and maps legacy codes
+func normalizeLang(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+
+	base, region := tag, ""
+	if i := strings.Index(tag, "-"); i >= 0 {
+		base, region = tag[:i], tag[i:]
+	}
+
+	if code, ok := legacyLangs[base]; ok {
+		return code + region
+	}
+
+	return tag
+}
+
+// langMatches reports whether tag is one of langs, or a regional variant
+// of one
+func langMatches(tag string, langs []string) bool {
+	for _, l := range langs {
+		l = normalizeLang(l)
+		if tag == l || strings.HasPrefix(tag, l+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLanguage checks the language of a tweet against c. Returns a
+// rejection label (language, languageDetected or languageUndetermined) and
+// the reason if it isn't wanted.
+func checkLanguage(status anaconda.Tweet, c LanguageConfig) (bool, string, string) {
+	lang := normalizeLang(status.Lang)
+	label := "language"
+
+	if undeterminedLangs[lang] && c.Detect {
+		lang = detectLanguage(tweetFullText(status))
+		label = "languageDetected"
+		log.Debugf("checkLanguage: Twitter tagged %v as %q, detected %q", status.IdStr, status.Lang, lang)
+	}
+
+	if undeterminedLangs[lang] {
+		if c.Undetermined == undeterminedDeny {
+			reason := fmt.Sprintf("language of the tweet is undetermined (lang: %q)", status.Lang)
+			log.Infof("checkLanguage: REJECT - The %v", reason)
+			return false, "languageUndetermined", reason
+		}
+
+		log.Println("checkLanguage: OK (undetermined)")
+		return true, "", ""
+	}
+
+	if len(c.Allow) > 0 && !langMatches(lang, c.Allow) {
+		reason := fmt.Sprintf("language %v is not allowed", lang)
+		log.Infof("checkLanguage: REJECT - The %v", reason)
+		return false, label, reason
+	}
+
+	if langMatches(lang, c.Deny) {
+		reason := fmt.Sprintf("language %v is denied", lang)
+		log.Infof("checkLanguage: REJECT - The %v", reason)
+		return false, label, reason
+	}
+
+	log.Println("checkLanguage: OK")
+	return true, "", ""
+}
+
+// countryMatches reports whether code is one of countries
+func countryMatches(code string, countries []string) bool {
+	for _, c := range countries {
+		if strings.EqualFold(code, strings.TrimSpace(c)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPlaceCountry checks the country of a tweet's place against c.
+// Returns the reason if it isn't wanted.
+func checkPlaceCountry(status anaconda.Tweet, c CountryConfig) (bool, string) {
+	code := strings.ToUpper(status.Place.CountryCode)
+
+	if code == "" {
+		if c.DenyUnknown {
+			log.Info("checkPlaceCountry: REJECT - The tweet has no place")
+			return false, "tweet has no place"
+		}
+
+		log.Println("checkPlaceCountry: OK (no place)")
+		return true, ""
+	}
+
+	if len(c.Allow) > 0 && !countryMatches(code, c.Allow) {
+		reason := fmt.Sprintf("place country %v is not allowed", code)
+		log.Infof("checkPlaceCountry: REJECT - The %v", reason)
+		return false, reason
+	}
+
+	if countryMatches(code, c.Deny) {
+		reason := fmt.Sprintf("place country %v is denied", code)
+		log.Infof("checkPlaceCountry: REJECT - The %v", reason)
+		return false, reason
+	}
+
+	log.Println("checkPlaceCountry: OK")
+	return true, ""
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/davidk/anaconda"
+	"testing"
+)
+
+func TestCheckLanguage(t *testing.T) {
+	allow := LanguageConfig{Allow: []string{"en", "JA"}}
+	deny := LanguageConfig{Deny: []string{"zh", "in"}}
+	detect := LanguageConfig{Allow: []string{"en", "ja"}, Detect: true, Undetermined: undeterminedDeny}
+
+	var tests = []struct {
+		Explain string
+		Config  LanguageConfig
+		Status  anaconda.Tweet
+		Output  bool
+		Label   string
+	}{
+		{"Allowed", allow, anaconda.Tweet{Lang: "en"}, true, ""},
+		{"Allowed, case and region", allow, anaconda.Tweet{Lang: "ja-JP"}, true, ""},
+		{"Not allowed", allow, anaconda.Tweet{Lang: "es"}, false, "language"},
+		{"Undetermined passes by default", allow, anaconda.Tweet{Lang: "und"}, true, ""},
+		{"Hashtags only passes by default", allow, anaconda.Tweet{Lang: "qht"}, true, ""},
+		{"Denied regional variant", deny, anaconda.Tweet{Lang: "zh-tw"}, false, "language"},
+		{"Denied legacy code", deny, anaconda.Tweet{Lang: "id"}, false, "language"},
+		{"Not denied", deny, anaconda.Tweet{Lang: "fr"}, true, ""},
+		{"Twitter's tag wins over detection", detect, anaconda.Tweet{Lang: "en", Text: "これは日本語です"}, true, ""},
+		{"Detected allowed", detect, anaconda.Tweet{Lang: "und", Text: "今日はいい天気ですね"}, true, ""},
+		{"Detected not allowed", detect, anaconda.Tweet{Text: "Das ist nicht mein Hund und ich mag ihn"}, false, "languageDetected"},
+		{"Still undetermined, denied", detect, anaconda.Tweet{Lang: "zxx", Text: "https://t.co/abc #clip"}, false, "languageUndetermined"},
+	}
+
+	for _, test := range tests {
+		ok, label, reason := checkLanguage(test.Status, test.Config)
+
+		if ok != test.Output || label != test.Label {
+			t.Errorf("%v: got %v/%q, want %v/%q", test.Explain, ok, label, test.Output, test.Label)
+		}
+
+		if !ok && reason == "" {
+			t.Errorf("%v: rejected without a reason", test.Explain)
+		}
+	}
+}
+
+func TestCheckPlaceCountry(t *testing.T) {
+	place := func(code string) anaconda.Tweet {
+		var status anaconda.Tweet
+		status.Place.CountryCode = code
+		return status
+	}
+
+	var tests = []struct {
+		Explain string
+		Config  CountryConfig
+		Status  anaconda.Tweet
+		Output  bool
+	}{
+		{"Allowed", CountryConfig{Allow: []string{"us", "JP"}}, place("JP"), true},
+		{"Not allowed", CountryConfig{Allow: []string{"US", "JP"}}, place("BR"), false},
+		{"Denied", CountryConfig{Deny: []string{"BR"}}, place("br"), false},
+		{"Not denied", CountryConfig{Deny: []string{"BR"}}, place("US"), true},
+		{"No place passes", CountryConfig{Allow: []string{"US"}}, anaconda.Tweet{}, true},
+		{"No place, denied", CountryConfig{Allow: []string{"US"}, DenyUnknown: true}, anaconda.Tweet{}, false},
+	}
+
+	for _, test := range tests {
+		if ok, reason := checkPlaceCountry(test.Status, test.Config); ok != test.Output || (!ok && reason == "") {
+			t.Errorf("%v: got %v (%q), want %v", test.Explain, ok, reason, test.Output)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Link domain filters. Tweets linking to spam or phishing domains are
+// rejected by the domain of their expanded links; a domain also covers its
+// subdomains, so denying example.com denies m.example.com too.
+package main
+
+import (
+	"fmt"
+	"github.com/davidk/anaconda"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// LinkDomainsConfig sets the domains tweets may or may not link to
+type LinkDomainsConfig struct {
+	// Reject tweets linking to these domains (or their subdomains)
+	Deny []string `json:"deny"`
+
+	// Domains that are never rejected, even if a parent domain is denied
+	Allow []string `json:"allow"`
+
+	// Reject tweets linking anywhere but the allowed domains
+	AllowOnly bool `json:"allow_only"`
+}
+
+// linkDomainFilter is the normalized form of a LinkDomainsConfig
+type linkDomainFilter struct {
+	deny      []string
+	allow     []string
+	allowOnly bool
+}
+
+// Link domain filter in use, compiled by ConfigureApp
+var linkDomains *linkDomainFilter
+
+// compileLinkDomains normalizes the configured domains. Returns nil if
+// there is nothing to filter.
+func compileLinkDomains(c LinkDomainsConfig) (*linkDomainFilter, error) {
+	if len(c.Deny) == 0 && !c.AllowOnly {
+		return nil, nil
+	}
+
+	if c.AllowOnly && len(c.Allow) == 0 {
+		return nil, fmt.Errorf("allow_only is set but no domains are allowed")
+	}
+
+	f := &linkDomainFilter{allowOnly: c.AllowOnly}
+
+	for _, lists := range []struct {
+		name    string
+		domains []string
+		into    *[]string
+	}{
+		{"deny", c.Deny, &f.deny},
+		{"allow", c.Allow, &f.allow},
+	} {
+		for _, d := range lists.domains {
+			domain := normalizeDomain(d)
+			if domain == "" {
+				return nil, fmt.Errorf("invalid %v domain %q", lists.name, d)
+			}
+			*lists.into = append(*lists.into, domain)
+		}
+	}
+
+	return f, nil
+}
+
+// normalizeDomain lowercases a configured domain, dropping a scheme, path,
+// port, leading "*." and trailing dot
+func normalizeDomain(d string) string {
+	d = strings.ToLower(strings.TrimSpace(d))
+
+	if strings.Contains(d, "://") {
+		if u, err := url.Parse(d); err == nil {
+			d = u.Hostname()
+		}
+	}
+
+	if i := strings.IndexAny(d, "/:"); i >= 0 {
+		d = d[:i]
+	}
+
+	d = strings.TrimPrefix(d, "*.")
+	return strings.Trim(d, ".")
+}
+
+// linkHost returns the lowercased host of a link, or "" if it has none
+func linkHost(link string) string {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// domainMatches reports whether host is one of domains or a subdomain of one
+func domainMatches(host string, domains []string) (string, bool) {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return d, true
+		}
+	}
+	return "", false
+}
+
+// Paths of Twitter's own links to a status (or its media)
+var twitterStatusPath = regexp.MustCompile(`^/(i/web|[^/]+)/status/\d+(/|$)`)
+
+// isTwitterSelfLink reports whether link is one Twitter adds itself: the
+// "…" link of a truncated tweet, the link to a quoted tweet, or a media link
+func isTwitterSelfLink(link string) bool {
+	host := linkHost(link)
+
+	if host == "pic.twitter.com" {
+		return true
+	}
+
+	if _, ok := domainMatches(host, []string{"twitter.com"}); !ok {
+		return false
+	}
+
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+
+	u, err := url.Parse(link)
+	return err == nil && twitterStatusPath.MatchString(u.Path)
+}
+
+// tweetLinks returns the expanded links of a tweet, including the ones only
+// in the extended tweet. Twitter's own links to statuses and media are left
+// out.
+func tweetLinks(status anaconda.Tweet) []string {
+	var links []string
+
+	for _, entities := range []anaconda.Entities{
+		status.Entities,
+		status.ExtendedEntities,
+		status.ExtendedTweet.Entities,
+		status.ExtendedTweet.ExtendedEntities,
+	} {
+		for _, u := range entities.Urls {
+			link := u.Expanded_url
+			if link == "" {
+				link = u.Url
+			}
+
+			if link != "" && !isTwitterSelfLink(link) {
+				links = append(links, link)
+			}
+		}
+	}
+
+	return links
+}
+
+// checkLinkDomains checks the links of a tweet against the filter. Returns
+// the reason if a link is to a denied domain, or (in allow_only mode) to a
+// domain that isn't allowed.
+func checkLinkDomains(status anaconda.Tweet, f *linkDomainFilter) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+
+	for _, link := range tweetLinks(status) {
+		host := linkHost(link)
+		if host == "" {
+			continue
+		}
+
+		if _, ok := domainMatches(host, f.allow); ok {
+			continue
+		}
+
+		if f.allowOnly {
+			reason := fmt.Sprintf("link to %v is not on an allowed domain", host)
+			log.Infof("checkLinkDomains: REJECT - %v", reason)
+			return false, reason
+		}
+
+		if domain, ok := domainMatches(host, f.deny); ok {
+			reason := fmt.Sprintf("link to %v is on denied domain %v", host, domain)
+			log.Infof("checkLinkDomains: REJECT - %v", reason)
+			return false, reason
+		}
+	}
+
+	log.Println("checkLinkDomains: OK")
+	return true, ""
+}
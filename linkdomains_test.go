@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/davidk/anaconda"
+	"testing"
+)
+
+// linkTweet builds a tweet linking to each of links
+func linkTweet(links ...string) anaconda.Tweet {
+	var status anaconda.Tweet
+	for _, link := range links {
+		status.Entities.Urls = append(status.Entities.Urls, struct {
+			Indices      []int
+			Url          string
+			Display_url  string
+			Expanded_url string
+		}{Url: "https://t.co/x", Expanded_url: link})
+	}
+	return status
+}
+
+func TestCheckLinkDomains(t *testing.T) {
+	deny, err := compileLinkDomains(LinkDomainsConfig{
+		Deny:  []string{"Example.com", "*.spam.net", "https://phish.org/login"},
+		Allow: []string{"good.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowOnly, err := compileLinkDomains(LinkDomainsConfig{
+		Allow:     []string{"youtube.com", "youtu.be"},
+		AllowOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	twitterDeny, err := compileLinkDomains(LinkDomainsConfig{Deny: []string{"twitter.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extended := anaconda.Tweet{}
+	extended.ExtendedTweet.Entities = linkTweet("http://m.example.com/a").Entities
+
+	var tests = []struct {
+		Explain string
+		Filter  *linkDomainFilter
+		Status  anaconda.Tweet
+		Output  bool
+	}{
+		{"No filter", nil, linkTweet("https://example.com"), true},
+		{"No links", deny, anaconda.Tweet{Text: "example.com"}, true},
+		{"Denied domain", deny, linkTweet("https://example.com/x"), false},
+		{"Denied subdomain", deny, linkTweet("https://M.Example.com./x"), false},
+		{"Only a suffix of the name", deny, linkTweet("https://notexample.com"), true},
+		{"Wildcard entry", deny, linkTweet("https://a.spam.net"), false},
+		{"URL entry", deny, linkTweet("phish.org:8080/x"), false},
+		{"Allowed subdomain of denied domain", deny, linkTweet("https://good.example.com"), true},
+		{"Second link denied", deny, linkTweet("https://ok.org", "https://spam.net"), false},
+		{"Extended tweet link", deny, extended, false},
+		{"Allow only: allowed", allowOnly, linkTweet("https://www.youtube.com/watch?v=1", "https://youtu.be/1"), true},
+		{"Allow only: not allowed", allowOnly, linkTweet("https://vimeo.com/1"), false},
+		{"Allow only: truncated tweet", allowOnly, linkTweet("https://twitter.com/i/web/status/1234567890"), true},
+		{"Allow only: quoted tweet", allowOnly, linkTweet("https://twitter.com/someone/status/1234567890"), true},
+		{"Allow only: media link", allowOnly, linkTweet("https://twitter.com/someone/status/1234567890/video/1", "pic.twitter.com/abc"), true},
+		{"Allow only: other twitter.com link", allowOnly, linkTweet("https://twitter.com/someone"), false},
+		{"Denied twitter.com still skips status links", twitterDeny, linkTweet("https://mobile.twitter.com/i/web/status/1"), true},
+	}
+
+	for _, test := range tests {
+		ok, reason := checkLinkDomains(test.Status, test.Filter)
+
+		if ok != test.Output {
+			t.Errorf("%v: got %v (%v), want %v", test.Explain, ok, reason, test.Output)
+		}
+
+		if !ok && reason == "" {
+			t.Errorf("%v: rejected without a reason", test.Explain)
+		}
+	}
+}
+
+func TestCompileLinkDomains(t *testing.T) {
+	if f, err := compileLinkDomains(LinkDomainsConfig{Allow: []string{"a.com"}}); f != nil || err != nil {
+		t.Errorf("Expected no filter without denied domains, got %v, %v", f, err)
+	}
+
+	if _, err := compileLinkDomains(LinkDomainsConfig{AllowOnly: true}); err == nil {
+		t.Error("Expected an error for allow_only without allowed domains")
+	}
+
+	if _, err := compileLinkDomains(LinkDomainsConfig{Deny: []string{" "}}); err == nil {
+		t.Error("Expected an error for an empty domain")
+	}
+}
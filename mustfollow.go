@@ -0,0 +1,152 @@
+// must_follow can name several accounts, each with its own mutual follow
+// setting. must_follow_mode decides how many of them a tweet's author has
+// to follow: any, all, or at_least must_follow_at_least of them.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/davidk/anaconda"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// Values for settings.must_follow_mode
+const (
+	mustFollowAny     = "any"
+	mustFollowAll     = "all"
+	mustFollowAtLeast = "at_least"
+)
+
+// FollowTarget is an account that tweet authors must follow. Mutual
+// overrides settings.mutual_follow for this account.
+type FollowTarget struct {
+	ScreenName string `json:"screen_name"`
+	Mutual     *bool  `json:"mutual_follow"`
+}
+
+// FollowTargets is the list of must_follow accounts. In JSON it can be a
+// single (comma separated) string, as in older configurations, or a list
+// of screen names and/or FollowTarget objects.
+type FollowTargets []FollowTarget
+
+// FollowCacheKey is the tweetOriginatorLRU key for a follow check. Each
+// target (and mutual setting) gets its own entry, so the result for one
+// target can't be mistaken for another's.
+type FollowCacheKey struct {
+	Source string
+	Target string
+	Mutual bool
+}
+
+// mutual returns whether a mutual follow is required for this target
+func (t FollowTarget) mutual() bool {
+	if t.Mutual != nil {
+		return *t.Mutual
+	}
+	return config.Settings.MutualFollow
+}
+
+// UnmarshalJSON accepts "a", "a,b", ["a", "b"] and
+// [{"screen_name": "a", "mutual_follow": true}, "b"]
+func (t *FollowTargets) UnmarshalJSON(data []byte) error {
+	var names string
+	if err := json.Unmarshal(data, &names); err == nil {
+		*t = nil
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				*t = append(*t, FollowTarget{ScreenName: name})
+			}
+		}
+		return nil
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("must_follow must be a string or a list: %v", err)
+	}
+
+	*t = nil
+	for _, entry := range entries {
+		var target FollowTarget
+		if err := json.Unmarshal(entry, &target.ScreenName); err != nil {
+			if err := json.Unmarshal(entry, &target); err != nil {
+				return fmt.Errorf("must_follow entries must be screen names or objects: %v", err)
+			}
+		}
+
+		if target.ScreenName = strings.TrimSpace(target.ScreenName); target.ScreenName != "" {
+			*t = append(*t, target)
+		}
+	}
+
+	return nil
+}
+
+// String lists the targets for logging
+func (t FollowTargets) String() string {
+	var names []string
+	for _, target := range t {
+		names = append(names, target.ScreenName)
+	}
+	return strings.Join(names, ",")
+}
+
+// mustFollowRequired returns how many targets a user must follow
+func mustFollowRequired(targets FollowTargets, mode string, atLeast int) int {
+	switch mode {
+	case mustFollowAll:
+		return len(targets)
+	case mustFollowAtLeast:
+		if atLeast > len(targets) {
+			return len(targets)
+		}
+		if atLeast < 1 {
+			return 1
+		}
+		return atLeast
+	default:
+		return 1
+	}
+}
+
+// checkMustFollow checks the author of a tweet against every must_follow
+// target, and passes if they follow enough of them (see must_follow_mode).
+// Targets are checked in order, stopping as soon as the outcome is known.
+// The result is followUnknown if the targets that couldn't be checked
+// decide the outcome.
+func checkMustFollow(fs FriendshipStatus, status anaconda.Tweet, targets FollowTargets, mode string, atLeast int) followResult {
+	if len(targets) == 0 {
+		log.Infof("checkMustFollow: Setting must_follow is not set. Bypassing check for user: %v\n", status.User.ScreenName)
+		return followYes
+	}
+
+	required := mustFollowRequired(targets, mode, atLeast)
+	following, unknown := 0, 0
+
+	for i, target := range targets {
+		switch checkFollowTarget(fs, status, target) {
+		case followYes:
+			following++
+		case followUnknown:
+			unknown++
+		}
+
+		if following >= required {
+			log.Infof("checkMustFollow: OK - %v follows %d of %d required accounts (%v)", status.User.ScreenName, following, required, targets)
+			return followYes
+		}
+
+		if following+unknown+len(targets)-i-1 < required {
+			break
+		}
+	}
+
+	if following+unknown >= required {
+		log.Infof("checkMustFollow: UNKNOWN - %v follows %d of %d required accounts (%v), %d could not be checked", status.User.ScreenName, following, required, targets, unknown)
+		return followUnknown
+	}
+
+	log.Infof("checkMustFollow: REJECT - %v follows %d of %d required accounts (%v)", status.User.ScreenName, following, required, targets)
+	return followNo
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/davidk/anaconda"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestFollowTargetsUnmarshal(t *testing.T) {
+
+	yes, no := true, false
+
+	var tests = []struct {
+		Input  string
+		Output FollowTargets
+	}{
+		{`""`, nil},
+		{`"jack"`, FollowTargets{{ScreenName: "jack"}}},
+		{`"jack, ev"`, FollowTargets{{ScreenName: "jack"}, {ScreenName: "ev"}}},
+		{`["jack", "ev"]`, FollowTargets{{ScreenName: "jack"}, {ScreenName: "ev"}}},
+		{`[{"screen_name": "jack", "mutual_follow": true}, "ev", {"screen_name": "biz", "mutual_follow": false}]`,
+			FollowTargets{{ScreenName: "jack", Mutual: &yes}, {ScreenName: "ev"}, {ScreenName: "biz", Mutual: &no}}},
+	}
+
+	for _, test := range tests {
+		var targets FollowTargets
+		if err := json.Unmarshal([]byte(test.Input), &targets); err != nil {
+			t.Errorf("Unmarshal(%v): %v", test.Input, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(targets, test.Output) {
+			t.Errorf("Unmarshal(%v): wanted %+v, got %+v", test.Input, test.Output, targets)
+		}
+	}
+
+	var targets FollowTargets
+	if err := json.Unmarshal([]byte(`42`), &targets); err == nil {
+		t.Error("A number should not unmarshal into must_follow")
+	}
+}
+
+// FakeTargetFriendships answers friendships per target:
+// [source follows target, target follows source]
+type FakeTargetFriendships map[string][2]bool
+
+func (f FakeTargetFriendships) GetFriendshipStatus(v url.Values) (anaconda.RelationshipResponse, error) {
+	r := anaconda.RelationshipResponse{}
+	answer := f[v.Get("target_screen_name")]
+	r.Relationship.Source.Following = answer[0]
+	r.Relationship.Target.Following = answer[1]
+	return r, nil
+}
+
+func TestCheckMustFollow(t *testing.T) {
+
+	savedMutual := config.Settings.MutualFollow
+	defer func() { config.Settings.MutualFollow = savedMutual }()
+	config.Settings.MutualFollow = false
+
+	tweetOriginatorLRU = newStateCache("tweetOriginator", 128)
+
+	yes := true
+
+	// The user follows studio_a and studio_b; studio_b follows back
+	fs := FakeTargetFriendships{
+		"studio_a": {true, false},
+		"studio_b": {true, true},
+		"studio_c": {false, true},
+	}
+
+	a := FollowTarget{ScreenName: "studio_a"}
+	b := FollowTarget{ScreenName: "studio_b"}
+	c := FollowTarget{ScreenName: "studio_c"}
+	mutualA := FollowTarget{ScreenName: "studio_a", Mutual: &yes}
+
+	var tests = []struct {
+		TestInfo string
+		Targets  FollowTargets
+		Mode     string
+		AtLeast  int
+		Output   followResult
+	}{
+		{"No targets", nil, "", 0, followYes},
+		{"Any (default)", FollowTargets{c, a}, "", 0, followYes},
+		{"Any, none followed", FollowTargets{c}, mustFollowAny, 0, followNo},
+		{"All", FollowTargets{a, b}, mustFollowAll, 0, followYes},
+		{"All, one missing", FollowTargets{a, b, c}, mustFollowAll, 0, followNo},
+		{"At least 2 of 3", FollowTargets{a, b, c}, mustFollowAtLeast, 2, followYes},
+		{"At least 3 of 3", FollowTargets{a, b, c}, mustFollowAtLeast, 3, followNo},
+		{"Per-target mutual follow", FollowTargets{mutualA}, mustFollowAny, 0, followNo},
+		// Cached separately from the mutual check of the same target above
+		{"Same target without mutual follow", FollowTargets{a}, mustFollowAny, 0, followYes},
+	}
+
+	status := anaconda.Tweet{User: anaconda.User{ScreenName: "contributor"}}
+
+	for _, test := range tests {
+		if result := checkMustFollow(fs, status, test.Targets, test.Mode, test.AtLeast); result != test.Output {
+			t.Errorf("%v: wanted %v, got %v", test.TestInfo, test.Output, result)
+		}
+	}
+
+	// Answers are cached per target, so changing the API's answer for
+	// one target doesn't change the cached answer of another
+	fs["studio_a"] = [2]bool{false, false}
+	if checkMustFollow(fs, status, FollowTargets{a}, mustFollowAny, 0) != followYes {
+		t.Error("The cached answer for studio_a was not used")
+	}
+
+	if _, ok := tweetOriginatorLRU.Get(FollowCacheKey{Source: "contributor", Target: "studio_a", Mutual: true}); !ok {
+		t.Error("The mutual check of studio_a was not cached under its own key")
+	}
+}
+
+func TestMustFollowRequired(t *testing.T) {
+
+	targets := FollowTargets{{ScreenName: "a"}, {ScreenName: "b"}, {ScreenName: "c"}}
+
+	var tests = []struct {
+		Mode    string
+		AtLeast int
+		Output  int
+	}{
+		{"", 0, 1},
+		{mustFollowAny, 5, 1},
+		{mustFollowAll, 0, 3},
+		{mustFollowAtLeast, 2, 2},
+		{mustFollowAtLeast, 9, 3},
+		{mustFollowAtLeast, 0, 1},
+	}
+
+	for _, test := range tests {
+		if result := mustFollowRequired(targets, test.Mode, test.AtLeast); result != test.Output {
+			t.Errorf("mustFollowRequired(%q, %d): wanted %d, got %d", test.Mode, test.AtLeast, test.Output, result)
+		}
+	}
+}
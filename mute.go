@@ -1,10 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"github.com/davidk/anaconda"
 	"github.com/davidk/memberset"
 	log "github.com/sirupsen/logrus"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // FriendshipInfo is replaced in testing with fake versions that
@@ -16,32 +23,216 @@ type GetMutedList interface {
 	GetMutedUsersList(v url.Values) (c anaconda.UserCursor, err error)
 }
 
-// MutedInfo stubs out Anaconda's information for testing / production
-type MutedInfo struct{}
+// How long to wait before retrying a refresh that couldn't read every source
+const muteRetryDelay = time.Minute
 
-// GetMutedUsersList passes to Anaconda's GetMutedUsersList()
-func (fs MutedInfo) GetMutedUsersList(v url.Values) (c anaconda.UserCursor, err error) {
-	return api.GetMutedUsersList(v)
+// MuteConfig configures how the muted user list is kept up to date.
+// Keyword mutes can't be synced: the API has no endpoint for them, so
+// muted words go in prohibited_words instead.
+type MuteConfig struct {
+	// Re-read mutes every RefreshSeconds (0: only at startup and on SIGUSR1)
+	RefreshSeconds int `json:"refresh_seconds"`
+
+	// A JSON list of BlocklistEntry, merged with the mutes from the API
+	File string `json:"file"`
+
+	// Local blocklists (CSV or JSON), reloaded when they change
+	Blocklists []string `json:"blocklists"`
+
+	// Also deny the bot's blocks, the blocks/mutes of moderator accounts
+	// and the members of Twitter lists
+	Blocks     bool               `json:"blocks"`
+	Moderators []ModeratorAccount `json:"moderators"`
+	Lists      []DenyList         `json:"lists"`
+}
+
+// Guards swapping mutedIds for a freshly built set
+var mutedIdsLock sync.RWMutex
+
+// The source name of users muted through MuteConfig.File
+const muteFileSource = "mute file"
+
+// currentMutedIds returns the muted user set in use
+func currentMutedIds() *memberset.MemberSet {
+	mutedIdsLock.RLock()
+	defer mutedIdsLock.RUnlock()
+	return mutedIds
 }
 
 // populateMutedList grabs the muted user list from the API and stores it.
-func populateMutedList(m GetMutedList, v url.Values, mutedIds *memberset.MemberSet) {
+// Pages are followed until the API runs out of them. If a page fails, the
+// error is returned and mutedIds holds the users read so far.
+func populateMutedList(m GetMutedList, v url.Values, mutedIds *memberset.MemberSet) error {
 
 	log.Println("populateMutedList: Requesting list of muted user IDs from API.")
-	cursor, err := m.GetMutedUsersList(v)
-	check(ErrorsAreFatal{}, "Unable to get list of muted user IDs from API", err)
-	for _, user := range cursor.Users {
-		log.Println("Got user:", user.Id)
+
+	err := fetchUsers(m.GetMutedUsersList, v, func(user anaconda.User) {
 		mutedIds.Add(user.Id)
 		log.Printf("populateMutedList: Muting tweets from: %v [id: %v ]\n", user.ScreenName, user.Id)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get list of muted user IDs from API: %v", err)
+	}
+
+	log.Println("populateMutedList: Done.")
+
+	return nil
+}
+
+// addDenyEntries adds the entries that haven't expired by now to d, and
+// returns when the next of the remaining entries expires (zero if none)
+func addDenyEntries(entries []BlocklistEntry, source string, now time.Time, d *DenySet) time.Time {
+	var nextExpiry time.Time
+
+	for _, e := range entries {
+		if !e.ExpiresAt.IsZero() && !e.ExpiresAt.After(now) {
+			log.Debugf("addDenyEntries: Entry for %v in %v expired at %v", e.UserID, source, e.ExpiresAt)
+			continue
+		}
+
+		d.Deny(e.UserID, source)
+		log.Debugf("addDenyEntries: Denying %v [id: %v ] from %v (reason: %q, expires: %v)", e.ScreenName, e.UserID, source, e.Reason, e.ExpiresAt)
+
+		if !e.ExpiresAt.IsZero() && (nextExpiry.IsZero() || e.ExpiresAt.Before(nextExpiry)) {
+			nextExpiry = e.ExpiresAt
+		}
 	}
 
-	if cursor.Next_cursor_str != "0" {
-		values := url.Values{}
-		log.Printf("populateMutedList: Retrieving next set of users ( recursion active, next cursor: %v )\n", cursor.Next_cursor_str)
-		values.Set("cursor", cursor.Next_cursor_str)
-		populateMutedList(m, values, mutedIds)
+	return nextExpiry
+}
+
+// keepPreviousEntries copies the entries of source from the set in use
+// into d, for a source that couldn't be read
+func keepPreviousEntries(d *DenySet, source string) {
+	mutedIdsLock.RLock()
+	defer mutedIdsLock.RUnlock()
+
+	for id, sources := range mutedSources {
+		for _, s := range sources {
+			if s == source {
+				d.Deny(id, source)
+			}
+		}
 	}
+}
 
-	log.Println("populateMutedList: Done.")
+// refreshMutedList rebuilds the deny set from every source and local file,
+// then swaps it in. A source that fails keeps the entries it had in the
+// previous set, so a bad refresh never unmutes anyone. Returns when the
+// next file entry expires (zero if none), and the sources that failed.
+func refreshMutedList(sources []denySource, c MuteConfig, now time.Time) (time.Time, error) {
+	return rebuildDenySet(sources, c, now, true)
+}
+
+// reloadDenyFiles rebuilds the deny set from the local files only, keeping
+// what the API sources had
+func reloadDenyFiles(sources []denySource, c MuteConfig, now time.Time) (time.Time, error) {
+	return rebuildDenySet(sources, c, now, false)
+}
+
+func rebuildDenySet(sources []denySource, c MuteConfig, now time.Time, fetch bool) (time.Time, error) {
+	fresh := NewDenySet()
+	var failed []string
+
+	for _, source := range sources {
+		name := source.Name
+
+		if !fetch {
+			keepPreviousEntries(fresh, name)
+			continue
+		}
+
+		err := fetchUsers(source.Fetch, source.Values, func(user anaconda.User) {
+			fresh.Deny(user.Id, name)
+		})
+		if err != nil {
+			log.Errorf("refreshMutedList: Unable to read %v, keeping its previous entries: %v", name, err)
+			keepPreviousEntries(fresh, name)
+			failed = append(failed, name)
+		}
+	}
+
+	var nextExpiry time.Time
+
+	for _, file := range denyFiles(c) {
+		entries, err := loadBlocklistFile(file.Path)
+		if err != nil {
+			log.Errorf("refreshMutedList: Unable to read %v, keeping its previous entries: %v", file.Path, err)
+			keepPreviousEntries(fresh, file.Name)
+			failed = append(failed, file.Name)
+			continue
+		}
+
+		if next := addDenyEntries(entries, file.Name, now, fresh); !next.IsZero() && (nextExpiry.IsZero() || next.Before(nextExpiry)) {
+			nextExpiry = next
+		}
+	}
+
+	setDenySet(fresh)
+	log.Infof("refreshMutedList: Denying %d users", fresh.Len())
+
+	if len(failed) > 0 {
+		return nextExpiry, fmt.Errorf("unable to read %v", strings.Join(failed, ", "))
+	}
+
+	return nextExpiry, nil
+}
+
+// runMuteRefresh re-reads every deny source every refresh_seconds and on
+// SIGUSR1. Local files are re-read when they change or an entry in them
+// expires. A refresh that couldn't read every source is retried after
+// muteRetryDelay.
+func runMuteRefresh(sources []denySource, c MuteConfig, nextExpiry time.Time) {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGUSR1)
+
+	files := denyFiles(c)
+	stamps := fileStamps(files)
+
+	var poll <-chan time.Time
+	if len(files) > 0 {
+		poll = time.Tick(blocklistPollInterval)
+	}
+
+	var tick <-chan time.Time
+	if c.RefreshSeconds > 0 {
+		tick = time.Tick(time.Duration(c.RefreshSeconds) * time.Second)
+	}
+
+	for {
+		var expiry <-chan time.Time
+		if !nextExpiry.IsZero() {
+			expiry = time.After(time.Until(nextExpiry))
+		}
+
+		refresh := refreshMutedList
+
+		select {
+		case <-tick:
+			log.Info("runMuteRefresh: Refreshing muted users")
+		case <-expiry:
+			log.Info("runMuteRefresh: An entry expired. Reloading local deny files")
+			refresh = reloadDenyFiles
+		case <-poll:
+			current := fileStamps(files)
+			if !stampsChanged(stamps, current) {
+				continue
+			}
+			log.Info("runMuteRefresh: Local deny files changed. Reloading them")
+			refresh = reloadDenyFiles
+		case sig := <-reload:
+			log.Infof("runMuteRefresh: Got %v. Refreshing muted users", sig)
+		}
+
+		stamps = fileStamps(files)
+
+		next, err := refresh(sources, c, time.Now())
+		if err != nil {
+			log.Errorf("runMuteRefresh: Refresh incomplete: %v", err)
+			if retry := time.Now().Add(muteRetryDelay); next.IsZero() || next.After(retry) {
+				next = retry
+			}
+		}
+		nextExpiry = next
+	}
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"github.com/davidk/memberset"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPopulateMutedListError(t *testing.T) {
+	ids := memberset.New()
+
+	if err := populateMutedList(FakeMuteInfo{Err: errors.New("rate limited")}, url.Values{}, ids); err == nil {
+		t.Error("Expected an error from a failing API, got none")
+	}
+
+	if err := populateMutedList(FakeMuteInfo{}, url.Values{}, ids); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestAddMuteEntries(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	entries := []BlocklistEntry{
+		{UserID: 1, Reason: "forever"},
+		{UserID: 2, ExpiresAt: now.Add(-time.Minute), Reason: "expired"},
+		{UserID: 3, ExpiresAt: now.Add(2 * time.Hour)},
+		{UserID: 4, ExpiresAt: now.Add(time.Hour)},
+	}
+
+	d := NewDenySet()
+	nextExpiry := addDenyEntries(entries, "test", now, d)
+
+	var tests = []struct {
+		id    int64
+		muted bool
+	}{
+		{1, true},
+		{2, false},
+		{3, true},
+		{4, true},
+	}
+
+	for _, test := range tests {
+		if got := userIsMuted(test.id, d.IDs); got != test.muted {
+			t.Errorf("userIsMuted(%v) = %v, want %v", test.id, got, test.muted)
+		}
+	}
+
+	if !nextExpiry.Equal(now.Add(time.Hour)) {
+		t.Errorf("Next expiry is %v, want %v", nextExpiry, now.Add(time.Hour))
+	}
+}
+
+func TestRefreshMutedList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chim-mute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "mutes.json")
+	if err := ioutil.WriteFile(file, []byte(`[{"user_id": 42, "reason": "spam"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := &DenySet{IDs: mutedIds, sources: mutedSources}
+	defer setDenySet(previous)
+
+	working := []denySource{{Name: "mutes", Fetch: FakeMuteInfo{}.GetMutedUsersList}}
+	if _, err := refreshMutedList(working, MuteConfig{File: file}, time.Now()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, id := range []int64{1234, 4567, 8910, 42} {
+		if !userIsMuted(id, currentMutedIds()) {
+			t.Errorf("Expected %v to be muted after a refresh", id)
+		}
+	}
+
+	// A failed refresh keeps what the failing source had before
+	failing := []denySource{{Name: "mutes", Fetch: FakeMuteInfo{Err: errors.New("unavailable")}.GetMutedUsersList}}
+	if _, err := refreshMutedList(failing, MuteConfig{File: file}, time.Now()); err == nil {
+		t.Error("Expected an error from a failing API, got none")
+	}
+
+	for _, id := range []int64{1234, 42} {
+		if !userIsMuted(id, currentMutedIds()) {
+			t.Errorf("A failed refresh dropped the previous mute of %v", id)
+		}
+	}
+
+	// So does an unreadable mute file
+	if err := ioutil.WriteFile(file, []byte(`not json`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := refreshMutedList(working, MuteConfig{File: file}, time.Now()); err == nil {
+		t.Error("Expected an error from a broken mute file, got none")
+	}
+
+	if !userIsMuted(int64(42), currentMutedIds()) {
+		t.Error("A broken mute file dropped the previous mutes")
+	}
+
+	// Sources that are no longer configured are dropped
+	if _, err := refreshMutedList(nil, MuteConfig{}, time.Now()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if userIsMuted(int64(42), currentMutedIds()) || userIsMuted(int64(1234), currentMutedIds()) {
+		t.Error("Mutes from sources that are gone were kept")
+	}
+}
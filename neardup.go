@@ -0,0 +1,161 @@
+// Near-duplicate text detection. Spam rings re-post the same text with a
+// different emoji, URL or mention, so instead of remembering the exact
+// text we normalize it and keep a 64 bit SimHash fingerprint. Texts that
+// differ by a word or two end up a few bits apart.
+package main
+
+import (
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"hash/fnv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultNearDuplicateDistance  = 6
+	defaultNearDuplicateWindow    = 3600
+	defaultNearDuplicateIndexSize = 512
+	defaultNearDuplicateMinTokens = 5
+)
+
+// NearDuplicateTextConfig configures near-duplicate text detection
+type NearDuplicateTextConfig struct {
+	MaxDistance   int `json:"max_distance"`
+	WindowSeconds int `json:"window_seconds"`
+	IndexSize     int `json:"index_size"`
+	MinTokens     int `json:"min_tokens"`
+}
+
+// withDefaults fills in unset values
+func (c NearDuplicateTextConfig) withDefaults() NearDuplicateTextConfig {
+	if c.MaxDistance <= 0 {
+		c.MaxDistance = defaultNearDuplicateDistance
+	}
+
+	if c.WindowSeconds <= 0 {
+		c.WindowSeconds = defaultNearDuplicateWindow
+	}
+
+	if c.IndexSize <= 0 {
+		c.IndexSize = defaultNearDuplicateIndexSize
+	}
+
+	if c.MinTokens <= 0 {
+		c.MinTokens = defaultNearDuplicateMinTokens
+	}
+
+	return c
+}
+
+// normalizeText strips URLs and mentions, applies NFKC and case folding,
+// and drops anything that isn't a letter or a number (emoji, punctuation).
+// Hashtags keep their text.
+func normalizeText(text string) string {
+	var words []string
+
+	for _, word := range strings.Fields(norm.NFKC.String(text)) {
+		lower := strings.ToLower(word)
+		if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(word, "@") {
+			continue
+		}
+
+		word = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsNumber(r) {
+				return r
+			}
+			return ' '
+		}, cases.Fold().String(word))
+
+		words = append(words, strings.Fields(word)...)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// simHash fingerprints a list of tokens. Every unigram and bigram is
+// hashed, and each bit of the fingerprint is set if most features have
+// that bit set.
+func simHash(tokens []string) uint64 {
+	var weights [64]int
+
+	feature := func(s string) {
+		h := fnv.New64a()
+		h.Write([]byte(s))
+		sum := h.Sum64()
+		for i := 0; i < 64; i++ {
+			if sum&(1<<uint(i)) != 0 {
+				weights[i]++
+			} else {
+				weights[i]--
+			}
+		}
+	}
+
+	for i, token := range tokens {
+		feature(token)
+		if i > 0 {
+			feature(tokens[i-1] + " " + token)
+		}
+	}
+
+	var fingerprint uint64
+	for i := 0; i < 64; i++ {
+		if weights[i] > 0 {
+			fingerprint |= 1 << uint(i)
+		}
+	}
+
+	return fingerprint
+}
+
+// textKey returns what is stored in postTextLRU for a text, or nil if
+// there is nothing to compare. Texts that are too short for a meaningful
+// fingerprint are compared exactly, as posted: once links and mentions
+// are stripped, captions like "#clip https://t.co/..." from different
+// users would all look the same.
+func textKey(text string, minTokens int) interface{} {
+	normalized := normalizeText(text)
+	tokens := strings.Fields(normalized)
+
+	if len(tokens) < minTokens {
+		if strings.TrimSpace(text) == "" {
+			return nil
+		}
+		return text
+	}
+
+	return simHash(tokens)
+}
+
+// findNearDuplicate looks for a key in cache that was added within window
+// and is within maxDistance bits of key. Returns the distance of the
+// match.
+func findNearDuplicate(cache *StateCache, key interface{}, maxDistance int, window time.Duration) (int, bool) {
+	cutoff := time.Now().Add(-window)
+	distance, found := 0, false
+
+	cache.Each(func(k interface{}, v interface{}, addedAt time.Time) bool {
+		if addedAt.Before(cutoff) {
+			return true
+		}
+
+		switch seen := k.(type) {
+		case uint64:
+			if fingerprint, ok := key.(uint64); ok {
+				if d := hammingDistance(fingerprint, seen); d <= maxDistance {
+					distance, found = d, true
+				}
+			}
+		case string:
+			if text, ok := key.(string); ok && text == seen {
+				found = true
+			}
+		}
+
+		return !found
+	})
+
+	return distance, found
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeText(t *testing.T) {
+
+	var tests = []struct {
+		Input  string
+		Output string
+	}{
+		{"So cool that they cant touch this", "so cool that they cant touch this"},
+		{"So COOL 🔥🔥 https://t.co/abc @someone #Clips!", "so cool clips"},
+		{"Ｆｕｌｌｗｉｄｔｈ text", "fullwidth text"},
+		{"Straße", "strasse"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if result := normalizeText(test.Input); result != test.Output {
+			t.Errorf("normalizeText(%q): wanted %q, got %q", test.Input, test.Output, result)
+		}
+	}
+}
+
+func TestSimHash(t *testing.T) {
+
+	base := textKey("Check out this amazing new clip from the game last night", 5).(uint64)
+
+	var tests = []struct {
+		Input string
+		Near  bool
+	}{
+		{"Check out this amazing new clip from the game last night 🔥", true},
+		{"CHECK out this amazing new clip from the game last night https://t.co/xyz", true},
+		{"@spam Check out this amazing new clip from the game last night!!", true},
+		{"RT check out this amazing new clip from the game last night", true},
+		{"Check out this amazing new video from the show last week", false},
+		{"My cat knocked a glass of water off the table again today", false},
+	}
+
+	for _, test := range tests {
+		d := hammingDistance(base, textKey(test.Input, 5).(uint64))
+		if (d <= defaultNearDuplicateDistance) != test.Near {
+			t.Errorf("%q is %d bits from the base text, wanted near: %v", test.Input, d, test.Near)
+		}
+	}
+}
+
+func TestFindNearDuplicate(t *testing.T) {
+
+	cache := newStateCache("postText", 10)
+	window := time.Hour
+
+	cache.Add(textKey("Check out this amazing new clip from the game last night", 5), 1)
+	cache.Add(textKey("short one", 5), 1)
+	cache.add(textKey("My cat knocked a glass of water off the table again today", 5), 1, time.Now().Add(-2*time.Hour))
+
+	var tests = []struct {
+		Input string
+		Found bool
+	}{
+		{"Check out this amazing new clip from the game last night 🎉 https://t.co/q", true},
+		{"short one", true},
+		// Short texts are compared as posted
+		{"Short one!", false},
+		{"Short two", false},
+		// Outside of the window
+		{"My cat knocked a glass of water off the table again today", false},
+	}
+
+	for _, test := range tests {
+		if _, found := findNearDuplicate(cache, textKey(test.Input, 5), defaultNearDuplicateDistance, window); found != test.Found {
+			t.Errorf("findNearDuplicate(%q): wanted %v, got %v", test.Input, test.Found, found)
+		}
+	}
+}
+
+// TestCheckPostRecentLRUShortCaptions ensures short captions that only
+// differ in their links or mentions aren't taken for duplicates
+func TestCheckPostRecentLRUShortCaptions(t *testing.T) {
+	defer func(cache *StateCache) { postTextLRU = cache }(postTextLRU)
+	postTextLRU = newStateCache("postText", 25)
+
+	var tests = []struct {
+		Explain string
+		Input   string
+		Output  bool
+	}{
+		{"Empty caption", "", true},
+		{"Another empty caption", "", true},
+		{"Link only", "https://t.co/abc", true},
+		{"Another user's link only", "https://t.co/xyz", true},
+		{"Hashtag only", "#clip https://t.co/1", true},
+		{"Another user's hashtag only", "#clip https://t.co/2", true},
+		{"Mention only", "@a look", true},
+		{"Another user's mention only", "@b look", true},
+		{"The same short tweet again", "#clip https://t.co/1", false},
+	}
+
+	for _, test := range tests {
+		if result := checkPostRecentLRU(test.Input); result != test.Output {
+			t.Errorf("%v: %q got %v, want %v", test.Explain, test.Input, result, test.Output)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Perceptual-hash duplicate detection. Re-uploads of the same clip get
+// new media IDs and URLs, but their poster images look the same. We
+// compute a 64 bit difference hash (dHash) of each poster and compare it
+// against the posters of recently approved tweets.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/davidk/anaconda"
+	log "github.com/sirupsen/logrus"
+	"image"
+	_ "image/gif" // register decoders for image.Decode
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPerceptualDistance  = 6
+	defaultPerceptualIndexSize = 500
+
+	// Posters are a few hundred KB at most
+	maxPosterBytes = 8 * 1024 * 1024
+)
+
+var (
+	// phashIndex is nil unless perceptual_dedup is enabled
+	phashIndex *PerceptualIndex
+
+	// Posters are fetched while a tweet is being checked, so a slow media
+	// host only gets a few seconds before the poster is skipped
+	posterClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// PerceptualDedupConfig configures perceptual-hash duplicate detection
+type PerceptualDedupConfig struct {
+	Enabled     bool   `json:"enabled"`
+	MaxDistance int    `json:"max_distance"`
+	IndexSize   int    `json:"index_size"`
+	IndexFile   string `json:"index_file"`
+}
+
+// PerceptualEntry is a poster hash of an approved tweet
+type PerceptualEntry struct {
+	Hash    uint64    `json:"hash"`
+	TweetID int64     `json:"tweet_id"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// PerceptualIndex is a bounded, optionally persisted list of poster hashes.
+// When it is full, the oldest entry is dropped.
+type PerceptualIndex struct {
+	Path        string
+	Size        int
+	MaxDistance int
+
+	entries []PerceptualEntry
+	sync.RWMutex
+}
+
+// NewPerceptualIndex loads a previously saved index from path (if set)
+func NewPerceptualIndex(c PerceptualDedupConfig) (*PerceptualIndex, error) {
+	idx := &PerceptualIndex{Path: c.IndexFile, Size: c.IndexSize, MaxDistance: c.MaxDistance}
+
+	if idx.Size <= 0 {
+		idx.Size = defaultPerceptualIndexSize
+	}
+
+	if idx.MaxDistance <= 0 {
+		idx.MaxDistance = defaultPerceptualDistance
+	}
+
+	if idx.Path == "" {
+		return idx, nil
+	}
+
+	data, err := ioutil.ReadFile(idx.Path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &idx.entries); err != nil {
+		return nil, err
+	}
+
+	if len(idx.entries) > idx.Size {
+		idx.entries = idx.entries[len(idx.entries)-idx.Size:]
+	}
+
+	log.Infof("NewPerceptualIndex: Loaded %d poster hashes from %v", len(idx.entries), idx.Path)
+
+	return idx, nil
+}
+
+// Match returns the closest entry within MaxDistance of hash
+func (idx *PerceptualIndex) Match(hash uint64) (PerceptualEntry, int, bool) {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	best := PerceptualEntry{}
+	bestDistance := 65
+
+	for _, e := range idx.entries {
+		if d := hammingDistance(hash, e.Hash); d < bestDistance {
+			best, bestDistance = e, d
+		}
+	}
+
+	return best, bestDistance, bestDistance <= idx.MaxDistance
+}
+
+// Add remembers the hashes of an approved tweet and saves the index
+func (idx *PerceptualIndex) Add(tweetID int64, hashes []uint64) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	idx.Lock()
+	defer idx.Unlock()
+
+	for _, h := range hashes {
+		idx.entries = append(idx.entries, PerceptualEntry{Hash: h, TweetID: tweetID, AddedAt: time.Now().UTC()})
+	}
+
+	if len(idx.entries) > idx.Size {
+		idx.entries = append([]PerceptualEntry(nil), idx.entries[len(idx.entries)-idx.Size:]...)
+	}
+
+	if idx.Path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(idx.entries)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(idx.Path, data, 0600)
+}
+
+// hammingDistance counts the bits that differ between two hashes
+func hammingDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// differenceHash computes a 64 bit dHash: the image is shrunk to 9x8
+// grayscale cells, and each bit says whether a cell is brighter than its
+// right-hand neighbour. It survives re-encoding, resizing and small
+// brightness changes.
+func differenceHash(img image.Image) uint64 {
+	const w, h = 9, 8
+
+	var cells [h][w]float64
+
+	b := img.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return 0
+	}
+
+	// Box-average the pixels that fall into each cell
+	var counts [h][w]float64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		cy := (y - b.Min.Y) * h / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x++ {
+			cx := (x - b.Min.X) * w / b.Dx()
+			r, g, bl, _ := img.At(x, y).RGBA()
+			cells[cy][cx] += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+			counts[cy][cx]++
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			left, right := cells[y][x], cells[y][x+1]
+			if counts[y][x] > 0 {
+				left /= counts[y][x]
+			}
+			if counts[y][x+1] > 0 {
+				right /= counts[y][x+1]
+			}
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// hashPoster decodes an image and returns its difference hash
+func hashPoster(r io.Reader) (uint64, error) {
+	img, _, err := image.Decode(io.LimitReader(r, maxPosterBytes))
+	if err != nil {
+		return 0, err
+	}
+	return differenceHash(img), nil
+}
+
+// fetchPosterHash downloads a poster image and hashes it
+func fetchPosterHash(src string) (uint64, error) {
+	resp, err := posterClient.Get(src)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fetching %v returned HTTP %d", src, resp.StatusCode)
+	}
+
+	return hashPoster(resp.Body)
+}
+
+// checkPerceptualDuplicate hashes the poster of every media entry in the
+// tweet and rejects it if any is within MaxDistance of a recently approved
+// poster. The hashes are returned so they can be added to the index once
+// the tweet is approved. Posters that can't be fetched (or time out) are
+// skipped.
+func checkPerceptualDuplicate(status anaconda.Tweet, idx *PerceptualIndex) (bool, []uint64) {
+	if idx == nil {
+		return true, nil
+	}
+
+	var hashes []uint64
+
+	for _, media := range tweetMediaEntities(status) {
+		if media.Media_url_https == "" {
+			continue
+		}
+
+		hash, err := fetchPosterHash(media.Media_url_https)
+		if err != nil {
+			log.Warnf("checkPerceptualDuplicate: Unable to hash poster %v, skipping: %v", media.Media_url_https, err)
+			continue
+		}
+
+		// A flat image (i.e. a black first frame) hashes to 0 and would
+		// match every other flat image
+		if hash == 0 {
+			log.Debugf("checkPerceptualDuplicate: Poster %v has no detail to compare, skipping", media.Media_url_https)
+			continue
+		}
+
+		if match, distance, ok := idx.Match(hash); ok {
+			log.Infof("checkPerceptualDuplicate: REJECT - Poster %v (%016x) is %d bits from tweet %v (%016x)",
+				media.Media_url_https, hash, distance, match.TweetID, match.Hash)
+			return false, nil
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	log.Infof("checkPerceptualDuplicate: OK - %d poster(s) not seen recently", len(hashes))
+	return true, hashes
+}
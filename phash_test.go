@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"github.com/davidk/anaconda"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPoster draws a fixture image: diagonal stripes on a gradient, with
+// the stripes shifted by phase. Different phases look nothing alike.
+func testPoster(width int, height int, phase int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(x * 255 / width)
+			if ((x*8/width)+(y*8/height)+phase)%3 == 0 {
+				v = 255 - v
+			}
+			img.Set(x, y, color.RGBA{v, v / 2, 255 - v, 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestDifferenceHash checks that a re-encoded, resized copy of a poster
+// hashes close to the original while a different poster does not
+func TestDifferenceHash(t *testing.T) {
+	original := differenceHash(testPoster(640, 360, 0))
+
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, testPoster(320, 180, 0), &jpeg.Options{Quality: 40})
+	reencoded, err := hashPoster(&buf)
+	if err != nil {
+		t.Fatalf("hashPoster: %v", err)
+	}
+
+	if d := hammingDistance(original, reencoded); d > defaultPerceptualDistance {
+		t.Errorf("Re-encoded copy is %d bits away, wanted <= %d", d, defaultPerceptualDistance)
+	}
+
+	different := differenceHash(testPoster(640, 360, 1))
+	if d := hammingDistance(original, different); d <= defaultPerceptualDistance {
+		t.Errorf("Different poster is only %d bits away", d)
+	}
+
+	if _, err := hashPoster(bytes.NewReader([]byte("not an image"))); err == nil {
+		t.Error("Expected an error decoding garbage")
+	}
+}
+
+// TestCheckPerceptualDuplicate runs the check against a stand-in media
+// host and checks that the index persists
+func TestCheckPerceptualDuplicate(t *testing.T) {
+	posters := map[string][]byte{
+		"/original.png":  encodePNG(t, testPoster(640, 360, 0)),
+		"/reupload.png":  encodePNG(t, testPoster(600, 338, 0)),
+		"/something.png": encodePNG(t, testPoster(640, 360, 2)),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if data, ok := posters[r.URL.Path]; ok {
+			w.Write(data)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	tweet := func(poster string) anaconda.Tweet {
+		return anaconda.Tweet{
+			ExtendedEntities: anaconda.Entities{
+				Media: []anaconda.EntityMedia{{Type: "video", Media_url_https: server.URL + poster}},
+			},
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "phash.json")
+	idx, err := NewPerceptualIndex(PerceptualDedupConfig{Enabled: true, IndexFile: path, IndexSize: 2})
+	if err != nil {
+		t.Fatalf("NewPerceptualIndex: %v", err)
+	}
+
+	ok, hashes := checkPerceptualDuplicate(tweet("/original.png"), idx)
+	if !ok || len(hashes) != 1 {
+		t.Fatalf("First poster should pass with one hash. Got %v, %v", ok, hashes)
+	}
+	idx.Add(1, hashes)
+
+	if ok, _ := checkPerceptualDuplicate(tweet("/reupload.png"), idx); ok {
+		t.Error("Re-upload of the same clip should be rejected")
+	}
+
+	if ok, _ := checkPerceptualDuplicate(tweet("/something.png"), idx); !ok {
+		t.Error("A different clip should pass")
+	}
+
+	if ok, hashes := checkPerceptualDuplicate(tweet("/missing.png"), idx); !ok || len(hashes) != 0 {
+		t.Error("A poster that can't be fetched should be skipped, not rejected")
+	}
+
+	reloaded, err := NewPerceptualIndex(PerceptualDedupConfig{Enabled: true, IndexFile: path, IndexSize: 2})
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	if ok, _ := checkPerceptualDuplicate(tweet("/reupload.png"), reloaded); ok {
+		t.Error("Reloaded index forgot the original poster")
+	}
+
+	// The index is bounded: two more approvals push the original out
+	reloaded.Add(2, []uint64{0x0f0f0f0f0f0f0f0f})
+	reloaded.Add(3, []uint64{0xf0f0f0f0f0f0f0f0})
+
+	if ok, _ := checkPerceptualDuplicate(tweet("/reupload.png"), reloaded); !ok {
+		t.Error("Oldest entry should have been dropped from a full index")
+	}
+}
+
+// TestCheckPerceptualDuplicateTimeout ensures a slow media host doesn't
+// hold up the tweet: the poster is skipped once posterClient gives up
+func TestCheckPerceptualDuplicateTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	defer func(timeout time.Duration) { posterClient.Timeout = timeout }(posterClient.Timeout)
+	posterClient.Timeout = 50 * time.Millisecond
+
+	idx, err := NewPerceptualIndex(PerceptualDedupConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("NewPerceptualIndex: %v", err)
+	}
+
+	status := anaconda.Tweet{
+		ExtendedEntities: anaconda.Entities{
+			Media: []anaconda.EntityMedia{{Type: "video", Media_url_https: server.URL + "/slow.png"}},
+		},
+	}
+
+	start := time.Now()
+	if ok, hashes := checkPerceptualDuplicate(status, idx); !ok || len(hashes) != 0 {
+		t.Errorf("A poster that times out should be skipped, got %v, %v", ok, hashes)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Waited %v for a slow poster", elapsed)
+	}
+}
@@ -0,0 +1,100 @@
+// Profile filters. Spam accounts often give themselves away in their
+// display name, bio, location or website rather than in the tweet, so the
+// prohibited words matcher is also run over those fields.
+package main
+
+import (
+	"fmt"
+	"github.com/davidk/anaconda"
+	log "github.com/sirupsen/logrus"
+)
+
+// TermsConfig is a list of prohibited words/phrases and patterns, matched
+// the same way as prohibited_words and prohibited_patterns
+type TermsConfig struct {
+	Words    []string `json:"words"`
+	Patterns []string `json:"patterns"`
+}
+
+// ProfileFiltersConfig sets the prohibited terms of each profile field
+type ProfileFiltersConfig struct {
+	Name        TermsConfig `json:"name"`
+	Description TermsConfig `json:"description"`
+	Location    TermsConfig `json:"location"`
+	URL         TermsConfig `json:"url"`
+}
+
+// profileFilter is the compiled filter of one profile field
+type profileFilter struct {
+	// Field name for logs and reasons, and the tweets_processed label
+	field string
+	label string
+
+	terms  *ProhibitedTerms
+	values func(u anaconda.User) []string
+}
+
+// Profile filters in use, compiled by ConfigureApp
+var profileFilters []profileFilter
+
+// compileProfileFilters compiles the fields that have terms configured
+func compileProfileFilters(c ProfileFiltersConfig) ([]profileFilter, error) {
+	fields := []struct {
+		field  string
+		label  string
+		terms  TermsConfig
+		values func(u anaconda.User) []string
+	}{
+		{"name", "profileName", c.Name, func(u anaconda.User) []string { return []string{u.Name} }},
+		{"description", "profileDescription", c.Description, func(u anaconda.User) []string { return []string{u.Description} }},
+		{"location", "profileLocation", c.Location, func(u anaconda.User) []string { return []string{u.Location} }},
+		{"url", "profileURL", c.URL, profileURLs},
+	}
+
+	var filters []profileFilter
+
+	for _, f := range fields {
+		if len(f.terms.Words) == 0 && len(f.terms.Patterns) == 0 {
+			continue
+		}
+
+		terms, err := compileProhibitedTerms(f.terms.Words, f.terms.Patterns)
+		if err != nil {
+			return nil, fmt.Errorf("profile_filters.%v: %v", f.field, err)
+		}
+
+		filters = append(filters, profileFilter{field: f.field, label: f.label, terms: terms, values: f.values})
+	}
+
+	return filters, nil
+}
+
+// profileURLs returns a user's website, both as the t.co link in the
+// profile and the link it expands to
+func profileURLs(u anaconda.User) []string {
+	urls := []string{u.URL}
+
+	for _, entity := range u.Entities.Url.Urls {
+		if entity.Expanded_url != "" {
+			urls = append(urls, entity.Expanded_url)
+		}
+	}
+
+	return urls
+}
+
+// checkProfile runs the profile filters over the author of a tweet.
+// Returns a rejection label and the reason if a field has a prohibited
+// term.
+func checkProfile(status anaconda.Tweet, filters []profileFilter) (bool, string, string) {
+	for _, f := range filters {
+		if term, ok := f.terms.Match(f.values(status.User)); ok {
+			reason := fmt.Sprintf("profile %v of %v matches %q", f.field, status.User.ScreenName, term)
+			log.Infof("checkProfile: REJECT - The %v", reason)
+			return false, f.label, reason
+		}
+	}
+
+	log.Println("checkProfile: OK")
+	return true, "", ""
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/davidk/anaconda"
+	"testing"
+)
+
+func TestCheckProfile(t *testing.T) {
+	filters, err := compileProfileFilters(ProfileFiltersConfig{
+		Name:        TermsConfig{Words: []string{"giveaway"}},
+		Description: TermsConfig{Words: []string{"dm for promo"}, Patterns: []string{`\d+k followers`}},
+		Location:    TermsConfig{Words: []string{"crypto land"}},
+		URL:         TermsConfig{Patterns: []string{`onlyfans\.com`}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profileURL := anaconda.User{URL: "https://t.co/abc"}
+	profileURL.Entities.Url.Urls = append(profileURL.Entities.Url.Urls, struct {
+		Indices      []int
+		Url          string
+		Display_url  string
+		Expanded_url string
+	}{Url: "https://t.co/abc", Expanded_url: "https://OnlyFans.com/someone"})
+
+	var tests = []struct {
+		Explain string
+		User    anaconda.User
+		Output  bool
+		Label   string
+	}{
+		{"Clean profile", anaconda.User{Name: "Sam", Description: "Goalkeeper", Location: "Leeds"}, true, ""},
+		{"Name", anaconda.User{Name: "🎁 GIVEAWAY 🎁"}, false, "profileName"},
+		{"Bio phrase", anaconda.User{Description: "Music lover. DM for PROMO!"}, false, "profileDescription"},
+		{"Bio pattern", anaconda.User{Description: "Get 10k followers fast"}, false, "profileDescription"},
+		{"Location", anaconda.User{Location: "Crypto Land 🚀"}, false, "profileLocation"},
+		{"Expanded profile URL", profileURL, false, "profileURL"},
+		{"Terms of one field don't apply to another", anaconda.User{Name: "crypto land"}, true, ""},
+	}
+
+	for _, test := range tests {
+		ok, label, reason := checkProfile(anaconda.Tweet{User: test.User}, filters)
+
+		if ok != test.Output || label != test.Label {
+			t.Errorf("%v: got %v/%q, want %v/%q", test.Explain, ok, label, test.Output, test.Label)
+		}
+
+		if !ok && reason == "" {
+			t.Errorf("%v: rejected without a reason", test.Explain)
+		}
+	}
+}
+
+func TestCompileProfileFilters(t *testing.T) {
+	filters, err := compileProfileFilters(ProfileFiltersConfig{})
+	if err != nil || len(filters) != 0 {
+		t.Errorf("Expected no filters from an empty config, got %v, %v", filters, err)
+	}
+
+	if _, err := compileProfileFilters(ProfileFiltersConfig{Location: TermsConfig{Patterns: []string{"("}}}); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+func TestDecisionRejected(t *testing.T) {
+	d := &Decision{}
+	d.passed("checkTweetContent")
+	d.rejected("profileName", "profile name of someone matches \"giveaway\"")
+
+	if d.Verdict != "reject" || d.RejectedBy != "profileName" || d.Reason == "" {
+		t.Errorf("Unexpected decision: %+v", d)
+	}
+}
@@ -0,0 +1,150 @@
+// Video quality gates. Twitter sends the duration, aspect ratio, encoded
+// variants and rendered sizes of every video, so tiny, low bitrate or
+// hour-long uploads can be turned away without downloading anything.
+package main
+
+import (
+	"fmt"
+	"github.com/davidk/anaconda"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// How far (relative) an aspect ratio may be from an allowed one. Encoders
+// round odd sizes, so 1280x718 still counts as 16:9.
+const aspectRatioTolerance = 0.01
+
+// VideoQualityConfig sets the quality thresholds for videos and gifs.
+// Zero values disable a threshold.
+type VideoQualityConfig struct {
+	MinDurationMillis int64    `json:"min_duration_millis"`
+	MaxDurationMillis int64    `json:"max_duration_millis"`
+	MinBitrate        int      `json:"min_bitrate"`
+	AspectRatios      []string `json:"aspect_ratios"`
+	MinWidth          int      `json:"min_width"`
+	MinHeight         int      `json:"min_height"`
+
+	// AspectRatios as width/height, parsed by compile
+	ratios []float64
+}
+
+// compile parses the allowed aspect ratios. ConfigureApp calls it so that
+// an invalid entry stops the bot at startup.
+func (c *VideoQualityConfig) compile() error {
+	c.ratios = nil
+
+	for _, ratio := range c.AspectRatios {
+		w, h, err := parseRatio(ratio)
+		if err != nil {
+			return fmt.Errorf("aspect ratio %q: %v", ratio, err)
+		}
+		c.ratios = append(c.ratios, float64(w)/float64(h))
+	}
+
+	return nil
+}
+
+// checkVideoQuality checks every video and gif in a tweet against the
+// quality thresholds. Duration and bitrate only apply to videos, since
+// gifs are short, silent loops that Twitter encodes without a bitrate.
+// Metadata that Twitter didn't send is not held against the tweet.
+// Returns a rejection label if the tweet should be dropped.
+func checkVideoQuality(status anaconda.Tweet, c VideoQualityConfig) (bool, string) {
+	for _, media := range tweetMediaEntities(status) {
+		isVideo := strings.EqualFold(media.Type, "video")
+		if !isVideo && !strings.EqualFold(media.Type, "animated_gif") {
+			continue
+		}
+
+		info := media.VideoInfo
+
+		if isVideo && info.DurationMillis > 0 {
+			if c.MinDurationMillis > 0 && info.DurationMillis < c.MinDurationMillis {
+				log.Infof("checkVideoQuality: REJECT - Video %v is %dms long, shorter than %dms", media.Id_str, info.DurationMillis, c.MinDurationMillis)
+				return false, "videoTooShort"
+			}
+
+			if c.MaxDurationMillis > 0 && info.DurationMillis > c.MaxDurationMillis {
+				log.Infof("checkVideoQuality: REJECT - Video %v is %dms long, longer than %dms", media.Id_str, info.DurationMillis, c.MaxDurationMillis)
+				return false, "videoTooLong"
+			}
+		}
+
+		if isVideo && c.MinBitrate > 0 {
+			if best, ok := bestVariant(info.Variants); ok && best.Bitrate > 0 && best.Bitrate < c.MinBitrate {
+				log.Infof("checkVideoQuality: REJECT - Best variant of video %v is %d bps, below %d bps", media.Id_str, best.Bitrate, c.MinBitrate)
+				return false, "videoLowBitrate"
+			}
+		}
+
+		if len(c.ratios) > 0 && len(info.AspectRatio) == 2 && !aspectRatioAllowed(info.AspectRatio[0], info.AspectRatio[1], c.ratios) {
+			log.Infof("checkVideoQuality: REJECT - Aspect ratio %d:%d of %v is not in %v", info.AspectRatio[0], info.AspectRatio[1], media.Id_str, c.AspectRatios)
+			return false, "videoAspectRatio"
+		}
+
+		if w, h := largestMediaSize(media.Sizes); w > 0 && h > 0 && (w < c.MinWidth || h < c.MinHeight) {
+			log.Infof("checkVideoQuality: REJECT - %v is %dx%d, smaller than %dx%d", media.Id_str, w, h, c.MinWidth, c.MinHeight)
+			return false, "videoLowResolution"
+		}
+	}
+
+	log.Info("checkVideoQuality: OK")
+	return true, ""
+}
+
+// aspectRatioAllowed compares w:h against a list of ratios (width/height),
+// within aspectRatioTolerance
+func aspectRatioAllowed(w int, h int, allowed []float64) bool {
+	if w <= 0 || h <= 0 {
+		return false
+	}
+
+	ratio := float64(w) / float64(h)
+
+	for _, a := range allowed {
+		if math.Abs(ratio-a) <= a*aspectRatioTolerance {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseRatio parses "w:h"
+func parseRatio(ratio string) (int, int, error) {
+	parts := strings.Split(strings.TrimSpace(ratio), ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected width:height")
+	}
+
+	w, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	h, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("width and height must be positive")
+	}
+
+	return w, h, nil
+}
+
+// largestMediaSize returns the dimensions of the largest rendition
+func largestMediaSize(sizes anaconda.MediaSizes) (int, int) {
+	w, h := 0, 0
+
+	for _, s := range []anaconda.MediaSize{sizes.Thumb, sizes.Small, sizes.Medium, sizes.Large} {
+		if s.W*s.H > w*h {
+			w, h = s.W, s.H
+		}
+	}
+
+	return w, h
+}
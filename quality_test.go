@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/davidk/anaconda"
+	"testing"
+)
+
+func TestCheckVideoQuality(t *testing.T) {
+
+	video := func(durationMillis int64, bitrate int, ratio []int, w int, h int) anaconda.Tweet {
+		status := anaconda.Tweet{}
+		status.ExtendedEntities.Media = []anaconda.EntityMedia{{
+			Id_str: "1",
+			Type:   "video",
+			Sizes:  anaconda.MediaSizes{Small: anaconda.MediaSize{W: w / 2, H: h / 2}, Large: anaconda.MediaSize{W: w, H: h}},
+			VideoInfo: anaconda.VideoInfo{
+				AspectRatio:    ratio,
+				DurationMillis: durationMillis,
+				Variants: []anaconda.Variant{
+					{ContentType: "application/x-mpegURL", Url: "https://video.example.com/pl.m3u8"},
+					{ContentType: "video/mp4", Bitrate: bitrate / 2, Url: "https://video.example.com/low.mp4"},
+					{ContentType: "video/mp4", Bitrate: bitrate, Url: "https://video.example.com/high.mp4"},
+				},
+			},
+		}}
+		return status
+	}
+
+	gif := anaconda.Tweet{}
+	gif.ExtendedEntities.Media = []anaconda.EntityMedia{{
+		Id_str:    "2",
+		Type:      "animated_gif",
+		Sizes:     anaconda.MediaSizes{Large: anaconda.MediaSize{W: 480, H: 270}},
+		VideoInfo: anaconda.VideoInfo{AspectRatio: []int{16, 9}, Variants: []anaconda.Variant{{ContentType: "video/mp4", Url: "https://video.example.com/gif.mp4"}}},
+	}}
+
+	gates := VideoQualityConfig{
+		MinDurationMillis: 3000,
+		MaxDurationMillis: 600000,
+		MinBitrate:        800000,
+		AspectRatios:      []string{"16:9", "9:16", "1:1"},
+		MinWidth:          320,
+		MinHeight:         240,
+	}
+	if err := gates.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	var tests = []struct {
+		TestInfo string
+		Config   VideoQualityConfig
+		Input    anaconda.Tweet
+		Output   bool
+		Label    string
+	}{
+		{"No gates", VideoQualityConfig{}, video(500, 1000, []int{4, 3}, 16, 16), true, ""},
+		{"Passes every gate", gates, video(30000, 2176000, []int{16, 9}, 1280, 720), true, ""},
+		{"Too short", gates, video(1500, 2176000, []int{16, 9}, 1280, 720), false, "videoTooShort"},
+		{"Too long", gates, video(3600000, 2176000, []int{16, 9}, 1280, 720), false, "videoTooLong"},
+		{"Low bitrate", gates, video(30000, 256000, []int{16, 9}, 1280, 720), false, "videoLowBitrate"},
+		{"Aspect ratio not allowed", gates, video(30000, 2176000, []int{4, 3}, 1280, 960), false, "videoAspectRatio"},
+		{"Aspect ratio is reduced", gates, video(30000, 2176000, []int{32, 18}, 1280, 720), true, ""},
+		{"Aspect ratio is close enough", gates, video(30000, 2176000, []int{640, 359}, 1280, 718), true, ""},
+		{"Low resolution", gates, video(30000, 2176000, []int{16, 9}, 256, 144), false, "videoLowResolution"},
+		{"Missing metadata is not held against the tweet", gates, video(0, 0, nil, 0, 0), true, ""},
+		{"Gifs skip the duration and bitrate gates", gates, gif, true, ""},
+		{"Gifs still need the resolution", VideoQualityConfig{MinWidth: 640}, gif, false, "videoLowResolution"},
+	}
+
+	for _, test := range tests {
+		result, label := checkVideoQuality(test.Input, test.Config)
+		if result != test.Output || label != test.Label {
+			t.Errorf("%v: wanted (%v, %q), got (%v, %q)", test.TestInfo, test.Output, test.Label, result, label)
+		}
+	}
+}
+
+func TestAspectRatioAllowed(t *testing.T) {
+
+	var tests = []struct {
+		W, H    int
+		Allowed []string
+		Output  bool
+	}{
+		{16, 9, []string{"16:9"}, true},
+		{1920, 1080, []string{" 16 : 9 "}, true},
+		{1280, 718, []string{"16:9"}, true},
+		{1280, 700, []string{"16:9"}, false},
+		{9, 16, []string{"16:9"}, false},
+		{1, 1, []string{"4:3", "2:2"}, true},
+		{4, 3, nil, false},
+		{4, 0, []string{"4:3"}, false},
+	}
+
+	for _, test := range tests {
+		c := VideoQualityConfig{AspectRatios: test.Allowed}
+		if err := c.compile(); err != nil {
+			t.Fatalf("compile(%q): %v", test.Allowed, err)
+		}
+
+		if result := aspectRatioAllowed(test.W, test.H, c.ratios); result != test.Output {
+			t.Errorf("aspectRatioAllowed(%d, %d, %q): wanted %v, got %v", test.W, test.H, test.Allowed, test.Output, result)
+		}
+	}
+}
+
+func TestVideoQualityCompile(t *testing.T) {
+
+	for _, bad := range []string{"bogus", "1:0", "16:9:1", "-4:3"} {
+		c := VideoQualityConfig{AspectRatios: []string{"16:9", bad}}
+		if err := c.compile(); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
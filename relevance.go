@@ -0,0 +1,183 @@
+// Relevance check. The streaming API's track parameter matches loosely:
+// text inside URLs, display names and the like all count. This confirms a
+// tweet really has one of the search terms as a hashtag, a mention or a
+// whole word in its text, or that it came from a watched user, and
+// records what matched.
+package main
+
+import (
+	"github.com/davidk/anaconda"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// trackWord is one word of a search term. Words given as #tag or @user
+// only match a hashtag or mention; other words match either, or the text.
+type trackWord struct {
+	text    string
+	hashtag bool
+	mention bool
+}
+
+// trackTerm is a search term, read the way Twitter reads track: every
+// word of the term has to be in the tweet, in any order
+type trackTerm struct {
+	term  string
+	words []trackWord
+}
+
+// relevanceFields are the parts of a tweet search terms are matched against
+type relevanceFields struct {
+	// Folded words of the text, without links, as " word word "
+	text     string
+	hashtags map[string]bool
+	mentions map[string]bool
+}
+
+var (
+	// Search terms, parsed by ConfigureApp
+	trackTerms []trackTerm
+
+	// IDs of watch_users, and their screen names. Filled in by
+	// buildSearchTerms.
+	watchedUsers = make(map[int64]string)
+
+	// Links in the text aren't words of the tweet
+	textLinks = regexp.MustCompile(`https?://\S+`)
+)
+
+// parseTrackTerms splits a comma separated list of search terms
+func parseTrackTerms(searchTerms string) []trackTerm {
+	var terms []trackTerm
+
+	for _, term := range strings.Split(searchTerms, ",") {
+		term = strings.TrimSpace(term)
+		t := trackTerm{term: term}
+
+		for _, w := range strings.Fields(term) {
+			word := trackWord{}
+
+			switch {
+			case strings.HasPrefix(w, "#"):
+				word.hashtag = true
+				word.text = strings.Join(textTokens(foldText(w[1:])), "")
+			case strings.HasPrefix(w, "@"):
+				word.mention = true
+				word.text = strings.ToLower(w[1:])
+			default:
+				word.text = strings.Join(textTokens(foldText(w)), " ")
+			}
+
+			if word.text != "" {
+				t.words = append(t.words, word)
+			}
+		}
+
+		if len(t.words) > 0 {
+			terms = append(terms, t)
+		}
+	}
+
+	return terms
+}
+
+// tweetRelevanceFields collects the text, hashtags and mentions of a tweet
+func tweetRelevanceFields(status anaconda.Tweet) relevanceFields {
+	f := relevanceFields{
+		text:     " " + strings.Join(textTokens(foldText(textLinks.ReplaceAllString(tweetFullText(status), " "))), " ") + " ",
+		hashtags: make(map[string]bool),
+		mentions: make(map[string]bool),
+	}
+
+	for _, entities := range []anaconda.Entities{
+		status.Entities,
+		status.ExtendedEntities,
+		status.ExtendedTweet.Entities,
+		status.ExtendedTweet.ExtendedEntities,
+	} {
+		for _, h := range entities.Hashtags {
+			f.hashtags[strings.Join(textTokens(foldText(h.Text)), "")] = true
+		}
+		for _, m := range entities.User_mentions {
+			f.mentions[strings.ToLower(m.Screen_name)] = true
+		}
+	}
+
+	return f
+}
+
+// matches reports whether every word of the term is in f
+func (t trackTerm) matches(f relevanceFields) bool {
+	for _, w := range t.words {
+		var found bool
+
+		switch {
+		case w.hashtag:
+			found = f.hashtags[w.text]
+		case w.mention:
+			found = f.mentions[w.text]
+		default:
+			joined := strings.Replace(w.text, " ", "", -1)
+			found = strings.Contains(f.text, " "+w.text+" ") || f.hashtags[joined] || f.mentions[joined]
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchedTerms returns the search terms a tweet (or the tweet it retweets
+// or quotes) really contains, and the watched users it is from or replies
+// to, as @screen_name
+func matchedTerms(status anaconda.Tweet, terms []trackTerm, watched map[int64]string) []string {
+	var matched []string
+	seen := make(map[string]bool)
+
+	add := func(term string) {
+		if !seen[term] {
+			seen[term] = true
+			matched = append(matched, term)
+		}
+	}
+
+	tweets := []anaconda.Tweet{status}
+	if status.RetweetedStatus != nil {
+		tweets = append(tweets, *status.RetweetedStatus)
+	}
+	if status.QuotedStatus != nil {
+		tweets = append(tweets, *status.QuotedStatus)
+	}
+
+	for _, t := range tweets {
+		for _, id := range []int64{t.User.Id, t.InReplyToUserID} {
+			if name, ok := watched[id]; ok && id != 0 {
+				add(watchedUserTerm(id, name))
+			}
+		}
+
+		if len(terms) == 0 {
+			continue
+		}
+
+		fields := tweetRelevanceFields(t)
+		for _, term := range terms {
+			if term.matches(fields) {
+				add(term.term)
+			}
+		}
+	}
+
+	return matched
+}
+
+// watchedUserTerm names a watched user as a matched term
+func watchedUserTerm(id int64, screenName string) string {
+	if screenName == "" {
+		return "@" + strconv.FormatInt(id, 10)
+	}
+	return "@" + screenName
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/davidk/anaconda"
+	"reflect"
+	"testing"
+)
+
+// relevanceTweet builds a tweet with text, hashtags and mentions
+func relevanceTweet(text string, hashtags []string, mentions []string) anaconda.Tweet {
+	status := anaconda.Tweet{Text: text, User: anaconda.User{Id: 1}}
+
+	for _, h := range hashtags {
+		status.Entities.Hashtags = append(status.Entities.Hashtags, struct {
+			Indices []int
+			Text    string
+		}{Text: h})
+	}
+
+	for _, m := range mentions {
+		status.Entities.User_mentions = append(status.Entities.User_mentions, struct {
+			Name        string
+			Indices     []int
+			Screen_name string
+			Id          int64
+			Id_str      string
+		}{Screen_name: m})
+	}
+
+	return status
+}
+
+func TestMatchedTerms(t *testing.T) {
+	terms := parseTrackTerms("cats, #goal ,@ClipBot, iron man,, dog-rates")
+	watched := map[int64]string{42: "thecatreviewer", 43: ""}
+
+	retweet := relevanceTweet("RT", nil, nil)
+	original := relevanceTweet("Look at these cats", nil, nil)
+	retweet.RetweetedStatus = &original
+
+	reply := relevanceTweet("nice", nil, nil)
+	reply.InReplyToUserID = 42
+
+	var tests = []struct {
+		Explain string
+		Status  anaconda.Tweet
+		Output  []string
+	}{
+		{"Word in text", relevanceTweet("I love CATS!", nil, nil), []string{"cats"}},
+		{"Only part of a word", relevanceTweet("concatsenate", nil, nil), nil},
+		{"Only in a link", relevanceTweet("look https://example.com/cats", nil, nil), nil},
+		{"Hashtag entity", relevanceTweet("what a strike", []string{"GOAL"}, nil), []string{"#goal"}},
+		{"Hashtag term needs a hashtag", relevanceTweet("goal!", nil, nil), nil},
+		{"Mention", relevanceTweet("hi", nil, []string{"clipbot"}), []string{"@ClipBot"}},
+		{"Phrase words in any order", relevanceTweet("The man made of iron", nil, nil), []string{"iron man"}},
+		{"Phrase needs every word", relevanceTweet("iron bars", nil, nil), nil},
+		{"Hyphenated term as a hashtag", relevanceTweet("wow", []string{"DogRates"}, nil), []string{"dog-rates"}},
+		{"Several terms", relevanceTweet("cats #goal", []string{"goal"}, nil), []string{"cats", "#goal"}},
+		{"Retweeted text", retweet, []string{"cats"}},
+		{"From a watched user", anaconda.Tweet{User: anaconda.User{Id: 42}}, []string{"@thecatreviewer"}},
+		{"Watched user without a screen name", anaconda.Tweet{User: anaconda.User{Id: 43}}, []string{"@43"}},
+		{"Reply to a watched user", reply, []string{"@thecatreviewer"}},
+	}
+
+	for _, test := range tests {
+		if result := matchedTerms(test.Status, terms, watched); !reflect.DeepEqual(result, test.Output) {
+			t.Errorf("%v: got %q, want %q", test.Explain, result, test.Output)
+		}
+	}
+}
+
+func TestParseTrackTerms(t *testing.T) {
+	terms := parseTrackTerms(" , #, @ ,cats")
+
+	if len(terms) != 1 || terms[0].term != "cats" {
+		t.Errorf("Expected only cats to be parsed, got %+v", terms)
+	}
+}
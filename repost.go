@@ -0,0 +1,108 @@
+// Canonical source resolution. When someone shares another user's video,
+// Twitter attaches the original tweet's ID to the media entity
+// (source_status_id) and points expanded_url at the original. Depending on
+// repost_policy, chim can retweet the original instead, so credit goes to
+// the creator rather than the re-poster.
+package main
+
+import (
+	"github.com/davidk/anaconda"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Values for settings.repost_policy
+const (
+	repostAllow          = "allow-reposts"
+	repostPreferOriginal = "prefer-original"
+	repostDeny           = "deny-reposts"
+)
+
+// repostSourceID returns the ID of the tweet the media in status was
+// originally posted in, or 0 if the media was uploaded with status itself
+func repostSourceID(status anaconda.Tweet) int64 {
+	for _, media := range tweetMediaEntities(status) {
+		if media.Source_status_id != 0 && media.Source_status_id != status.Id {
+			return media.Source_status_id
+		}
+
+		if id, err := strconv.ParseInt(media.Source_status_id_str, 10, 64); err == nil && id != 0 && id != status.Id {
+			return id
+		}
+
+		if id := statusIDFromURL(media.Expanded_url); id != 0 && id != status.Id {
+			return id
+		}
+	}
+
+	return 0
+}
+
+// statusIDFromURL extracts the tweet ID from a link such as
+// https://twitter.com/someone/status/1234/video/1. Returns 0 for links
+// that don't point at a tweet.
+func statusIDFromURL(link string) int64 {
+	u, err := url.Parse(link)
+	if err != nil {
+		return 0
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	if host != "twitter.com" && host != "mobile.twitter.com" && host != "x.com" {
+		return 0
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "status" || parts[i] == "statuses" {
+			if id, err := strconv.ParseInt(parts[i+1], 10, 64); err == nil {
+				return id
+			}
+		}
+	}
+
+	return 0
+}
+
+// Reasons recorded in the decision for resolveCanonicalSource's rejections
+var repostRejectReasons = map[string]string{
+	"repostDenied":              "tweet re-posts media from another tweet, and re-posts are denied",
+	"repostOriginalUnavailable": "the original tweet of the re-posted media couldn't be looked up",
+}
+
+// resolveCanonicalSource applies the repost policy to status. It returns
+// the tweet that should go through the rest of the pipeline (the original,
+// for prefer-original), the ID of the re-post it replaced (0 if none), and
+// a rejection label if the tweet should be dropped.
+func resolveCanonicalSource(a APIInterface, status anaconda.Tweet, policy string) (anaconda.Tweet, int64, string) {
+	sourceID := repostSourceID(status)
+	if sourceID == 0 {
+		return status, 0, ""
+	}
+
+	switch policy {
+	case repostDeny:
+		log.Infof("resolveCanonicalSource: REJECT - Tweet %v re-posts media from tweet %v", status.Id, sourceID)
+		return status, 0, "repostDenied"
+
+	case repostPreferOriginal:
+		v := url.Values{}
+		v.Set("tweet_mode", "extended")
+
+		original, err := a.GetTweet(sourceID, v)
+		if err != nil {
+			log.Warnf("resolveCanonicalSource: REJECT - Unable to look up original tweet %v of re-post %v: %v", sourceID, status.Id, err)
+			return status, 0, "repostOriginalUnavailable"
+		}
+
+		log.Infof("resolveCanonicalSource: OK - Tweet %v by %v re-posts tweet %v by %v. Checking the original instead.",
+			status.Id, status.User.ScreenName, original.Id, original.User.ScreenName)
+		return original, status.Id, ""
+
+	default:
+		log.Debugf("resolveCanonicalSource: OK - Tweet %v re-posts media from tweet %v, re-posts are allowed", status.Id, sourceID)
+		return status, 0, ""
+	}
+}
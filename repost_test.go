@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"github.com/davidk/anaconda"
+	"testing"
+)
+
+func TestStatusIDFromURL(t *testing.T) {
+
+	var tests = []struct {
+		Input  string
+		Output int64
+	}{
+		{"https://twitter.com/creator/status/77/video/1", 77},
+		{"https://mobile.twitter.com/creator/status/78?s=20", 78},
+		{"https://x.com/creator/status/79/photo/1", 79},
+		{"https://example.com/creator/status/80", 0},
+		{"https://twitter.com/creator", 0},
+		{"", 0},
+	}
+
+	for _, test := range tests {
+		if result := statusIDFromURL(test.Input); result != test.Output {
+			t.Errorf("statusIDFromURL(%q): wanted %v, got %v", test.Input, test.Output, result)
+		}
+	}
+}
+
+func TestRepostSourceID(t *testing.T) {
+
+	repost := func(media anaconda.EntityMedia) anaconda.Tweet {
+		status := anaconda.Tweet{Id: 100}
+		status.ExtendedEntities.Media = []anaconda.EntityMedia{media}
+		return status
+	}
+
+	var tests = []struct {
+		Name   string
+		Tweet  anaconda.Tweet
+		Output int64
+	}{
+		{"native upload", repost(anaconda.EntityMedia{Id_str: "1", Expanded_url: "https://twitter.com/me/status/100/video/1"}), 0},
+		{"source_status_id", repost(anaconda.EntityMedia{Id_str: "1", Source_status_id: 77}), 77},
+		{"source_status_id_str", repost(anaconda.EntityMedia{Id_str: "1", Source_status_id_str: "78"}), 78},
+		{"expanded_url", repost(anaconda.EntityMedia{Id_str: "1", Expanded_url: "https://twitter.com/creator/status/79/video/1"}), 79},
+		{"no media", anaconda.Tweet{Id: 100}, 0},
+	}
+
+	for _, test := range tests {
+		if result := repostSourceID(test.Tweet); result != test.Output {
+			t.Errorf("repostSourceID (%v): wanted %v, got %v", test.Name, test.Output, result)
+		}
+	}
+}
+
+func TestResolveCanonicalSource(t *testing.T) {
+
+	status := anaconda.Tweet{Id: 100, User: anaconda.User{ScreenName: "reposter"}}
+	status.ExtendedEntities.Media = []anaconda.EntityMedia{{Id_str: "1", Source_status_id: 77}}
+
+	original := anaconda.Tweet{Id: 77, User: anaconda.User{ScreenName: "creator"}}
+
+	found := FakeAPIRetweet{Response: original}
+	missing := FakeAPIRetweet{Error: errors.New("No status found with that ID")}
+
+	var tests = []struct {
+		Policy       string
+		API          APIInterface
+		Tweet        anaconda.Tweet
+		OutputID     int64
+		ResolvedFrom int64
+		Reject       string
+	}{
+		{"", found, status, 100, 0, ""},
+		{repostAllow, found, status, 100, 0, ""},
+		{repostDeny, found, status, 100, 0, "repostDenied"},
+		{repostPreferOriginal, found, status, 77, 100, ""},
+		{repostPreferOriginal, missing, status, 100, 0, "repostOriginalUnavailable"},
+		// Not a re-post, so no lookup (which would fail) happens
+		{repostPreferOriginal, missing, original, 77, 0, ""},
+		{repostDeny, missing, original, 77, 0, ""},
+	}
+
+	for _, test := range tests {
+		result, resolvedFrom, reject := resolveCanonicalSource(test.API, test.Tweet, test.Policy)
+		if result.Id != test.OutputID || resolvedFrom != test.ResolvedFrom || reject != test.Reject {
+			t.Errorf("resolveCanonicalSource(%v, %q): wanted (%v, %v, %q), got (%v, %v, %q)",
+				test.Tweet.Id, test.Policy, test.OutputID, test.ResolvedFrom, test.Reject, result.Id, resolvedFrom, reject)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Account reputation. Besides account age, throwaway and spam accounts
+// tend to have few followers, follow far more accounts than follow them,
+// have barely tweeted, keep the default avatar, or have just changed their
+// name. Each threshold is off unless configured, and every threshold an
+// account fails is reported with its own reason code.
+package main
+
+import (
+	"fmt"
+	"github.com/davidk/anaconda"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// Number of users whose names are remembered to spot name changes
+const defaultNameHistorySize = 4096
+
+// ReputationConfig sets the thresholds of the reputation check. Zero
+// values disable a threshold.
+type ReputationConfig struct {
+	MinFollowers      int     `json:"min_followers"`
+	MaxFollowingRatio float64 `json:"max_following_ratio"`
+	MinStatuses       int64   `json:"min_statuses"`
+
+	DenyDefaultProfileImage bool `json:"deny_default_profile_image"`
+	DenyProtected           bool `json:"deny_protected"`
+	RequireVerified         bool `json:"require_verified"`
+
+	// Verified accounts skip the follower, ratio, statuses and profile
+	// image thresholds
+	TrustVerified bool `json:"trust_verified"`
+
+	// Reject accounts whose screen name or display name changed less than
+	// this many hours ago. Only changes seen by the bot count.
+	MinHoursSinceNameChange int `json:"min_hours_since_name_change"`
+
+	// Users whose names are remembered (default 4096)
+	NameHistorySize int `json:"name_history_size"`
+}
+
+// NameRecord is what nameHistoryLRU remembers about a user
+type NameRecord struct {
+	ScreenName string
+	Name       string
+
+	// When the bot saw the name change (zero if it never has)
+	ChangedAt time.Time
+}
+
+// reputationFailure is a threshold an account failed
+type reputationFailure struct {
+	Code   string
+	Detail string
+}
+
+var (
+	// LRU: The names users had when we last saw them
+	nameHistoryLRU *StateCache
+
+	reputationFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "reputation_failures",
+			Help: "Reputation thresholds failed by tweet authors, by reason code.",
+		},
+		[]string{"reason"},
+	)
+)
+
+// enabled reports whether any threshold is set
+func (c ReputationConfig) enabled() bool {
+	return c.MinFollowers > 0 || c.MaxFollowingRatio > 0 || c.MinStatuses > 0 || c.DenyDefaultProfileImage ||
+		c.DenyProtected || c.RequireVerified || c.MinHoursSinceNameChange > 0
+}
+
+// recordName remembers the user's current names, and returns when they
+// were last seen to change (zero if never)
+func recordName(history *StateCache, u anaconda.User, now time.Time) time.Time {
+	record := NameRecord{ScreenName: u.ScreenName, Name: u.Name}
+
+	if previous, ok := history.Get(u.Id); ok {
+		prev := previous.(NameRecord)
+		record.ChangedAt = prev.ChangedAt
+
+		if !strings.EqualFold(prev.ScreenName, u.ScreenName) || prev.Name != u.Name {
+			log.Infof("recordName: %v [id: %v] was %v (%q), now %q", u.ScreenName, u.Id, prev.ScreenName, prev.Name, u.Name)
+			record.ChangedAt = now
+		}
+	}
+
+	history.Add(u.Id, record)
+
+	return record.ChangedAt
+}
+
+// checkReputation checks the author of a tweet against the reputation
+// thresholds, and returns every threshold it failed
+func checkReputation(status anaconda.Tweet, c ReputationConfig, history *StateCache, now time.Time) []reputationFailure {
+	u := status.User
+	var failures []reputationFailure
+
+	fail := func(code string, format string, v ...interface{}) {
+		failures = append(failures, reputationFailure{Code: code, Detail: fmt.Sprintf(format, v...)})
+	}
+
+	if c.DenyProtected && u.Protected {
+		fail("protected", "account is protected")
+	}
+
+	if c.RequireVerified && !u.Verified {
+		fail("notVerified", "account is not verified")
+	}
+
+	if !(c.TrustVerified && u.Verified) {
+		if c.MinFollowers > 0 && u.FollowersCount < c.MinFollowers {
+			fail("lowFollowers", "%d followers, fewer than %d", u.FollowersCount, c.MinFollowers)
+		}
+
+		if c.MaxFollowingRatio > 0 {
+			followers := u.FollowersCount
+			if followers < 1 {
+				followers = 1
+			}
+
+			if ratio := float64(u.FriendsCount) / float64(followers); ratio > c.MaxFollowingRatio {
+				fail("highFollowingRatio", "follows %d accounts with %d followers (ratio %.1f, above %.1f)", u.FriendsCount, u.FollowersCount, ratio, c.MaxFollowingRatio)
+			}
+		}
+
+		if c.MinStatuses > 0 && u.StatusesCount < c.MinStatuses {
+			fail("lowStatuses", "%d tweets, fewer than %d", u.StatusesCount, c.MinStatuses)
+		}
+
+		if c.DenyDefaultProfileImage && u.DefaultProfileImage {
+			fail("defaultProfileImage", "account has the default profile image")
+		}
+	}
+
+	if c.MinHoursSinceNameChange > 0 && history != nil {
+		changedAt := recordName(history, u, now)
+		window := time.Duration(c.MinHoursSinceNameChange) * time.Hour
+
+		if !changedAt.IsZero() && now.Sub(changedAt) < window {
+			fail("recentNameChange", "name changed %v ago, less than %v", now.Sub(changedAt).Round(time.Minute), window)
+		}
+	}
+
+	for _, f := range failures {
+		log.Infof("checkReputation: REJECT - %v [id: %v]: %v (%v)", u.ScreenName, u.Id, f.Code, f.Detail)
+	}
+
+	if len(failures) == 0 {
+		log.Println("checkReputation: OK")
+	}
+
+	return failures
+}
+
+// reputationReason summarizes failures for the decision, and counts them
+func reputationReason(failures []reputationFailure) string {
+	var reasons []string
+
+	for _, f := range failures {
+		reputationFailures.WithLabelValues(f.Code).Add(1)
+		reasons = append(reasons, f.Code+": "+f.Detail)
+	}
+
+	return strings.Join(reasons, "; ")
+}
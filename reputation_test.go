@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/davidk/anaconda"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckReputation(t *testing.T) {
+	c := ReputationConfig{
+		MinFollowers:            10,
+		MaxFollowingRatio:       20,
+		MinStatuses:             5,
+		DenyDefaultProfileImage: true,
+		DenyProtected:           true,
+		TrustVerified:           true,
+	}
+
+	established := anaconda.User{FollowersCount: 100, FriendsCount: 150, StatusesCount: 900}
+
+	var tests = []struct {
+		Explain string
+		User    anaconda.User
+		Config  ReputationConfig
+		Codes   []string
+	}{
+		{"Established account", established, c, nil},
+		{
+			"Fresh spam account fails every threshold",
+			anaconda.User{FollowersCount: 2, FriendsCount: 2000, StatusesCount: 1, DefaultProfileImage: true, Protected: true},
+			c,
+			[]string{"protected", "lowFollowers", "highFollowingRatio", "lowStatuses", "defaultProfileImage"},
+		},
+		{"No followers at all", anaconda.User{FriendsCount: 21, StatusesCount: 10}, c, []string{"lowFollowers", "highFollowingRatio"}},
+		{"Verified accounts are trusted", anaconda.User{Verified: true, FollowersCount: 1, DefaultProfileImage: true}, c, nil},
+		{"Verified accounts are still checked for protection", anaconda.User{Verified: true, Protected: true}, c, []string{"protected"}},
+		{"Verification required", established, ReputationConfig{RequireVerified: true}, []string{"notVerified"}},
+		{"Nothing configured", anaconda.User{Protected: true, DefaultProfileImage: true}, ReputationConfig{}, nil},
+	}
+
+	for _, test := range tests {
+		var codes []string
+		for _, f := range checkReputation(anaconda.Tweet{User: test.User}, test.Config, nil, time.Now()) {
+			codes = append(codes, f.Code)
+		}
+
+		if !reflect.DeepEqual(codes, test.Codes) {
+			t.Errorf("%v: got %v, want %v", test.Explain, codes, test.Codes)
+		}
+	}
+}
+
+func TestCheckReputationNameChange(t *testing.T) {
+	history := newStateCache("nameHistory", 16)
+	c := ReputationConfig{MinHoursSinceNameChange: 24}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	user := anaconda.User{Id: 1, ScreenName: "original", Name: "Original"}
+
+	var tests = []struct {
+		Explain string
+		Name    string
+		At      time.Time
+		Failed  bool
+	}{
+		{"First sighting, no change known", "original", now, false},
+		{"Same name", "original", now.Add(time.Hour), false},
+		{"Screen name changed", "rebrand", now.Add(2 * time.Hour), true},
+		{"Still within the window", "rebrand", now.Add(20 * time.Hour), true},
+		{"Window over", "rebrand", now.Add(27 * time.Hour), false},
+		{"Case changes don't count", "REBRAND", now.Add(28 * time.Hour), false},
+	}
+
+	for _, test := range tests {
+		user.ScreenName = test.Name
+		failures := checkReputation(anaconda.Tweet{User: user}, c, history, test.At)
+
+		if failed := len(failures) > 0; failed != test.Failed {
+			t.Errorf("%v: failed = %v, want %v (%v)", test.Explain, failed, test.Failed, failures)
+		}
+	}
+
+	// Display name changes count too
+	user.Name = "Totally Real Giveaways"
+	if failures := checkReputation(anaconda.Tweet{User: user}, c, history, now.Add(30*time.Hour)); len(failures) != 1 || failures[0].Code != "recentNameChange" {
+		t.Errorf("Display name change was not caught: %v", failures)
+	}
+}
+
+func TestReputationReason(t *testing.T) {
+	reason := reputationReason([]reputationFailure{{"lowFollowers", "2 followers, fewer than 10"}, {"protected", "account is protected"}})
+
+	if want := "lowFollowers: 2 followers, fewer than 10; protected: account is protected"; reason != want {
+		t.Errorf("Got %q, want %q", reason, want)
+	}
+}
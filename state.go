@@ -0,0 +1,311 @@
+// Snapshots of the anti-abuse LRUs, so a restart doesn't hand spammers a
+// clean slate. The bot was designed to keep disk writes to a minimum, so
+// snapshots are only written on an interval, and only if something has
+// changed since the last one.
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/davidk/lru"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultSnapshotIntervalSeconds = 300
+	defaultStateMaxAgeSeconds      = 86400
+)
+
+// StateConfig configures the state snapshot file
+type StateConfig struct {
+	File                    string `json:"file"`
+	SnapshotIntervalSeconds int    `json:"snapshot_interval_seconds"`
+	MaxAgeSeconds           int    `json:"max_age_seconds"`
+}
+
+// stateEntry is a cache entry, with the time it was last added/updated
+type stateEntry struct {
+	Key     interface{}
+	Value   interface{}
+	AddedAt time.Time
+	Seq     uint64
+}
+
+// StateCache is an LRU whose contents can be snapshotted. lru.Cache can't
+// be iterated, so a mirror of its entries is kept alongside it. Get is
+// passed straight through; everything that changes the cache has to hold
+// the StateCache lock so that evictions can update the mirror.
+type StateCache struct {
+	*lru.Cache
+	Name string
+
+	entries map[interface{}]stateEntry
+	seq     uint64
+	dirty   bool
+	sync.Mutex
+}
+
+// stateSnapshot is the on-disk format, keyed on StateCache.Name
+type stateSnapshot struct {
+	SavedAt time.Time
+	Caches  map[string][]stateEntry
+}
+
+var (
+	// Caches that are written to the snapshot file
+	stateCaches []*StateCache
+
+	stateLock sync.Mutex
+)
+
+func init() {
+	// Concrete types that are stored in the caches as interface{}
+	gob.Register(time.Time{})
+	gob.Register(ContentDelta{})
+	gob.Register(FollowCacheKey{})
+	gob.Register(NameRecord{})
+}
+
+// newStateCache creates a named LRU that is included in state snapshots
+func newStateCache(name string, maxEntries int) *StateCache {
+	c := &StateCache{
+		Cache:   lru.New(maxEntries),
+		Name:    name,
+		entries: make(map[interface{}]stateEntry),
+	}
+
+	// Only called from Add/Remove/Clear below, which hold c's lock
+	c.Cache.OnEvicted = func(key lru.Key, value interface{}) {
+		delete(c.entries, key)
+		c.dirty = true
+	}
+
+	return c
+}
+
+// Add adds a value to the cache
+func (c *StateCache) Add(key lru.Key, value interface{}) {
+	c.add(key, value, time.Now())
+}
+
+func (c *StateCache) add(key lru.Key, value interface{}, addedAt time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.seq++
+	c.Cache.Add(key, value)
+	c.entries[key] = stateEntry{Key: key, Value: value, AddedAt: addedAt, Seq: c.seq}
+	c.dirty = true
+}
+
+// Remove removes a key from the cache
+func (c *StateCache) Remove(key lru.Key) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.Cache.Remove(key)
+	delete(c.entries, key)
+	c.dirty = true
+}
+
+// Clear empties the cache
+func (c *StateCache) Clear() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.Cache.Clear()
+	c.entries = make(map[interface{}]stateEntry)
+	c.dirty = true
+}
+
+// Each calls fn for every entry, oldest first, until fn returns false.
+// fn is called on a copy of the entries, so it may use the cache.
+func (c *StateCache) Each(fn func(key interface{}, value interface{}, addedAt time.Time) bool) {
+	c.Lock()
+	entries := make([]stateEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	c.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+
+	for _, e := range entries {
+		if !fn(e.Key, e.Value, e.AddedAt) {
+			return
+		}
+	}
+}
+
+// snapshot returns the entries oldest first, and whether the cache has
+// changed since the last snapshot. It clears the dirty flag.
+func (c *StateCache) snapshot() ([]stateEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entries := make([]stateEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+
+	dirty := c.dirty
+	c.dirty = false
+
+	return entries, dirty
+}
+
+// restore re-adds entries oldest first, so the most recently used end up
+// at the front of the LRU. Entries older than maxAge are dropped.
+func (c *StateCache) restore(entries []stateEntry, maxAge time.Duration, now time.Time) int {
+	restored := 0
+
+	for _, e := range entries {
+		if maxAge > 0 && now.Sub(e.AddedAt) > maxAge {
+			continue
+		}
+		c.add(e.Key, e.Value, e.AddedAt)
+		restored++
+	}
+
+	c.Lock()
+	c.dirty = false
+	c.Unlock()
+
+	return restored
+}
+
+// saveStateSnapshot writes every cache to path, if any of them changed.
+// Returns true if a snapshot was written.
+func saveStateSnapshot(path string, caches []*StateCache) (bool, error) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	snap := stateSnapshot{SavedAt: time.Now().UTC(), Caches: make(map[string][]stateEntry)}
+	dirty := false
+
+	for _, c := range caches {
+		entries, changed := c.snapshot()
+		snap.Caches[c.Name] = entries
+		dirty = dirty || changed
+	}
+
+	if !dirty {
+		return false, nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snap); err != nil {
+		markStateDirty(caches)
+		return false, err
+	}
+
+	if err := writeFileAtomic(path, buf.Bytes(), 0600); err != nil {
+		markStateDirty(caches)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// markStateDirty makes sure a failed snapshot is retried on the next tick
+func markStateDirty(caches []*StateCache) {
+	for _, c := range caches {
+		c.Lock()
+		c.dirty = true
+		c.Unlock()
+	}
+}
+
+// loadStateSnapshot restores caches from path. A missing file is not an
+// error (first run). maxAge returns how old an entry of a given cache
+// may be before it is dropped instead of restored.
+func loadStateSnapshot(path string, caches []*StateCache, maxAge func(name string) time.Duration) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Infof("loadStateSnapshot: No snapshot at %v yet. Starting with empty caches.", path)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var snap stateSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snap); err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, c := range caches {
+		restored := c.restore(snap.Caches[c.Name], maxAge(c.Name), now)
+		log.Infof("loadStateSnapshot: Restored %d/%d entries into %v (snapshot from %v)", restored, len(snap.Caches[c.Name]), c.Name, snap.SavedAt)
+	}
+
+	return nil
+}
+
+// stateMaxAge picks how long entries of each cache stay relevant. The
+// delta caches are only useful for as long as their configured delta, and
+// post text for as long as the near-duplicate window; everything else uses
+// max_age_seconds.
+func stateMaxAge(name string) time.Duration {
+	maxAge := config.State.MaxAgeSeconds
+	if maxAge <= 0 {
+		maxAge = defaultStateMaxAgeSeconds
+	}
+
+	switch name {
+	case "userPostDelta":
+		maxAge = config.Settings.PostTimeDelta
+	case "userContentDelta":
+		maxAge = config.Settings.ContentTimeDelta
+	case "postText":
+		maxAge = config.Settings.NearDuplicateText.withDefaults().WindowSeconds
+	case "nameHistory":
+		// Names are only useful as long as they are remembered, the
+		// name change window just has to fit
+		if window := config.Settings.Reputation.MinHoursSinceNameChange * 3600; window > maxAge {
+			maxAge = window
+		}
+	}
+
+	return time.Duration(maxAge) * time.Second
+}
+
+// runStateSnapshots periodically writes dirty caches to the snapshot
+// file, and writes a final one when the bot is asked to stop
+func runStateSnapshots(c StateConfig, caches []*StateCache) {
+	interval := c.SnapshotIntervalSeconds
+	if interval <= 0 {
+		interval = defaultSnapshotIntervalSeconds
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			if wrote, err := saveStateSnapshot(c.File, caches); err != nil {
+				log.Errorf("runStateSnapshots: Unable to write snapshot: %v", err)
+			} else if wrote {
+				log.Debugf("runStateSnapshots: Wrote snapshot to %v", c.File)
+			}
+		case sig := <-stop:
+			log.Infof("runStateSnapshots: Got %v. Writing a final snapshot before exiting.", sig)
+			if _, err := saveStateSnapshot(c.File, caches); err != nil {
+				log.Errorf("runStateSnapshots: Unable to write snapshot: %v", err)
+			}
+			os.Exit(0)
+		}
+	}
+}
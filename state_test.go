@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestStateSnapshot round-trips a set of caches through a snapshot file,
+// checking that stale entries are aged out and that unchanged caches
+// don't cause a write
+func TestStateSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.gob")
+
+	posts := newStateCache("userPostDelta", 2)
+	content := newStateCache("userContentDelta", 10)
+	text := newStateCache("postText", 10)
+
+	posts.Add(int64(1), time.Now())
+	posts.Add(int64(2), time.Now())
+	posts.Add(int64(3), time.Now()) // evicts 1
+	content.Add(ContentDelta{User: 3, ContentType: "gif"}, time.Now())
+	text.add("old news", 1, time.Now().Add(-2*time.Hour))
+	text.Add("I have cake!", 1)
+
+	caches := []*StateCache{posts, content, text}
+
+	if wrote, err := saveStateSnapshot(path, caches); err != nil || !wrote {
+		t.Fatalf("Expected a snapshot to be written (wrote: %v, err: %v)", wrote, err)
+	}
+
+	info, _ := os.Stat(path)
+
+	// Nothing changed, so nothing should be written
+	if wrote, err := saveStateSnapshot(path, caches); err != nil || wrote {
+		t.Errorf("Clean caches were written again (wrote: %v, err: %v)", wrote, err)
+	}
+
+	if again, _ := os.Stat(path); !again.ModTime().Equal(info.ModTime()) {
+		t.Error("Snapshot file was touched without changes")
+	}
+
+	restoredPosts := newStateCache("userPostDelta", 2)
+	restoredContent := newStateCache("userContentDelta", 10)
+	restoredText := newStateCache("postText", 10)
+
+	maxAge := func(name string) time.Duration { return time.Hour }
+
+	if err := loadStateSnapshot(path, []*StateCache{restoredPosts, restoredContent, restoredText}, maxAge); err != nil {
+		t.Fatalf("loadStateSnapshot: %v", err)
+	}
+
+	if _, ok := restoredPosts.Get(int64(1)); ok {
+		t.Error("Evicted entry came back from the snapshot")
+	}
+
+	for _, id := range []int64{2, 3} {
+		if v, ok := restoredPosts.Get(id); !ok {
+			t.Errorf("User %v was not restored", id)
+		} else if _, isTime := v.(time.Time); !isTime {
+			t.Errorf("User %v restored with the wrong type: %T", id, v)
+		}
+	}
+
+	if _, ok := restoredContent.Get(ContentDelta{User: 3, ContentType: "gif"}); !ok {
+		t.Error("Content delta entry was not restored")
+	}
+
+	if _, ok := restoredText.Get("I have cake!"); !ok {
+		t.Error("Recent post text was not restored")
+	}
+
+	if _, ok := restoredText.Get("old news"); ok {
+		t.Error("Stale post text should have been aged out")
+	}
+
+	// A missing snapshot is a first run, not an error
+	if err := loadStateSnapshot(path+".missing", caches, maxAge); err != nil {
+		t.Errorf("Missing snapshot returned an error: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+// Search term attribution. Every tweet is tagged with the search terms or
+// watched user that brought it in (see relevance.go), and its verdict is
+// counted by term, so `chim report` can rank terms by how many of their
+// tweets get approved and noisy terms can be pruned.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// The term of tweets that didn't really match any search term or watched
+// user (Twitter matched a link, a display name, ...)
+const unmatchedTerm = "(unmatched)"
+
+// Where `chim report` reads metrics from by default
+const defaultMetricsURL = "http://127.0.0.1:8080/metrics"
+
+var tweetsByTerm = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "tweets_by_term",
+		Help: "Tweets allowed or rejected, by the search term or watched user that brought them in.",
+	},
+	[]string{"term", "verdict"},
+)
+
+// countTermVerdict counts a verdict for each term a decision matched
+func countTermVerdict(d *Decision, verdict string) {
+	terms := d.MatchedTerms
+	if len(terms) == 0 {
+		terms = []string{unmatchedTerm}
+	}
+
+	for _, term := range terms {
+		tweetsByTerm.WithLabelValues(term, verdict).Add(1)
+	}
+}
+
+// TermStats is the number of tweets a term brought in, and how many of
+// them were allowed
+type TermStats struct {
+	Term     string
+	Allowed  float64
+	Rejected float64
+}
+
+// Total is the number of tweets the term brought in
+func (s TermStats) Total() float64 {
+	return s.Allowed + s.Rejected
+}
+
+// ApprovalRate is the share of the term's tweets that were allowed
+func (s TermStats) ApprovalRate() float64 {
+	if s.Total() == 0 {
+		return 0
+	}
+	return s.Allowed / s.Total()
+}
+
+// readTermStats reads tweets_by_term from metrics in the Prometheus text
+// format. Every term in terms is listed, even with no tweets.
+func readTermStats(r io.Reader, terms []string) ([]TermStats, error) {
+	var parser expfmt.TextParser
+
+	families, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, err
+	}
+
+	byTerm := make(map[string]*TermStats)
+	for _, term := range terms {
+		byTerm[term] = &TermStats{Term: term}
+	}
+
+	if family, ok := families["tweets_by_term"]; ok {
+		for _, m := range family.GetMetric() {
+			var term, verdict string
+			for _, label := range m.GetLabel() {
+				switch label.GetName() {
+				case "term":
+					term = label.GetValue()
+				case "verdict":
+					verdict = label.GetValue()
+				}
+			}
+
+			s, ok := byTerm[term]
+			if !ok {
+				s = &TermStats{Term: term}
+				byTerm[term] = s
+			}
+
+			switch verdict {
+			case "allow":
+				s.Allowed += m.GetCounter().GetValue()
+			case "reject":
+				s.Rejected += m.GetCounter().GetValue()
+			}
+		}
+	}
+
+	stats := make([]TermStats, 0, len(byTerm))
+	for _, s := range byTerm {
+		stats = append(stats, *s)
+	}
+
+	return stats, nil
+}
+
+// rankTermStats sorts terms by approval rate, then by number of tweets,
+// best first
+func rankTermStats(stats []TermStats) {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].ApprovalRate() != stats[j].ApprovalRate() {
+			return stats[i].ApprovalRate() > stats[j].ApprovalRate()
+		}
+		if stats[i].Total() != stats[j].Total() {
+			return stats[i].Total() > stats[j].Total()
+		}
+		return stats[i].Term < stats[j].Term
+	})
+}
+
+// writeTermReport writes a table of ranked terms
+func writeTermReport(w io.Writer, stats []TermStats) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "TERM\tTWEETS\tALLOWED\tREJECTED\tAPPROVAL\t")
+
+	for _, s := range stats {
+		fmt.Fprintf(tw, "%v\t%.0f\t%.0f\t%.0f\t%.1f%%\t\n", s.Term, s.Total(), s.Allowed, s.Rejected, 100*s.ApprovalRate())
+	}
+
+	return tw.Flush()
+}
+
+// runReport runs `chim report`: it reads the metrics of a running bot and
+// ranks the search terms and watched users by approval rate
+func runReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	metricsURL := fs.String("metrics", defaultMetricsURL, "Metrics endpoint of the running bot")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	resp, err := http.Get(*metricsURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %v", *metricsURL, resp.Status)
+	}
+
+	var terms []string
+	for _, t := range parseTrackTerms(config.SearchTerms) {
+		terms = append(terms, t.term)
+	}
+
+	stats, err := readTermStats(resp.Body, terms)
+	if err != nil {
+		return fmt.Errorf("%v: %v", *metricsURL, err)
+	}
+
+	rankTermStats(stats)
+
+	return writeTermReport(os.Stdout, stats)
+}
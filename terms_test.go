@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+)
+
+func TestCountTermVerdict(t *testing.T) {
+	before := testutil.ToFloat64(tweetsByTerm.WithLabelValues("cats", "allow"))
+	unmatched := testutil.ToFloat64(tweetsByTerm.WithLabelValues(unmatchedTerm, "reject"))
+
+	countTermVerdict(&Decision{MatchedTerms: []string{"cats", "#goal"}}, "allow")
+	countTermVerdict(&Decision{}, "reject")
+
+	if got := testutil.ToFloat64(tweetsByTerm.WithLabelValues("cats", "allow")) - before; got != 1 {
+		t.Errorf("Expected cats to count 1 allowed tweet, got %v", got)
+	}
+
+	if got := testutil.ToFloat64(tweetsByTerm.WithLabelValues(unmatchedTerm, "reject")) - unmatched; got != 1 {
+		t.Errorf("Expected an unmatched rejection to be counted, got %v", got)
+	}
+}
+
+func TestTermReport(t *testing.T) {
+	metrics := `# HELP tweets_by_term Tweets allowed or rejected, by the search term or watched user that brought them in.
+# TYPE tweets_by_term counter
+tweets_by_term{term="cats",verdict="allow"} 3
+tweets_by_term{term="cats",verdict="reject"} 1
+tweets_by_term{term="#goal",verdict="reject"} 9
+tweets_by_term{term="#goal",verdict="allow"} 1
+tweets_by_term{term="@thecatreviewer",verdict="allow"} 2
+tweets_by_term{term="(unmatched)",verdict="reject"} 5
+# HELP tweets_processed Number of tweets processed.
+# TYPE tweets_processed counter
+tweets_processed{check="total",status=""} 25
+`
+
+	stats, err := readTermStats(strings.NewReader(metrics), []string{"cats", "#goal", "dogs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rankTermStats(stats)
+
+	var ranked []string
+	for _, s := range stats {
+		ranked = append(ranked, s.Term)
+	}
+
+	want := "@thecatreviewer cats #goal (unmatched) dogs"
+	if strings.Join(ranked, " ") != want {
+		t.Errorf("Expected terms ranked as %q, got %q", want, strings.Join(ranked, " "))
+	}
+
+	if stats[1].Allowed != 3 || stats[1].Rejected != 1 || stats[1].ApprovalRate() != 0.75 {
+		t.Errorf("Unexpected stats for cats: %+v", stats[1])
+	}
+
+	var report strings.Builder
+	if err := writeTermReport(&report, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(report.String()), "\n")
+	if len(lines) != 6 || !strings.Contains(lines[2], "75.0%") {
+		t.Errorf("Unexpected report:\n%v", report.String())
+	}
+
+	if _, err := readTermStats(strings.NewReader("not metrics {"), nil); err == nil {
+		t.Error("Expected an error for malformed metrics")
+	}
+}
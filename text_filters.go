@@ -4,32 +4,46 @@
 package main
 
 import (
+	"fmt"
 	"github.com/davidk/anaconda"
 	"github.com/davidk/memberset"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"regexp"
+	"strconv"
 	"strings"
+	"unicode"
 )
 
+// Screen names are looked up 100 at a time (the users/lookup limit)
+const usersLookupBatch = 100
+
 // filterMentions ingests all the mentions parsed by Twitter and
 // checks them against a set for membership. Tweets fail this test
-// if they are in the set.
+// if they are in the set. The set holds user IDs (int64), resolved by
+// resolveProhibitedMentions so renamed accounts are still caught, and
+// lowercased screen names for accounts that couldn't be resolved.
 func checkForProhibitedMentions(status anaconda.Tweet, filteredMentions *memberset.MemberSet) bool {
 
-	for _, mention := range status.ExtendedTweet.ExtendedEntities.User_mentions {
-		log.Println(mention.Screen_name)
-		log.Printf("%+v\n", mention)
-		if filteredMentions.Get(strings.ToLower(mention.Screen_name)) {
-			log.Println("checkForProhibitedMentionsExtended: REJECT - Filtering on screen_name in mention:", mention.Screen_name)
-			return false
-		}
-	}
+	for _, entities := range []anaconda.Entities{
+		status.Entities,
+		status.ExtendedEntities,
+		status.ExtendedTweet.Entities,
+		status.ExtendedTweet.ExtendedEntities,
+	} {
+		for _, mention := range entities.User_mentions {
+			log.Debugf("checkForProhibitedMentions: %+v", mention)
 
-	for _, mention := range status.Entities.User_mentions {
-		log.Println(mention.Screen_name)
-		log.Printf("%+v\n", mention)
-		if filteredMentions.Get(strings.ToLower(mention.Screen_name)) {
-			log.Println("checkForProhibitedMentions: REJECT - Filtering on screen_name in mention:", mention.Screen_name)
-			return false
+			if mention.Id != 0 && filteredMentions.Get(mention.Id) {
+				log.Printf("checkForProhibitedMentions: REJECT - Filtering on user ID in mention: %v [id: %v]", mention.Screen_name, mention.Id)
+				return false
+			}
+
+			if filteredMentions.Get(strings.ToLower(mention.Screen_name)) {
+				log.Println("checkForProhibitedMentions: REJECT - Filtering on screen_name in mention:", mention.Screen_name)
+				return false
+			}
 		}
 	}
 
@@ -38,19 +52,221 @@ func checkForProhibitedMentions(status anaconda.Tweet, filteredMentions *members
 
 }
 
-// filterText loosely checks the text's words for anything that might
-// not be entirely permissible.
-// True  -- is passing for this test
-// False -- means that a prohibited word was found
-func checkForProhibitedWords(status anaconda.Tweet, filteredWords *memberset.MemberSet) bool {
+// loadProhibitedMentions fills the prohibited mention set from the
+// configuration: "id:1234" entries are user IDs, anything else is a screen
+// name. Returns the screen names, to be resolved to IDs.
+func loadProhibitedMentions(entries []string, filteredMentions *memberset.MemberSet) []string {
+	var names []string
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+
+		if strings.HasPrefix(entry, "id:") {
+			id, err := strconv.ParseInt(strings.TrimPrefix(entry, "id:"), 10, 64)
+			if err != nil {
+				log.Warnf("loadProhibitedMentions: Ignoring invalid user ID %q", entry)
+				continue
+			}
+			filteredMentions.Add(id)
+			continue
+		}
+
+		if name := strings.ToLower(strings.TrimPrefix(entry, "@")); name != "" {
+			filteredMentions.Add(name)
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// resolveProhibitedMentions looks up the user IDs of prohibited screen
+// names, so mentions are still caught after a rename. A resolved name is
+// dropped from the set, as whoever takes the name next isn't prohibited;
+// names that can't be resolved keep being matched by screen name.
+func resolveProhibitedMentions(a APIInterface, names []string, filteredMentions *memberset.MemberSet) {
+	for start := 0; start < len(names); start += usersLookupBatch {
+		end := start + usersLookupBatch
+		if end > len(names) {
+			end = len(names)
+		}
+
+		users, err := a.GetUsersLookup(strings.Join(names[start:end], ","), nil)
+		if err != nil {
+			log.Errorf("resolveProhibitedMentions: Unable to look up user IDs, matching screen names only: %v", err)
+			continue
+		}
+
+		for _, u := range users {
+			filteredMentions.Add(u.Id)
+			filteredMentions.Delete(strings.ToLower(u.ScreenName))
+			log.Printf("resolveProhibitedMentions: Filtering mentions of %v [id: %v]", u.ScreenName, u.Id)
+		}
+	}
+}
+
+// ProhibitedTerms is the compiled form of prohibited_words and
+// prohibited_patterns. Words and phrases match whole words of the folded
+// text (see foldText); patterns are regular expressions run over it.
+//
+// Words and phrases are compiled into one Aho-Corasick automaton, which
+// scans the folded words of a text (joined by single spaces) for " term ".
+// The spaces keep matches to whole words. Patterns are joined into one
+// regular expression, so a text is scanned once by each.
+type ProhibitedTerms struct {
+	automaton *ahoCorasick
+
+	// The configured term of each automaton pattern
+	terms []string
+
+	// All patterns as one alternation, and each on its own to tell which
+	// one matched
+	anyPattern *regexp.Regexp
+	patterns   []*regexp.Regexp
+}
+
+// confusables maps letters that look like Latin ones (mostly Cyrillic and
+// Greek) to the Latin letter, after case folding. NFKC already takes care
+// of fullwidth and mathematical alphanumerics.
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c',
+	'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ї': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't',
+	'υ': 'u', 'χ': 'x', 'ѵ': 'v', 'ɑ': 'a', 'ɡ': 'g', 'ı': 'i', 'ȷ': 'j', 'ⅼ': 'l',
+}
+
+// foldText applies NFKC and case folding, maps confusable letters to
+// Latin ones and drops invisible formatting characters (zero width
+// spaces and joiners), so lookalike spellings compare equal
+func foldText(text string) string {
+	folded := cases.Fold().String(norm.NFKC.String(text))
+
+	return strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		if c, ok := confusables[r]; ok {
+			return c
+		}
+		return r
+	}, folded)
+}
+
+// textTokens splits folded text into words of letters and numbers
+func textTokens(folded string) []string {
+	return strings.FieldsFunc(folded, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.Is(unicode.Mn, r)
+	})
+}
+
+// compileProhibitedTerms compiles prohibited words/phrases and patterns.
+// Blank entries are ignored.
+func compileProhibitedTerms(words []string, patterns []string) (*ProhibitedTerms, error) {
+	p := &ProhibitedTerms{}
+	var keys []string
+
+	for _, term := range words {
+		tokens := textTokens(foldText(term))
+		if len(tokens) == 0 {
+			continue
+		}
+
+		keys = append(keys, " "+strings.Join(tokens, " ")+" ")
+		p.terms = append(p.terms, term)
+
+		// Phrases also match as a single word, so #BuyFollowers matches
+		// "buy followers"
+		if len(tokens) > 1 {
+			keys = append(keys, " "+strings.Join(tokens, "")+" ")
+			p.terms = append(p.terms, term)
+		}
+	}
+
+	if len(keys) > 0 {
+		p.automaton = newAhoCorasick(keys)
+	}
+
+	var alternatives []string
+
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("prohibited pattern %q: %v", pattern, err)
+		}
+		p.patterns = append(p.patterns, re)
+		alternatives = append(alternatives, "(?:"+pattern+")")
+	}
+
+	if len(alternatives) > 0 {
+		p.anyPattern = regexp.MustCompile("(?i)" + strings.Join(alternatives, "|"))
+	}
+
+	return p, nil
+}
+
+// Match looks for a prohibited term in any of texts, and returns the
+// configured term (or pattern) that matched
+func (p *ProhibitedTerms) Match(texts []string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+
+	for _, text := range texts {
+		folded := foldText(text)
+
+		if p.automaton != nil {
+			if i := p.automaton.FindFirst(" " + strings.Join(textTokens(folded), " ") + " "); i >= 0 {
+				return p.terms[i], true
+			}
+		}
+
+		if p.anyPattern != nil && p.anyPattern.MatchString(folded) {
+			for _, re := range p.patterns {
+				if re.MatchString(folded) {
+					return re.String()[len("(?i)"):], true
+				}
+			}
+		}
+	}
+
+	return "", false
+}
 
-	for _, word := range strings.Split(status.Text, " ") {
-		if word != "" && filteredWords.Get(word) {
-			log.Printf("checkForProhibitedWords: REJECT - Found prohibited word '%v' in text: %v", word, status.ExtendedTweet.FullText)
-			return false
+// tweetTextFields returns the parts of a tweet that text filters look at:
+// the full text, hashtags and expanded URLs
+func tweetTextFields(status anaconda.Tweet) []string {
+	fields := []string{tweetFullText(status)}
+
+	for _, entities := range []anaconda.Entities{status.Entities, status.ExtendedTweet.Entities} {
+		for _, hashtag := range entities.Hashtags {
+			fields = append(fields, hashtag.Text)
+		}
+
+		for _, u := range entities.Urls {
+			if u.Expanded_url != "" {
+				fields = append(fields, u.Expanded_url)
+			}
 		}
 	}
 
+	return fields
+}
+
+// checkForProhibitedWords looks for prohibited words, phrases and patterns
+// in the tweet's full text, hashtags and expanded URLs.
+// True  -- is passing for this test
+// False -- means that a prohibited term was found
+func checkForProhibitedWords(status anaconda.Tweet, terms *ProhibitedTerms) bool {
+
+	if term, ok := terms.Match(tweetTextFields(status)); ok {
+		log.Printf("checkForProhibitedWords: REJECT - Found prohibited term '%v' in tweet: %v", term, tweetFullText(status))
+		return false
+	}
+
 	log.Println("checkForProhibitedWords: OK")
 	return true
 
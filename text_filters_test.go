@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"github.com/davidk/anaconda"
 	"github.com/davidk/memberset"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net/url"
 	"testing"
 )
 
@@ -110,42 +114,219 @@ func TestCheckForProhibitedMentions(t *testing.T) {
 
 }
 
-func TestCheckForProhibitedWords(t *testing.T) {
-	var prohibitedWordsTest *memberset.MemberSet = memberset.New()
+// FakeUsersLookup resolves only @Cake, to 12345
+type FakeUsersLookup struct {
+	FakeAPIRetweet
+}
+
+func (f FakeUsersLookup) GetUsersLookup(usernames string, v url.Values) ([]anaconda.User, error) {
+	return []anaconda.User{{Id: 12345, ScreenName: "Cake"}}, nil
+}
+
+func TestCheckForProhibitedMentionsByID(t *testing.T) {
+	mentions := memberset.New()
+	names := loadProhibitedMentions([]string{"@Cake", "@ghost", "id:42", "id:nope", " "}, mentions)
 
-	// note: "dog in the iron" is an invalid entry
-	// prohibitedWords is limited in scope only to filter words,
-	// and should not attempt lexical analysis (should be reserved for
-	// higher-level code)
-	for _, entries := range []string{"potassium", "cat", "dog in the iron", "woods", ""} {
-		prohibitedWordsTest.Add(entries)
+	if len(names) != 2 || names[0] != "cake" || names[1] != "ghost" {
+		t.Errorf("Expected [cake ghost] to resolve, got %v", names)
 	}
 
-	// Expected result: True, pass
-	result := checkForProhibitedWords(anaconda.Tweet{Text: "waffle"}, prohibitedWords)
+	resolveProhibitedMentions(FakeUsersLookup{}, names, mentions)
+
+	mention := func(name string, id int64) anaconda.Tweet {
+		var status anaconda.Tweet
+		status.Entities.User_mentions = append(status.Entities.User_mentions, struct {
+			Name        string
+			Indices     []int
+			Screen_name string
+			Id          int64
+			Id_str      string
+		}{Screen_name: name, Id: id})
+		return status
+	}
+
+	var tests = []struct {
+		Explain string
+		Status  anaconda.Tweet
+		Output  bool
+	}{
+		{"Configured ID", mention("someone", 42), false},
+		{"Resolved ID after a rename", mention("notcake", 12345), false},
+		{"Resolved screen name, taken by someone else", mention("CAKE", 1), true},
+		{"Unresolved screen name", mention("Ghost", 2), false},
+		{"Other user", mention("pie", 7), true},
+	}
+
+	for _, test := range tests {
+		if result := checkForProhibitedMentions(test.Status, mentions); result != test.Output {
+			t.Errorf("%v: got %v, want %v", test.Explain, result, test.Output)
+		}
+	}
+}
+
+func TestCheckForProhibitedWords(t *testing.T) {
+	prohibitedWordsTest, err := compileProhibitedTerms(
+		[]string{"potassium", "cat", "dog in the iron", "buy followers", "woods", ""},
+		[]string{`free\s*v-?bucks`, ""},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expected result: True, pass. No terms configured.
+	result := checkForProhibitedWords(anaconda.Tweet{Text: "waffle"}, nil)
 
 	if !result {
 		t.Error("Check for prohibited words returned false when we wanted true.")
 	}
 
-	// Expected result: True, pass
-	result = checkForProhibitedWords(anaconda.Tweet{Text: "dog in the iron"}, prohibitedWordsTest)
+	var tests = []struct {
+		Explain string
+		Tweet   anaconda.Tweet
+		Output  bool
+	}{
+		{"Plain word", anaconda.Tweet{Text: "cat"}, false},
+		{"Word is matched whole", anaconda.Tweet{Text: "concatenate the category"}, true},
+		{"Capitals and punctuation", anaconda.Tweet{Text: "Look at this CAT!!!"}, false},
+		{"Line breaks", anaconda.Tweet{Text: "look\nat\nthis\ncat"}, false},
+		{"Fullwidth letters (NFKC)", anaconda.Tweet{Text: "ｃａｔ video"}, false},
+		{"Cyrillic lookalikes", anaconda.Tweet{Text: "\u0441\u0430t video"}, false},
+		{"Zero width space", anaconda.Tweet{Text: "c\u200bat video"}, false},
+		{"Phrase", anaconda.Tweet{Text: "the dog in the iron, again"}, false},
+		{"Phrase words out of order", anaconda.Tweet{Text: "the iron in the dog"}, true},
+		{"Phrase as a hashtag", anaconda.Tweet{Text: "#BuyFollowers now"}, false},
+		{"Pattern", anaconda.Tweet{Text: "FREE VBucks here"}, false},
+		{"Pattern with a dash", anaconda.Tweet{Text: "free v-bucks"}, false},
+		{"Empty text", anaconda.Tweet{Text: ""}, true},
+		{
+			"Full text past 140 characters",
+			anaconda.Tweet{Text: "a long tweet…", ExtendedTweet: anaconda.ExtendedTweet{FullText: "a long tweet that ends with potassium"}},
+			false,
+		},
+		{
+			"Hashtag entity",
+			tweetWithHashtag("Woods"),
+			false,
+		},
+		{
+			"Expanded URL",
+			tweetWithURL("https://t.co/x", "https://example.com/cat/pics"),
+			false,
+		},
+		{
+			"Clean tweet with entities",
+			tweetWithURL("https://t.co/x", "https://example.com/dogs"),
+			true,
+		},
+	}
 
-	if !result {
-		t.Error("ProhibitedWords should only filter on individual words, but a full set of text is being blocked")
+	for _, test := range tests {
+		if result := checkForProhibitedWords(test.Tweet, prohibitedWordsTest); result != test.Output {
+			t.Errorf("%v: got %v, want %v", test.Explain, result, test.Output)
+		}
 	}
+}
 
-	// Expected result: False, fail
-	result = checkForProhibitedWords(anaconda.Tweet{Text: "cat"}, prohibitedWordsTest)
+func TestCompileProhibitedTermsInvalidPattern(t *testing.T) {
+	if _, err := compileProhibitedTerms(nil, []string{"(unclosed"}); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
 
-	if result {
-		t.Error("ProhibitedWords failed to block the word cat (listed in the test)")
+// tweetWithHashtag returns a tweet with a hashtag entity
+func tweetWithHashtag(tag string) anaconda.Tweet {
+	var status anaconda.Tweet
+	status.Text = "look"
+	status.Entities.Hashtags = append(status.Entities.Hashtags, struct {
+		Indices []int
+		Text    string
+	}{Text: tag})
+	return status
+}
+
+// tweetWithURL returns a tweet with a URL entity
+func tweetWithURL(short string, expanded string) anaconda.Tweet {
+	var status anaconda.Tweet
+	status.Text = "look " + short
+	status.Entities.Urls = append(status.Entities.Urls, struct {
+		Indices      []int
+		Url          string
+		Display_url  string
+		Expanded_url string
+	}{Url: short, Expanded_url: expanded})
+	return status
+}
+
+// benchmarkTerms generates n distinct words and phrases
+func benchmarkTerms(n int) []string {
+	r := rand.New(rand.NewSource(int64(n)))
+	seen := make(map[string]bool)
+	var terms []string
+
+	word := func() string {
+		b := make([]byte, 5+r.Intn(6))
+		for i := range b {
+			b[i] = byte('a' + r.Intn(26))
+		}
+		return string(b)
 	}
 
-	// Expected result: True, pass
-	result = checkForProhibitedWords(anaconda.Tweet{Text: ""}, prohibitedWordsTest)
-	if !result {
-		t.Error("ProhibitedWords failed to block the word \"\" (listed in the test)")
+	for len(terms) < n {
+		term := word()
+		if r.Intn(5) == 0 {
+			term += " " + word()
+		}
+
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
 	}
 
+	return terms
+}
+
+// benchmarkTweet is a clean tweet, so every term has to be ruled out
+var benchmarkTweet = anaconda.Tweet{
+	ExtendedTweet: anaconda.ExtendedTweet{
+		FullText: "Watch the full highlight reel from last night's match 🎥 Incredible finish in the final minute, " +
+			"the crowd went wild! Thanks to everyone who came out to support the team. #GameDay #Highlights https://t.co/abcdef",
+	},
+}
+
+// BenchmarkCheckForProhibitedWords shows the cost of checking one tweet
+// as the number of terms grows. It should stay flat.
+func BenchmarkCheckForProhibitedWords(b *testing.B) {
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	for _, n := range []int{10, 1000, 10000, 50000} {
+		terms, err := compileProhibitedTerms(benchmarkTerms(n), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("terms=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if !checkForProhibitedWords(benchmarkTweet, terms) {
+					b.Fatal("Clean tweet was rejected")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCompileProhibitedTerms is the one-off cost at startup
+func BenchmarkCompileProhibitedTerms(b *testing.B) {
+	for _, n := range []int{1000, 50000} {
+		words := benchmarkTerms(n)
+
+		b.Run(fmt.Sprintf("terms=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := compileProhibitedTerms(words, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
 }
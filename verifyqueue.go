@@ -0,0 +1,272 @@
+// Deferred follow verification. When friendships/show is rate-limited or
+// fails, whether a user follows must_follow is unknown; it doesn't mean
+// they don't. Depending on follow_unknown, such tweets are rejected
+// (fail-closed, the default), let through (fail-open), or held in a queue
+// and re-checked once the rate limit window resets (wait).
+package main
+
+import (
+	"fmt"
+	"github.com/davidk/anaconda"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Values for settings.follow_unknown.policy
+const (
+	followUnknownFailClosed = "fail-closed"
+	followUnknownFailOpen   = "fail-open"
+	followUnknownWait       = "wait"
+)
+
+const (
+	defaultFollowMaxWaitSeconds = 3600
+	defaultFollowRetrySeconds   = 60
+	defaultFollowQueueSize      = 500
+)
+
+// followResult is the outcome of a follow check
+type followResult int
+
+const (
+	followNo followResult = iota
+	followYes
+	followUnknown
+)
+
+// FollowUnknownConfig configures what happens to tweets whose follow
+// check couldn't be answered
+type FollowUnknownConfig struct {
+	Policy         string `json:"policy"`
+	MaxWaitSeconds int    `json:"max_wait_seconds"`
+	RetrySeconds   int    `json:"retry_seconds"`
+	QueueSize      int    `json:"queue_size"`
+}
+
+// PendingTweet is a tweet that passed every check up to must_follow,
+// waiting for its follow check to be answered
+type PendingTweet struct {
+	API         APIInterface
+	Friendships FriendshipStatus
+	Status      anaconda.Tweet
+	TweetType   string
+	Decision    *Decision
+	QueuedAt    time.Time
+}
+
+// FollowVerifyQueue holds PendingTweets until they can be checked again
+type FollowVerifyQueue struct {
+	MaxWait time.Duration
+	Retry   time.Duration
+	Size    int
+
+	pending []PendingTweet
+	sync.Mutex
+}
+
+var (
+	// followQueue is nil unless follow_unknown.policy is "wait"
+	followQueue *FollowVerifyQueue
+
+	// When friendship lookups may be made again after a rate limit error
+	followLookupsResumeAt time.Time
+	followLookupsLock     sync.Mutex
+
+	followQueueLength = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "follow_queue_length",
+			Help: "Number of tweets waiting for their must_follow check to be answered.",
+		},
+	)
+)
+
+// NewFollowVerifyQueue creates a queue, filling in defaults
+func NewFollowVerifyQueue(c FollowUnknownConfig) *FollowVerifyQueue {
+	q := &FollowVerifyQueue{
+		MaxWait: time.Duration(c.MaxWaitSeconds) * time.Second,
+		Retry:   time.Duration(c.RetrySeconds) * time.Second,
+		Size:    c.QueueSize,
+	}
+
+	if q.MaxWait <= 0 {
+		q.MaxWait = defaultFollowMaxWaitSeconds * time.Second
+	}
+
+	if q.Retry <= 0 {
+		q.Retry = defaultFollowRetrySeconds * time.Second
+	}
+
+	if q.Size <= 0 {
+		q.Size = defaultFollowQueueSize
+	}
+
+	return q
+}
+
+// rateLimitReset returns when the rate limit window resets, if err is a
+// rate limit error
+func rateLimitReset(err error) (time.Time, bool) {
+	var apiErr *anaconda.ApiError
+
+	switch e := err.(type) {
+	case *anaconda.ApiError:
+		apiErr = e
+	case anaconda.ApiError:
+		apiErr = &e
+	default:
+		return time.Time{}, false
+	}
+
+	limited, nextWindow := apiErr.RateLimitCheck()
+	return nextWindow, limited
+}
+
+// noteFollowLookupError pauses friendship lookups until the rate limit
+// window resets, if err is a rate limit error
+func noteFollowLookupError(err error) {
+	if nextWindow, limited := rateLimitReset(err); limited {
+		followLookupsLock.Lock()
+		followLookupsResumeAt = nextWindow
+		followLookupsLock.Unlock()
+
+		log.Warnf("noteFollowLookupError: Friendship lookups are rate-limited until %v", nextWindow)
+	}
+}
+
+// followLookupsPaused reports whether we are waiting out a rate limit
+func followLookupsPaused() (time.Time, bool) {
+	followLookupsLock.Lock()
+	defer followLookupsLock.Unlock()
+
+	return followLookupsResumeAt, time.Now().Before(followLookupsResumeAt)
+}
+
+// handleFollowUnknown applies follow_unknown to a tweet whose follow check
+// couldn't be answered. Returns true if the tweet should be retweeted now.
+func handleFollowUnknown(p PendingTweet, c FollowUnknownConfig) bool {
+	switch c.Policy {
+	case followUnknownFailOpen:
+		log.Warnf("handleFollowUnknown: ALLOW - Unable to check whether %v follows must_follow, failing open", p.Status.User.ScreenName)
+		tweetsProcessed.WithLabelValues("mustFollowUnknown", "allow").Add(1)
+		p.Decision.passed("mustFollowUnknown")
+		return true
+
+	case followUnknownWait:
+		if followQueue != nil && followQueue.Defer(p) {
+			log.Infof("handleFollowUnknown: DEFER - Unable to check whether %v follows must_follow, queued tweet %v for a retry", p.Status.User.ScreenName, p.Status.Id)
+			tweetsProcessed.WithLabelValues("mustFollowUnknown", "defer").Add(1)
+			p.Decision.Verdict = "defer"
+			return false
+		}
+
+		log.Warnf("handleFollowUnknown: REJECT - Follow verification queue is full, dropping tweet %v", p.Status.Id)
+		p.Decision.rejected("mustFollowQueueFull", "follow check couldn't be answered, and the follow verification queue is full")
+		return false
+
+	default:
+		log.Warnf("handleFollowUnknown: REJECT - Unable to check whether %v follows must_follow, failing closed", p.Status.User.ScreenName)
+		p.Decision.rejected("mustFollowUnknown", "follow check couldn't be answered")
+		return false
+	}
+}
+
+// Defer queues a tweet. Returns false if the queue is full.
+func (q *FollowVerifyQueue) Defer(p PendingTweet) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.pending) >= q.Size {
+		return false
+	}
+
+	if p.QueuedAt.IsZero() {
+		p.QueuedAt = time.Now()
+	}
+
+	q.pending = append(q.pending, p)
+	followQueueLength.Set(float64(len(q.pending)))
+
+	return true
+}
+
+// Len returns the number of queued tweets
+func (q *FollowVerifyQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.pending)
+}
+
+// RetryPending re-checks queued tweets. Tweets that have waited longer
+// than MaxWait are dropped; tweets that are still unknown stay queued.
+// Tweets that now pass their follow check go through checkRecentActivity
+// again before they are retweeted.
+// Nothing is re-checked while lookups are rate-limited.
+func (q *FollowVerifyQueue) RetryPending(now time.Time) {
+	q.Lock()
+	pending := q.pending
+	q.pending = nil
+	q.Unlock()
+
+	_, paused := followLookupsPaused()
+
+	var keep []PendingTweet
+
+	for _, p := range pending {
+		if now.Sub(p.QueuedAt) > q.MaxWait {
+			log.Warnf("FollowVerifyQueue: REJECT - Gave up on tweet %v by %v after waiting %v", p.Status.Id, p.Status.User.ScreenName, now.Sub(p.QueuedAt))
+			p.Decision.rejected("mustFollowExpired", fmt.Sprintf("follow check still couldn't be answered after %v", now.Sub(p.QueuedAt)))
+			p.Decision.log(p.Status)
+			countTermVerdict(p.Decision, "reject")
+			continue
+		}
+
+		if paused {
+			keep = append(keep, p)
+			continue
+		}
+
+		switch checkMustFollow(p.Friendships, p.Status, config.Settings.MustFollow, config.Settings.MustFollowMode, config.Settings.MustFollowAtLeast) {
+		case followYes:
+			log.Infof("FollowVerifyQueue: OK - Tweet %v by %v passed its deferred follow check", p.Status.Id, p.Status.User.ScreenName)
+			p.Decision.passed("mustFollow")
+
+			// The user may have posted again, or the clip been approved,
+			// while the tweet waited
+			forgetOwnDeltas(p.Status, p.TweetType)
+			ok, posterHashes := checkRecentActivity(p.Status, p.TweetType, p.Decision)
+			if !ok {
+				log.Infof("FollowVerifyQueue: REJECT - Tweet %v by %v failed its checks again after waiting", p.Status.Id, p.Status.User.ScreenName)
+				p.Decision.log(p.Status)
+				countTermVerdict(p.Decision, "reject")
+				continue
+			}
+
+			retweetApproved(p.API, p.Status, p.TweetType, p.Decision, posterHashes)
+			p.Decision.log(p.Status)
+			countTermVerdict(p.Decision, "allow")
+		case followNo:
+			log.Infof("FollowVerifyQueue: REJECT - Tweet %v by %v failed its deferred follow check", p.Status.Id, p.Status.User.ScreenName)
+			p.Decision.rejected("mustFollow", "user doesn't follow enough of the must_follow accounts")
+			p.Decision.log(p.Status)
+			countTermVerdict(p.Decision, "reject")
+		default:
+			keep = append(keep, p)
+		}
+	}
+
+	q.Lock()
+	q.pending = append(keep, q.pending...)
+	followQueueLength.Set(float64(len(q.pending)))
+	q.Unlock()
+}
+
+// Run retries the queue every Retry interval
+func (q *FollowVerifyQueue) Run() {
+	for now := range time.Tick(q.Retry) {
+		if q.Len() > 0 {
+			q.RetryPending(now)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"github.com/davidk/anaconda"
+	"github.com/davidk/memberset"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// FakeFlakyFriendships fails with Err until it is cleared, then answers
+// with Follows. Calls counts the lookups made.
+type FakeFlakyFriendships struct {
+	Err     error
+	Follows bool
+	Calls   int
+}
+
+func (f *FakeFlakyFriendships) GetFriendshipStatus(v url.Values) (anaconda.RelationshipResponse, error) {
+	f.Calls++
+	if f.Err != nil {
+		return anaconda.RelationshipResponse{}, f.Err
+	}
+
+	r := anaconda.RelationshipResponse{}
+	r.Relationship.Source.Following = f.Follows
+	r.Relationship.Target.Following = f.Follows
+	return r, nil
+}
+
+func TestCheckFollowTargetUnknown(t *testing.T) {
+
+	tweetOriginatorLRU = newStateCache("tweetOriginator", 128)
+	defer func() { followLookupsResumeAt = time.Time{} }()
+
+	status := anaconda.Tweet{User: anaconda.User{ScreenName: "flaky"}}
+	target := FollowTarget{ScreenName: "studio"}
+
+	fs := &FakeFlakyFriendships{Err: errors.New("connection reset by peer")}
+
+	if result := checkFollowTarget(fs, status, target); result != followUnknown {
+		t.Errorf("A failed lookup should be unknown, got %v", result)
+	}
+
+	// Unknown must not be cached, so the next check asks again
+	fs.Err, fs.Follows = nil, true
+	if result := checkFollowTarget(fs, status, target); result != followYes || fs.Calls != 2 {
+		t.Errorf("Wanted a fresh lookup that passes, got %v after %d calls", result, fs.Calls)
+	}
+
+	// A rate limit error pauses lookups until the window resets
+	reset := time.Now().Add(10 * time.Minute)
+	fs.Err = &anaconda.ApiError{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"X-Rate-Limit-Reset": []string{strconv.FormatInt(reset.Unix(), 10)}},
+		URL:        &url.URL{},
+	}
+
+	limited := anaconda.Tweet{User: anaconda.User{ScreenName: "limited"}}
+	if result := checkFollowTarget(fs, limited, target); result != followUnknown {
+		t.Errorf("A rate-limited lookup should be unknown, got %v", result)
+	}
+
+	if _, paused := followLookupsPaused(); !paused {
+		t.Fatal("Lookups were not paused after a rate limit error")
+	}
+
+	calls := fs.Calls
+	fs.Err = nil
+	if result := checkFollowTarget(fs, anaconda.Tweet{User: anaconda.User{ScreenName: "waiting"}}, target); result != followUnknown || fs.Calls != calls {
+		t.Errorf("Lookups should not be made while rate-limited (result %v, %d new calls)", result, fs.Calls-calls)
+	}
+}
+
+func TestHandleFollowUnknown(t *testing.T) {
+
+	saved := followQueue
+	defer func() { followQueue = saved }()
+
+	followQueue = NewFollowVerifyQueue(FollowUnknownConfig{QueueSize: 1})
+
+	pending := func() PendingTweet {
+		return PendingTweet{Status: anaconda.Tweet{Id: 1}, Decision: &Decision{}}
+	}
+
+	var tests = []struct {
+		Policy   string
+		Output   bool
+		QueueLen int
+	}{
+		{"", false, 0},
+		{followUnknownFailClosed, false, 0},
+		{followUnknownFailOpen, true, 0},
+		{followUnknownWait, false, 1},
+		// Queue is full
+		{followUnknownWait, false, 1},
+	}
+
+	for _, test := range tests {
+		if result := handleFollowUnknown(pending(), FollowUnknownConfig{Policy: test.Policy}); result != test.Output {
+			t.Errorf("Policy %q: wanted %v, got %v", test.Policy, test.Output, result)
+		}
+
+		if n := followQueue.Len(); n != test.QueueLen {
+			t.Errorf("Policy %q: wanted %d queued, got %d", test.Policy, test.QueueLen, n)
+		}
+	}
+}
+
+func TestFollowVerifyQueueRetry(t *testing.T) {
+
+	savedTargets, savedMode := config.Settings.MustFollow, config.Settings.MustFollowMode
+	defer func() { config.Settings.MustFollow, config.Settings.MustFollowMode = savedTargets, savedMode }()
+
+	config.Settings.MustFollow = FollowTargets{{ScreenName: "studio"}}
+	config.Settings.MustFollowMode = ""
+	tweetOriginatorLRU = newStateCache("tweetOriginator", 128)
+	followLookupsResumeAt = time.Time{}
+
+	q := NewFollowVerifyQueue(FollowUnknownConfig{MaxWaitSeconds: 60})
+	now := time.Now()
+
+	fs := &FakeFlakyFriendships{Err: errors.New("over capacity")}
+
+	queue := func(id int64, user string, queuedAt time.Time) *Decision {
+		d := &Decision{}
+		q.Defer(PendingTweet{
+			API:         FakeAPIRetweet{},
+			Friendships: fs,
+			Status:      anaconda.Tweet{Id: id, CreatedAt: "Wed Aug 27 13:08:45 +0000 2008", User: anaconda.User{Id: id, ScreenName: user}},
+			TweetType:   "video",
+			Decision:    d,
+			QueuedAt:    queuedAt,
+		})
+		return d
+	}
+
+	fresh := queue(1, "patient", now)
+	queue(2, "impatient", now.Add(-2*time.Minute))
+
+	// As if the tweet had passed the post delta in processTweet. Its own
+	// entry must not hold it back when it is checked again.
+	defer func(delta int) { config.Settings.PostTimeDelta = delta }(config.Settings.PostTimeDelta)
+	config.Settings.PostTimeDelta = 3600
+	userPostDeltaLRU.Add(int64(1), time.Date(2008, 8, 27, 13, 8, 45, 0, time.UTC))
+
+	// Still failing: the expired tweet is dropped, the other is kept
+	q.RetryPending(now)
+	if n := q.Len(); n != 1 {
+		t.Fatalf("Wanted 1 tweet still queued, got %d", n)
+	}
+
+	// The API is back and the user follows
+	fs.Err, fs.Follows = nil, true
+	q.RetryPending(now)
+
+	if n := q.Len(); n != 0 {
+		t.Errorf("Wanted an empty queue, got %d", n)
+	}
+
+	if fresh.Verdict != "allow" {
+		t.Errorf("Deferred tweet was not approved: %+v", fresh)
+	}
+}
+
+// TestFollowVerifyQueueRecheck queues a clip whose follow check is unknown,
+// then approves the same clip from someone else while it waits. The queued
+// tweet must not be retweeted once its follow check passes.
+func TestFollowVerifyQueueRecheck(t *testing.T) {
+
+	defer func(targets FollowTargets, c FollowUnknownConfig, q *FollowVerifyQueue) {
+		config.Settings.MustFollow, config.Settings.FollowUnknown, followQueue = targets, c, q
+	}(config.Settings.MustFollow, config.Settings.FollowUnknown, followQueue)
+
+	mutedIds = memberset.New()
+	tweetOriginatorLRU = newStateCache("tweetOriginator", 128)
+	urlLRU = newStateCache("url", 128)
+	followLookupsResumeAt = time.Time{}
+
+	config.Settings.MustFollow = FollowTargets{{ScreenName: "studio"}}
+	config.Settings.FollowUnknown = FollowUnknownConfig{Policy: followUnknownWait}
+	followQueue = NewFollowVerifyQueue(config.Settings.FollowUnknown)
+
+	clip := func(id int64, screenName string, text string) anaconda.Tweet {
+		return anaconda.Tweet{
+			Id:        id,
+			CreatedAt: "Wed Aug 27 13:08:45 +0000 2008",
+			Text:      text,
+			User:      anaconda.User{Id: id, ScreenName: screenName, CreatedAt: "Wed Aug 27 13:08:45 +0000 2008"},
+			ExtendedEntities: anaconda.Entities{
+				Media: []anaconda.EntityMedia{
+					{Id_str: "770770", Type: "video",
+						VideoInfo: anaconda.VideoInfo{
+							Variants: []anaconda.Variant{
+								{ContentType: "video/mp4", Url: "https://video.twimg.com/ext_tw_video/770770/vid/clip.mp4"},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	fs := &FakeFlakyFriendships{Err: errors.New("over capacity")}
+
+	if processTweet(FakeAPIRetweet{}, fs, clip(770001, "waiting", "first upload, follow check unknown")) {
+		t.Fatal("Expected the tweet to be deferred")
+	}
+	if n := followQueue.Len(); n != 1 {
+		t.Fatalf("Wanted 1 tweet queued, got %d", n)
+	}
+	deferred := followQueue.pending[0].Decision
+
+	// The same clip is approved while the first tweet waits
+	fs.Err, fs.Follows = nil, true
+	if !processTweet(FakeAPIRetweet{}, fs, clip(770002, "quick", "the same clip, approved first")) {
+		t.Fatal("Expected the second upload to be approved")
+	}
+
+	followQueue.RetryPending(time.Now())
+
+	if n := followQueue.Len(); n != 0 {
+		t.Errorf("Wanted an empty queue, got %d", n)
+	}
+
+	if deferred.Verdict != "reject" || deferred.RejectedBy != "duplicateMedia" {
+		t.Errorf("The queued duplicate was not rejected: %+v", deferred)
+	}
+}
@@ -0,0 +1,236 @@
+// Outbound webhooks. Every approved tweet is POSTed as JSON to the
+// configured endpoints, so other rooms/services can mirror the feed
+// without scraping the bot's timeline.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// WebhookSignatureHeader carries the hex HMAC-SHA256 of the request body,
+	// keyed with the webhook's secret: "sha256=<hex>"
+	WebhookSignatureHeader = "X-Chim-Signature"
+
+	defaultWebhookAttempts       = 5
+	defaultWebhookBackoffSeconds = 2
+)
+
+var (
+	// Unit for webhook backoff. Tests shrink this so retries are quick.
+	webhookBackoffUnit = time.Second
+
+	webhookClient = &http.Client{Timeout: 15 * time.Second}
+
+	// Serializes writes to dead-letter files, which may be shared by hooks
+	deadLetterLock sync.Mutex
+
+	webhookDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_deliveries",
+			Help: "Number of webhook delivery attempts, by outcome.",
+		},
+		// webhook == configured name (or host) of the webhook
+		// result == ok, retry, dead_letter
+		[]string{"webhook", "result"},
+	)
+)
+
+// WebhookConfig is a single outbound webhook
+type WebhookConfig struct {
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	Secret         string `json:"secret"`
+	MaxAttempts    int    `json:"max_attempts"`
+	BackoffSeconds int    `json:"backoff_seconds"`
+	DeadLetterFile string `json:"dead_letter_file"`
+}
+
+// label names the webhook in logs and metrics
+func (hook WebhookConfig) label() string {
+	if hook.Name != "" {
+		return hook.Name
+	}
+	if u, err := url.Parse(hook.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return hook.URL
+}
+
+// deadLetter is a line in a webhook's dead-letter file
+type deadLetter struct {
+	Webhook  string          `json:"webhook"`
+	URL      string          `json:"url"`
+	FailedAt time.Time       `json:"failed_at"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// webhookError is a failed delivery. Retry is false for responses that
+// will not get better by sending the same payload again (most 4xx).
+type webhookError struct {
+	Status int
+	Retry  bool
+	Err    error
+}
+
+func (e *webhookError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("webhook returned HTTP %d", e.Status)
+}
+
+// signWebhookPayload returns the value for WebhookSignatureHeader
+func signWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// publishWebhooks sends an approved item to every webhook. Each webhook
+// is delivered (and retried) on its own goroutine, so a slow endpoint
+// does not hold up the others, or the stream.
+func publishWebhooks(hooks []WebhookConfig, item ApprovedItem) {
+	if len(hooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(item)
+	if err != nil {
+		log.Errorf("publishWebhooks: Unable to marshal tweet %v: %v", item.TweetID, err)
+		return
+	}
+
+	for _, hook := range hooks {
+		go deliverWebhook(hook, body)
+	}
+}
+
+// deliverWebhook POSTs body to the webhook, backing off exponentially
+// between attempts. When the attempts run out the payload is written to
+// the webhook's dead-letter file (if it has one).
+func deliverWebhook(hook WebhookConfig, body []byte) error {
+	attempts := hook.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultWebhookAttempts
+	}
+
+	backoff := time.Duration(hook.BackoffSeconds) * webhookBackoffUnit
+	if hook.BackoffSeconds <= 0 {
+		backoff = defaultWebhookBackoffSeconds * webhookBackoffUnit
+	}
+
+	var err error
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = postWebhook(hook, body); err == nil {
+			log.Infof("deliverWebhook: Delivered to %v (attempt %d)", hook.label(), attempt)
+			webhookDeliveries.WithLabelValues(hook.label(), "ok").Add(1)
+			return nil
+		}
+
+		if e, ok := err.(*webhookError); ok && !e.Retry {
+			log.Warnf("deliverWebhook: %v refused the payload, not retrying: %v", hook.label(), err)
+			break
+		}
+
+		if attempt < attempts {
+			log.Warnf("deliverWebhook: Attempt %d/%d to %v failed, retrying in %v: %v", attempt, attempts, hook.label(), backoff, err)
+			webhookDeliveries.WithLabelValues(hook.label(), "retry").Add(1)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	log.Errorf("deliverWebhook: Giving up on %v: %v", hook.label(), err)
+	webhookDeliveries.WithLabelValues(hook.label(), "dead_letter").Add(1)
+
+	if dlErr := writeDeadLetter(hook, body, err); dlErr != nil {
+		log.Errorf("deliverWebhook: Unable to write dead letter for %v: %v", hook.label(), dlErr)
+	}
+
+	return err
+}
+
+// postWebhook makes a single delivery attempt
+func postWebhook(hook WebhookConfig, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return &webhookError{Err: err}
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chim/"+gitCommit)
+	if hook.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, signWebhookPayload(hook.Secret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return &webhookError{Retry: true, Err: err}
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return &webhookError{Status: resp.StatusCode, Retry: true}
+	default:
+		return &webhookError{Status: resp.StatusCode}
+	}
+}
+
+// writeDeadLetter appends a failed payload to the webhook's dead-letter
+// file, one JSON object per line
+func writeDeadLetter(hook WebhookConfig, body []byte, cause error) error {
+	if hook.DeadLetterFile == "" {
+		return nil
+	}
+
+	entry := deadLetter{
+		Webhook:  hook.label(),
+		URL:      hook.URL,
+		FailedAt: time.Now().UTC(),
+		Payload:  json.RawMessage(body),
+	}
+	if cause != nil {
+		entry.Error = cause.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+
+	f, err := os.OpenFile(hook.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
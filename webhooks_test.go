@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	webhookBackoffUnit = time.Millisecond
+}
+
+// TestDeliverWebhook checks that a payload arrives with a valid signature,
+// and that a flaky endpoint gets retried until it accepts the payload
+func TestDeliverWebhook(t *testing.T) {
+	var calls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if got := r.Header.Get(WebhookSignatureHeader); got != signWebhookPayload("hunter2", body) {
+			t.Errorf("Signature mismatch. Got: %v", got)
+		}
+
+		// Fail the first two attempts
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		var item ApprovedItem
+		if err := json.Unmarshal(body, &item); err != nil || item.TweetID != 1234 {
+			t.Errorf("Unexpected payload: %v (err: %v)", string(body), err)
+		}
+	}))
+	defer server.Close()
+
+	body, _ := json.Marshal(ApprovedItem{TweetID: 1234})
+	hook := WebhookConfig{Name: "test", URL: server.URL, Secret: "hunter2", MaxAttempts: 5, BackoffSeconds: 1}
+
+	if err := deliverWebhook(hook, body); err != nil {
+		t.Errorf("Delivery failed: %v", err)
+	}
+
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts, got %v", calls)
+	}
+}
+
+// TestDeliverWebhookDeadLetter ensures that payloads which can't be
+// delivered end up in the dead-letter file, and that 4xx responses are
+// not retried
+func TestDeliverWebhookDeadLetter(t *testing.T) {
+	var calls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	deadLetterFile := filepath.Join(t.TempDir(), "dead.jsonl")
+	hook := WebhookConfig{URL: server.URL, MaxAttempts: 3, DeadLetterFile: deadLetterFile}
+
+	if err := deliverWebhook(hook, []byte(`{"tweet_id":1}`)); err == nil {
+		t.Error("Expected delivery to fail")
+	}
+
+	if calls != 1 {
+		t.Errorf("A 400 should not be retried. Got %v attempts", calls)
+	}
+
+	// A second failure appends to the same file
+	deliverWebhook(hook, []byte(`{"tweet_id":2}`))
+
+	data, err := ioutil.ReadFile(deadLetterFile)
+	if err != nil {
+		t.Fatalf("Unable to read dead-letter file: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 dead letters, got %v", len(lines))
+	}
+
+	var entry deadLetter
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("Dead letter is not JSON: %v", err)
+	}
+
+	if string(entry.Payload) != `{"tweet_id":2}` || entry.Error == "" {
+		t.Errorf("Unexpected dead letter: %+v", entry)
+	}
+}